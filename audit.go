@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// auditRecord is a line of the audit log, written for every change the bot
+// makes to labels and project boards.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// Delivery, Event and Sender describe the webhook that caused the change,
+	// empty for changes made by subcommands
+	Delivery string `json:"delivery,omitempty"`
+	Event    string `json:"event,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	// Action is the GitHub call made, like MoveProjectCard
+	Action    string      `json:"action"`
+	Owner     string      `json:"owner"`
+	Repo      string      `json:"repo,omitempty"`
+	Issue     int         `json:"issue,omitempty"`
+	ProjectID int         `json:"project_id,omitempty"`
+	Project   string      `json:"project,omitempty"`
+	Before    *auditState `json:"before,omitempty"`
+	After     *auditState `json:"after,omitempty"`
+	// DryRun changes were only pretended
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// auditState is a label, card, column or project before or after a change,
+// nil if it didn't exist.
+type auditState struct {
+	Label       string `json:"label,omitempty"`
+	Color       string `json:"color,omitempty"`
+	CardID      int    `json:"card_id,omitempty"`
+	ColumnID    int    `json:"column_id,omitempty"`
+	Column      string `json:"column,omitempty"`
+	ContentID   int    `json:"content_id,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// State is whether a project is open or closed
+	State string `json:"state,omitempty"`
+}
+
+// auditLog appends audit records to a JSON lines file.
+type auditLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens the audit log at path for appending. An empty path
+// turns auditing off.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, file: file}, nil
+}
+
+// write appends a record. The change has already been made by then, so
+// failing to record it is logged rather than failing the delivery.
+func (l *auditLog) write(r *auditRecord) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("Could not encode audit record %+v: %v", r, err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Errorf("Could not write audit record %s: %v", line, err)
+	}
+}
+
+// query returns the records matching the filter, oldest first.
+func (l *auditLog) query(f *auditFilter) ([]*auditRecord, error) {
+	if l == nil {
+		return nil, fmt.Errorf("the audit log is turned off")
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []*auditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		r := &auditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			// A line cut short by a crash shouldn't hide the rest
+			log.Warnf("Skipping unreadable audit record in %s: %v", l.path, err)
+			continue
+		}
+		if f.match(r) {
+			records = append(records, r)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// auditFilter selects audit records, empty fields matching everything.
+type auditFilter struct {
+	Delivery string
+	Owner    string
+	Repo     string
+	Issue    int
+	// Project matches the name or ID of the project
+	Project string
+	User    string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f *auditFilter) match(r *auditRecord) bool {
+	switch {
+	case f.Delivery != "" && r.Delivery != f.Delivery:
+	case f.Owner != "" && !strings.EqualFold(r.Owner, f.Owner):
+	case f.Repo != "" && !strings.EqualFold(r.Repo, f.Repo):
+	case f.Issue != 0 && r.Issue != f.Issue:
+	case f.Project != "" && r.Project != f.Project && strconv.Itoa(r.ProjectID) != f.Project:
+	case f.User != "" && !strings.EqualFold(r.Sender, f.User):
+	case !f.Since.IsZero() && r.Time.Before(f.Since):
+	case !f.Until.IsZero() && r.Time.After(f.Until):
+	default:
+		return true
+	}
+	return false
+}
+
+// parseAuditFilter builds a filter out of the delivery, repo (owner/name or
+// an organization), issue, project, user, since and until parameters. Times
+// are RFC 3339 or a duration before now, like 24h.
+func parseAuditFilter(get func(string) string) (*auditFilter, error) {
+	f := &auditFilter{
+		Delivery: get("delivery"),
+		Project:  get("project"),
+		User:     get("user"),
+	}
+	f.Owner, f.Repo = splitBoard(get("repo"))
+	if issue := get("issue"); issue != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(issue, "#"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid issue %q", issue)
+		}
+		f.Issue = n
+	}
+	var err error
+	if f.Since, err = parseAuditTime(get("since")); err != nil {
+		return nil, err
+	}
+	if f.Until, err = parseAuditTime(get("until")); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or a duration like 24h", s)
+	}
+	return t, nil
+}
+
+// record writes an audit record, filling in the time and the delivery the
+// monitor is handling.
+func (mon *githubMonitor) record(r *auditRecord) {
+	r.Time = time.Now().UTC()
+	r.DryRun = mon.dryRun
+	if d := mon.delivery; d != nil {
+		r.Delivery, r.Event, r.Sender = d.ID, d.Event, payloadSender(d.Payload)
+	}
+	mon.audit.write(r)
+}
+
+func cardState(cardID int, column *github.ProjectColumn, item *boardItem) *auditState {
+	return &auditState{
+		CardID:      cardID,
+		ColumnID:    column.GetID(),
+		Column:      column.GetName(),
+		ContentID:   item.ContentID,
+		ContentType: item.ContentType,
+	}
+}
+
+// addLabels adds labels to an issue or pull request.
+func (mon *githubMonitor) addLabels(ctx context.Context, owner, name string, number int, labels []string) error {
+	for _, label := range labels {
+		mon.expectEcho(labelEchoKey("labeled", owner, name, number, label))
+	}
+	if _, _, err := mon.client.Issues.AddLabelsToIssue(ctx, owner, name, number, labels); err != nil {
+		return err
+	}
+	for _, label := range labels {
+		mon.record(&auditRecord{
+			Action: "AddLabelsToIssue",
+			Owner:  owner,
+			Repo:   name,
+			Issue:  number,
+			After:  &auditState{Label: label},
+		})
+	}
+	return nil
+}
+
+// removeLabel removes a label from an issue or pull request. The response is
+// returned so callers can tell a label that was already gone apart.
+func (mon *githubMonitor) removeLabel(ctx context.Context, owner, name string, number int, label string) (*github.Response, error) {
+	mon.expectEcho(labelEchoKey("unlabeled", owner, name, number, label))
+	resp, err := mon.client.Issues.RemoveLabelForIssue(ctx, owner, name, number, label)
+	if err != nil {
+		return resp, err
+	}
+	mon.record(&auditRecord{
+		Action: "RemoveLabelForIssue",
+		Owner:  owner,
+		Repo:   name,
+		Issue:  number,
+		Before: &auditState{Label: label},
+	})
+	return resp, nil
+}
+
+// createLabel creates a label in a repository.
+func (mon *githubMonitor) createLabel(ctx context.Context, owner, name, label, color string) error {
+	if _, _, err := mon.client.Issues.CreateLabel(ctx, owner, name, &github.Label{Name: &label, Color: &color}); err != nil {
+		return err
+	}
+	mon.record(&auditRecord{
+		Action: "CreateLabel",
+		Owner:  owner,
+		Repo:   name,
+		After:  &auditState{Label: label, Color: color},
+	})
+	return nil
+}
+
+// createColumn adds a column to the project of owner/name, or of the
+// organization owner if name is empty.
+func (mon *githubMonitor) createColumn(ctx context.Context, owner, name string, projectID int, projectName, column string) error {
+	created, _, err := mon.client.Projects.CreateProjectColumn(ctx, projectID, &github.ProjectColumnOptions{Name: column})
+	if err != nil {
+		return err
+	}
+	mon.record(&auditRecord{
+		Action:    "CreateProjectColumn",
+		Owner:     owner,
+		Repo:      name,
+		ProjectID: projectID,
+		Project:   projectName,
+		After:     &auditState{ColumnID: created.GetID(), Column: column},
+	})
+	return nil
+}
+
+// createProject creates a project of owner/name, or of the organization owner
+// if name is empty.
+func (mon *githubMonitor) createProject(ctx context.Context, owner, name string, opt *github.ProjectOptions) (*github.Project, error) {
+	var project *github.Project
+	var err error
+	if name == "" {
+		project, _, err = mon.client.Organizations.CreateProject(ctx, owner, opt)
+	} else {
+		project, _, err = mon.client.Repositories.CreateProject(ctx, owner, name, opt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mon.record(&auditRecord{
+		Action:    "CreateProject",
+		Owner:     owner,
+		Repo:      name,
+		ProjectID: project.GetID(),
+		Project:   opt.Name,
+		After:     &auditState{State: "open"},
+	})
+	return project, nil
+}
+
+// setProjectState opens or closes a project of owner/name. The vendored
+// go-github can't set the state of a project.
+func (mon *githubMonitor) setProjectState(ctx context.Context, owner, name string, project *github.Project, state string) error {
+	req, err := mon.client.NewRequest("PATCH", fmt.Sprintf("projects/%d", project.GetID()), map[string]string{"state": state})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.inertia-preview+json")
+	if _, err := mon.client.Do(ctx, req, nil); err != nil {
+		return err
+	}
+	before := "open"
+	if state == "open" {
+		before = "closed"
+	}
+	mon.record(&auditRecord{
+		Action:    "UpdateProject",
+		Owner:     owner,
+		Repo:      name,
+		ProjectID: project.GetID(),
+		Project:   project.GetName(),
+		Before:    &auditState{State: before},
+		After:     &auditState{State: state},
+	})
+	return nil
+}
+
+// createCard adds a card for item to a column of project. The response is
+// returned so callers can tell a card that already exists apart.
+func (mon *githubMonitor) createCard(ctx context.Context, project *github.Project, column *github.ProjectColumn, item *boardItem) (*github.ProjectCard, *github.Response, error) {
+	card, resp, err := mon.client.Projects.CreateProjectCard(ctx, *column.ID, &github.ProjectCardOptions{
+		ContentID:   item.ContentID,
+		ContentType: item.ContentType,
+	})
+	if err != nil {
+		return nil, resp, err
+	}
+	// The ID of the card is only known now, its webhook is still some way off
+	mon.expectEcho(cardEchoKey("created", *card.ID, *column.ID))
+	mon.record(&auditRecord{
+		Action:    "CreateProjectCard",
+		Owner:     item.Owner,
+		Repo:      item.Repo,
+		Issue:     item.Number,
+		ProjectID: project.GetID(),
+		Project:   project.GetName(),
+		After:     cardState(*card.ID, column, item),
+	})
+	mon.cardMoved(project)
+	return card, resp, nil
+}
+
+// moveCard moves the card of item to the top of another column of project.
+func (mon *githubMonitor) moveCard(ctx context.Context, project *github.Project, item *boardItem, cardID int, from, to *github.ProjectColumn) error {
+	mon.expectEcho(cardEchoKey("moved", cardID, *to.ID))
+	_, err := mon.client.Projects.MoveProjectCard(ctx, cardID, &github.ProjectCardMoveOptions{
+		Position: "top",
+		ColumnID: *to.ID,
+	})
+	if err != nil {
+		return err
+	}
+	mon.record(&auditRecord{
+		Action:    "MoveProjectCard",
+		Owner:     item.Owner,
+		Repo:      item.Repo,
+		Issue:     item.Number,
+		ProjectID: project.GetID(),
+		Project:   project.GetName(),
+		Before:    cardState(cardID, from, item),
+		After:     cardState(cardID, to, item),
+	})
+	mon.cardMoved(project)
+	return nil
+}
+
+// cardMoved counts a card created or moved in project, unless it wasn't.
+func (mon *githubMonitor) cardMoved(project *github.Project) {
+	if !mon.dryRun {
+		mon.metrics.cardsMoved.add(1, project.GetName())
+	}
+}
+
+// deleteCard deletes the card of item from a column of project.
+func (mon *githubMonitor) deleteCard(ctx context.Context, project *github.Project, item *boardItem, cardID int, column *github.ProjectColumn) error {
+	mon.expectEcho(cardEchoKey("deleted", cardID, column.GetID()))
+	if _, err := mon.client.Projects.DeleteProjectCard(ctx, cardID); err != nil {
+		return err
+	}
+	mon.record(&auditRecord{
+		Action:    "DeleteProjectCard",
+		Owner:     item.Owner,
+		Repo:      item.Repo,
+		Issue:     item.Number,
+		ProjectID: project.GetID(),
+		Project:   project.GetName(),
+		Before:    cardState(cardID, column, item),
+	})
+	return nil
+}
+
+// authorized checks the admin token of a request to an admin endpoint.
+func (mon *githubMonitor) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(mon.adminToken) == 0 || subtle.ConstantTimeCompare([]byte(token), mon.adminToken) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleAudit serves the audit records matching the query parameters as JSON
+// lines.
+func (mon *githubMonitor) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !mon.authorized(w, r) {
+		return
+	}
+	f, err := parseAuditFilter(r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := mon.audit.query(f)
+	if err != nil {
+		log.Errorf("%s Could not query audit log: %v", r.URL, err)
+		http.Error(w, "Could not query audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		enc.Encode(record)
+	}
+}
+
+// auditFlags defines the flags of the audit filter parameters.
+func auditFlags(flags *flag.FlagSet) map[string]*string {
+	params := make(map[string]*string)
+	for _, p := range []struct{ name, usage string }{
+		{"delivery", "Only changes made for this webhook delivery"},
+		{"repo", "Only changes to this repository, owner/name, or organization"},
+		{"issue", "Only changes to this issue or pull request number"},
+		{"project", "Only changes to this project, by name or ID"},
+		{"user", "Only changes caused by this GitHub user"},
+		{"since", "Only changes since this RFC 3339 time or duration ago, like 24h"},
+		{"until", "Only changes until this RFC 3339 time or duration ago"},
+	} {
+		params[p.name] = flags.String(p.name, "", p.usage)
+	}
+	return params
+}
+
+// auditCommand prints the audit records matching its flags as JSON lines:
+//
+//	release-bot audit [-delivery id] [-repo owner/name|org] [-issue n] [-project name|id] [-user login] [-since 24h] [-until time]
+func auditCommand(mon *githubMonitor, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	params := auditFlags(flags)
+	flags.Parse(args)
+	f, err := parseAuditFilter(func(name string) string { return *params[name] })
+	if err != nil {
+		return err
+	}
+	records, err := mon.audit.query(f)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// newTestAuditLog opens an audit log in a temporary directory.
+func newTestAuditLog(t *testing.T) (*auditLog, func()) {
+	dir, err := ioutil.TempDir("", "release-bot-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := openAuditLog(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return audit, func() {
+		audit.file.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	audit, cleanup := newTestAuditLog(t)
+	defer cleanup()
+	now := time.Now().UTC()
+	records := []*auditRecord{
+		{Time: now.Add(-48 * time.Hour), Delivery: "a", Sender: "alice", Action: "AddLabelsToIssue", Owner: "docker", Repo: "cli", Issue: 1},
+		{Time: now.Add(-time.Hour), Delivery: "b", Sender: "bob", Action: "MoveProjectCard", Owner: "docker", Repo: "cli", Issue: 2, ProjectID: 5, Project: "17.06.1-ee-1"},
+		{Time: now, Action: "CreateProjectColumn", Owner: "docker", ProjectID: 6, Project: "17.06.2-ee-1"},
+	}
+	for _, r := range records {
+		audit.write(r)
+	}
+	// A line cut short by a crash is skipped
+	audit.file.WriteString(`{"time":`)
+	tests := []struct {
+		name   string
+		filter *auditFilter
+		want   []string
+	}{
+		{"everything", &auditFilter{}, []string{"AddLabelsToIssue", "MoveProjectCard", "CreateProjectColumn"}},
+		{"delivery", &auditFilter{Delivery: "b"}, []string{"MoveProjectCard"}},
+		{"repository", &auditFilter{Owner: "Docker", Repo: "CLI"}, []string{"AddLabelsToIssue", "MoveProjectCard"}},
+		{"issue", &auditFilter{Issue: 1}, []string{"AddLabelsToIssue"}},
+		{"project name", &auditFilter{Project: "17.06.2-ee-1"}, []string{"CreateProjectColumn"}},
+		{"project ID", &auditFilter{Project: "5"}, []string{"MoveProjectCard"}},
+		{"user", &auditFilter{User: "Alice"}, []string{"AddLabelsToIssue"}},
+		{"since", &auditFilter{Since: now.Add(-24 * time.Hour)}, []string{"MoveProjectCard", "CreateProjectColumn"}},
+		{"until", &auditFilter{Until: now.Add(-24 * time.Hour)}, []string{"AddLabelsToIssue"}},
+	}
+	for _, tt := range tests {
+		got, err := audit.query(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actions []string
+		for _, r := range got {
+			actions = append(actions, r.Action)
+		}
+		if strings.Join(actions, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: query() = %v, want %v", tt.name, actions, tt.want)
+		}
+	}
+}
+
+func TestAuditLogOff(t *testing.T) {
+	audit, err := openAuditLog("")
+	if audit != nil || err != nil {
+		t.Fatalf("openAuditLog(\"\") = %v, %v, want no log", audit, err)
+	}
+	// Writing to a log that is off does nothing
+	audit.write(&auditRecord{Action: "CreateLabel"})
+	if _, err := audit.query(&auditFilter{}); err == nil {
+		t.Errorf("query() of a log that is off succeeded")
+	}
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	params := map[string]string{"repo": "docker/cli", "issue": "#42", "project": "17.06.1-ee-1", "since": "24h", "until": "2017-08-01T00:00:00Z"}
+	f, err := parseAuditFilter(func(name string) string { return params[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Owner != "docker" || f.Repo != "cli" || f.Issue != 42 || f.Project != "17.06.1-ee-1" {
+		t.Errorf("parseAuditFilter(%v) = %+v", params, f)
+	}
+	if since := time.Since(f.Since); since < 24*time.Hour || since > 25*time.Hour {
+		t.Errorf("since 24h is %v ago", since)
+	}
+	if want := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC); !f.Until.Equal(want) {
+		t.Errorf("until is %v, want %v", f.Until, want)
+	}
+	for _, bad := range []map[string]string{{"issue": "one"}, {"since": "yesterday"}, {"until": "2017-08-01"}} {
+		if _, err := parseAuditFilter(func(name string) string { return bad[name] }); err == nil {
+			t.Errorf("parseAuditFilter(%v) succeeded", bad)
+		}
+	}
+}
+
+func TestChangesAreAudited(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"POST /repos/docker/cli/issues/1/labels":                       {body: `[{"name":"17.06.1-ee-1/triage"}]`},
+		"POST /projects/columns/cards/31/moves":                        {code: http.StatusCreated, body: `{}`},
+		"DELETE /repos/docker/cli/issues/1/labels/17.06.1-ee-1/triage": {code: http.StatusNoContent},
+	})
+	defer fake.Close()
+	audit, cleanup := newTestAuditLog(t)
+	defer cleanup()
+	mon := &githubMonitor{
+		ctx:      context.Background(),
+		client:   fake.client(),
+		audit:    audit,
+		metrics:  newMetrics(),
+		delivery: &delivery{ID: "d1", Event: "issues", Payload: []byte(`{"sender":{"login":"alice"}}`)},
+	}
+	ctx := context.Background()
+	item := &boardItem{Owner: "docker", Repo: "cli", Number: 1, ContentID: 101, ContentType: "Issue"}
+	project := &github.Project{ID: github.Int(5), Name: github.String("17.06.1-ee-1")}
+	triage := &github.ProjectColumn{ID: github.Int(21), Name: github.String("Triage")}
+	cherryPick := &github.ProjectColumn{ID: github.Int(22), Name: github.String("Cherry Pick")}
+	if err := mon.addLabels(ctx, "docker", "cli", 1, []string{"17.06.1-ee-1/triage"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mon.moveCard(ctx, project, item, 31, triage, cherryPick); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mon.removeLabel(ctx, "docker", "cli", 1, "17.06.1-ee-1/triage"); err != nil {
+		t.Fatal(err)
+	}
+	// Failed changes aren't recorded
+	if err := mon.createLabel(ctx, "docker", "cli", "17.06.1-ee-1/triage", "eeeeee"); err == nil {
+		t.Fatal("createLabel() succeeded without a response")
+	}
+	records, err := audit.query(&auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		if r.Delivery != "d1" || r.Event != "issues" || r.Sender != "alice" {
+			t.Errorf("%s was recorded for delivery %q of %q by %q", r.Action, r.Delivery, r.Event, r.Sender)
+		}
+		line, _ := json.Marshal(struct {
+			Action        string
+			Before, After *auditState
+		}{r.Action, r.Before, r.After})
+		got = append(got, string(line))
+	}
+	want := []string{
+		`{"Action":"AddLabelsToIssue","Before":null,"After":{"label":"17.06.1-ee-1/triage"}}`,
+		`{"Action":"MoveProjectCard","Before":{"card_id":31,"column_id":21,"column":"Triage","content_id":101,"content_type":"Issue"},"After":{"card_id":31,"column_id":22,"column":"Cherry Pick","content_id":101,"content_type":"Issue"}}`,
+		`{"Action":"RemoveLabelForIssue","Before":{"label":"17.06.1-ee-1/triage"},"After":null}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit log has\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestHandleAuditNeedsAdminToken(t *testing.T) {
+	audit, cleanup := newTestAuditLog(t)
+	defer cleanup()
+	audit.write(&auditRecord{Action: "CreateLabel", Owner: "docker", Repo: "cli"})
+	mon := &githubMonitor{adminToken: []byte("admin"), audit: audit}
+	tests := []struct {
+		authorization string
+		code          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/audit?repo=docker/cli", nil)
+		r.Header.Set("Authorization", tt.authorization)
+		w := httptest.NewRecorder()
+		mon.handleAudit(w, r)
+		if w.Code != tt.code {
+			t.Errorf("Authorization %q: responded %d, want %d", tt.authorization, w.Code, tt.code)
+		}
+		if tt.code == http.StatusOK && !strings.Contains(w.Body.String(), `"action":"CreateLabel"`) {
+			t.Errorf("Authorization %q: got %s, want the CreateLabel record", tt.authorization, w.Body.String())
+		}
+	}
+	// Without a token configured nobody gets in
+	mon.adminToken = nil
+	w := httptest.NewRecorder()
+	mon.handleAudit(w, httptest.NewRequest("GET", "/audit", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without an admin token: responded %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/seemethere/release-bot/paginate"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Fixes #42, closes docker/release-tracking#42
+	closingPattern = regexp.MustCompile(`(?i)\b(?:close[sd]?|fix(?:e[sd])?|resolve[sd]?)\s*:?\s+(?:([\w.-]+)/([\w.-]+))?#(\d+)`)
+	// Fixes https://github.com/docker/release-tracking/issues/42, backport of
+	// https://github.com/docker/cli/pull/42. Links without a keyword are
+	// mostly to related or regressing changes.
+	linkPattern = regexp.MustCompile(`(?i)\b(?:close[sd]?|fix(?:e[sd])?|resolve[sd]?|backport(?:s|ed)?(?:\s+of)?)\s*:?\s+https?://[^/\s]+/([\w.-]+)/([\w.-]+)/(?:issues|pull)/(\d+)`)
+	// (cherry picked from commit 1a2b3c4), as written by git cherry-pick -x
+	trailerPattern = regexp.MustCompile(`\(cherry picked from commit ([0-9a-f]{7,40})\)`)
+	// Branches opened by handleCherryPickLabel
+	cherryPickBranchPattern = regexp.MustCompile(`^cherry-pick-(\d+)-`)
+)
+
+// issueRef points at an issue or pull request.
+type issueRef struct {
+	Owner  string
+	Repo   string
+	Number int
+}
+
+// When a pull request merges into a release branch it is a backport, so the
+// cards of the issues and pull requests it backports move to the workflow's
+// cherry_picked column for that release and get its label.
+func (mon *githubMonitor) handleBackportMerged(e *pullRequestEvent, d *delivery) error {
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	owner, name := *e.Repo.Owner.Login, *e.Repo.Name
+	wf := mon.config.workflowFor(owner, name)
+	branchTemplate := mon.config.releaseBranchFor(owner, name)
+	if wf.CherryPicked == "" || branchTemplate == "" {
+		return nil
+	}
+	prefixes, err := mon.releasesForBranch(ctx, owner, name, *e.PullRequest.Base.Ref, branchTemplate)
+	if err != nil || len(prefixes) == 0 {
+		return err
+	}
+	refs, err := mon.backportedRefs(ctx, e)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		// Only issues tracked on the same board can be moved
+		if !strings.EqualFold(ref.Owner, owner) || !strings.EqualFold(ref.Repo, name) {
+			org := mon.config.projectOrg(owner, name)
+			if org == "" || mon.config.projectOrg(ref.Owner, ref.Repo) != org {
+				log.Debugf("%s Ignoring %s/%s#%d, it is not on the board of %s/%s", d.URI, ref.Owner, ref.Repo, ref.Number, owner, name)
+				continue
+			}
+		}
+		item, _, err := mon.getItem(ctx, ref)
+		if err != nil {
+			if isTransient(err) {
+				return err
+			}
+			// A typo or an issue deleted since shouldn't hold up the rest
+			if isNotFound(err) {
+				log.Infof("%s Ignoring %s/%s#%d, it does not exist", d.URI, ref.Owner, ref.Repo, ref.Number)
+			} else {
+				log.Errorf("%s Ignoring %s/%s#%d, it could not be looked up: %v", d.URI, ref.Owner, ref.Repo, ref.Number, err)
+			}
+			continue
+		}
+		refWorkflow := mon.config.workflowFor(ref.Owner, ref.Repo)
+		if refWorkflow.CherryPicked == "" {
+			continue
+		}
+		for _, prefix := range prefixes {
+			label := fmt.Sprintf("%s/%s", prefix, refWorkflow.CherryPicked)
+			log.Infof("%s Pull request #%d backported %s/%s#%d, applying %s", d.URI, *e.PullRequest.Number, ref.Owner, ref.Repo, ref.Number, label)
+			if err := mon.handleLabelEvent(item, label, d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releasesForBranch returns the label prefixes of the open releases whose
+// release branch is branch.
+func (mon *githubMonitor) releasesForBranch(ctx context.Context, owner, name, branch, branchTemplate string) ([]string, error) {
+	projects, err := mon.openProjects(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	grammar := mon.config.grammarFor(owner, name)
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, project := range projects {
+		release, err := grammar.Parse(*project.Name)
+		if err != nil || seen[release.Prefix] {
+			continue
+		}
+		// Every release candidate of a release shares its branch
+		prefixRelease, err := grammar.Parse(release.Prefix)
+		if err != nil {
+			continue
+		}
+		if prefixRelease.Format(branchTemplate) == branch {
+			seen[release.Prefix] = true
+			prefixes = append(prefixes, release.Prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// backportedRefs works out what a backport pull request backports from its
+// branch name, the references and links following a closing or backport
+// keyword in its body, and the (cherry picked from commit …) trailers of its
+// body and commits.
+func (mon *githubMonitor) backportedRefs(ctx context.Context, e *pullRequestEvent) ([]issueRef, error) {
+	owner, name := *e.Repo.Owner.Login, *e.Repo.Name
+	pr := e.PullRequest
+	var refs []issueRef
+	seen := make(map[issueRef]bool)
+	add := func(ref issueRef) {
+		if ref.Number == *pr.Number && strings.EqualFold(ref.Owner, owner) && strings.EqualFold(ref.Repo, name) {
+			return
+		}
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	if pr.Head != nil && pr.Head.Ref != nil {
+		if m := cherryPickBranchPattern.FindStringSubmatch(*pr.Head.Ref); m != nil {
+			number, _ := strconv.Atoi(m[1])
+			add(issueRef{owner, name, number})
+		}
+	}
+	body := ""
+	if pr.Body != nil {
+		body = *pr.Body
+	}
+	for _, m := range closingPattern.FindAllStringSubmatch(body, -1) {
+		number, _ := strconv.Atoi(m[3])
+		if m[1] == "" {
+			add(issueRef{owner, name, number})
+		} else {
+			add(issueRef{m[1], m[2], number})
+		}
+	}
+	for _, m := range linkPattern.FindAllStringSubmatch(body, -1) {
+		number, _ := strconv.Atoi(m[3])
+		add(issueRef{m[1], m[2], number})
+	}
+	messages := []string{body}
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		commits, resp, err := mon.client.PullRequests.ListCommits(ctx, owner, name, *pr.Number, listPage(page))
+		if err != nil {
+			return 0, err
+		}
+		for _, commit := range commits {
+			if commit.Commit != nil && commit.Commit.Message != nil {
+				messages = append(messages, *commit.Commit.Message)
+			}
+		}
+		return resp.NextPage, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	shas := make(map[string]bool)
+	for _, message := range messages {
+		for _, m := range trailerPattern.FindAllStringSubmatch(message, -1) {
+			if shas[m[1]] {
+				continue
+			}
+			shas[m[1]] = true
+			numbers, err := mon.pullRequestsForCommit(ctx, owner, name, m[1])
+			if err != nil {
+				return nil, err
+			}
+			for _, number := range numbers {
+				add(issueRef{owner, name, number})
+			}
+		}
+	}
+	return refs, nil
+}
+
+// pullRequestsForCommit returns the merged pull requests a commit belongs to.
+// The vendored go-github predates this endpoint.
+func (mon *githubMonitor) pullRequestsForCommit(ctx context.Context, owner, name, sha string) ([]int, error) {
+	req, err := mon.client.NewRequest("GET", fmt.Sprintf("repos/%s/%s/commits/%s/pulls", owner, name, sha), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.groot-preview+json")
+	var pulls []*github.PullRequest
+	if _, err := mon.client.Do(ctx, req, &pulls); err != nil {
+		if e, ok := err.(*github.ErrorResponse); ok && e.Response.StatusCode == 422 {
+			// The commit doesn't exist in this repository
+			return nil, nil
+		}
+		return nil, err
+	}
+	var numbers []int
+	for _, pull := range pulls {
+		if pull.MergedAt != nil {
+			numbers = append(numbers, *pull.Number)
+		}
+	}
+	return numbers, nil
+}
+
+// getItem looks up an issue or pull request so it can be put on a board,
+// along with the issue itself.
+func (mon *githubMonitor) getItem(ctx context.Context, ref issueRef) (*boardItem, *github.Issue, error) {
+	issue, _, err := mon.client.Issues.Get(ctx, ref.Owner, ref.Repo, ref.Number)
+	if err != nil {
+		return nil, nil, err
+	}
+	item := &boardItem{
+		Owner:       ref.Owner,
+		Repo:        ref.Repo,
+		Number:      ref.Number,
+		URL:         *issue.URL,
+		ContentID:   *issue.ID,
+		ContentType: "Issue",
+	}
+	if issue.PullRequestLinks != nil {
+		// Cards of pull requests refer to the pull request, not its issue
+		pr, _, err := mon.client.PullRequests.Get(ctx, ref.Owner, ref.Repo, ref.Number)
+		if err != nil {
+			return nil, nil, err
+		}
+		item.ContentID = *pr.ID
+		item.ContentType = "PullRequest"
+	}
+	return item, issue, nil
+}
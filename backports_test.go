@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestBackportedRefs(t *testing.T) {
+	tests := []struct {
+		name    string
+		branch  string
+		body    string
+		commits []string
+		want    []issueRef
+	}{
+		{
+			name:   "cherry-pick branch",
+			branch: "cherry-pick-42-17.06.1-ee-1",
+			want:   []issueRef{{"docker", "cli", 42}},
+		},
+		{
+			name: "closing keywords",
+			body: "Fixes #12, closes moby/moby#34\nResolved: #56",
+			want: []issueRef{{"docker", "cli", 12}, {"moby", "moby", 34}, {"docker", "cli", 56}},
+		},
+		{
+			name: "links",
+			body: "Backport of https://github.com/docker/release-tracking/issues/5\nFixes: https://github.com/docker/cli/pull/6",
+			want: []issueRef{{"docker", "release-tracking", 5}, {"docker", "cli", 6}},
+		},
+		{
+			name: "links without a keyword",
+			body: "See also https://github.com/x/y/issues/1, regressed by https://github.com/x/y/pull/2\nhttps://github.com/x/y/issues/3",
+		},
+		{
+			name:   "duplicates and the pull request itself",
+			branch: "cherry-pick-12-17.06",
+			body:   "Fixes #12\nfixes #10",
+			want:   []issueRef{{"docker", "cli", 12}},
+		},
+		{
+			name:    "cherry picked commits",
+			body:    "(cherry picked from commit abcdef1)",
+			commits: []string{"Fix it\n\n(cherry picked from commit 1234567)", "(cherry picked from commit abcdef1)"},
+			want:    []issueRef{{"docker", "cli", 3}, {"docker", "cli", 7}},
+		},
+		{
+			name: "nothing",
+			body: "Ports #12 without saying it fixes it",
+		},
+	}
+	var commits []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/docker/cli/pulls/10/commits":
+			var list []*github.RepositoryCommit
+			for i := range commits {
+				list = append(list, &github.RepositoryCommit{Commit: &github.Commit{Message: &commits[i]}})
+			}
+			json.NewEncoder(w).Encode(list)
+		case "/repos/docker/cli/commits/abcdef1/pulls":
+			// Only merged pull requests count
+			fmt.Fprint(w, `[{"number": 3, "merged_at": "2017-08-01T00:00:00Z"}, {"number": 4}]`)
+		case "/repos/docker/cli/commits/1234567/pulls":
+			fmt.Fprint(w, `[{"number": 7, "merged_at": "2017-08-01T00:00:00Z"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	mon := &githubMonitor{client: client}
+	for _, tt := range tests {
+		commits = tt.commits
+		payload, err := json.Marshal(map[string]interface{}{
+			"action": "closed",
+			"pull_request": map[string]interface{}{
+				"number": 10,
+				"body":   tt.body,
+				"head":   map[string]string{"ref": tt.branch},
+				"base":   map[string]string{"ref": "17.06"},
+			},
+			"repository": map[string]interface{}{"name": "cli", "owner": map[string]string{"login": "docker"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := parsePullRequestEvent(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs, err := mon.backportedRefs(context.Background(), e)
+		if err != nil {
+			t.Errorf("%s: backportedRefs: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(refs, tt.want) {
+			t.Errorf("%s: backportedRefs = %v, want %v", tt.name, refs, tt.want)
+		}
+	}
+}
+
+func TestHandleBackportMergedSkipsMissingReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing fakeResponse
+		fails   bool
+	}{
+		{"deleted", fakeResponse{code: http.StatusNotFound, body: `{"message":"Not Found"}`}, false},
+		{"no access", fakeResponse{code: http.StatusForbidden, body: `{"message":"Must have admin rights"}`}, false},
+		{"GitHub down", fakeResponse{code: http.StatusBadGateway, body: `{"message":"Server Error"}`}, true},
+	}
+	path, cleanup := writeConfig(t, `{"repositories": {"docker/cli": {"release_branch": "{version}"}}}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"action":"closed","pull_request":{"number":10,"body":"Fixes #5, fixes #6","merged":true,"head":{"ref":"backport"},"base":{"ref":"17.06.1"}},` +
+		`"repository":{"name":"cli","owner":{"login":"docker"}}}`
+	e, err := parsePullRequestEvent([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		fake := newFakeGitHub(map[string]fakeResponse{
+			"GET /repos/docker/cli/projects":         {body: `[{"id":2,"name":"17.06.1-ee-1-rc1"}]`},
+			"GET /projects/2/columns":                {body: `[{"id":21,"name":"Triage"},{"id":23,"name":"Cherry Picked"}]`},
+			"GET /projects/columns/21/cards":         {body: `[]`},
+			"GET /projects/columns/23/cards":         {body: `[]`},
+			"GET /repos/docker/cli/pulls/10/commits": {body: `[]`},
+			"GET /repos/docker/cli/issues/5":         tt.missing,
+			"GET /repos/docker/cli/issues/6":         {body: `{"id":106,"number":6,"url":"https://api.github.com/repos/docker/cli/issues/6"}`},
+			"POST /projects/columns/23/cards":        {code: http.StatusCreated, body: `{"id":36}`},
+			"GET /repos/docker/cli/issues/6/labels":  {body: `[]`},
+			"POST /repos/docker/cli/issues/6/labels": {body: `[{"name":"17.06.1-ee-1/cherry-picked"}]`},
+		})
+		mon := &githubMonitor{ctx: context.Background(), client: fake.client(), config: cfg, metrics: newMetrics(), cards: newCardIndex(time.Hour)}
+		err := mon.handleBackportMerged(e, &delivery{URI: "/docker/cli"})
+		if fails := err != nil; fails != tt.fails {
+			t.Errorf("%s: handleBackportMerged() = %v, want failure %v", tt.name, err, tt.fails)
+		}
+		if tt.fails {
+			fake.Close()
+			continue
+		}
+		// #6 is still moved
+		var changes []string
+		for _, request := range fake.sent() {
+			if !strings.HasPrefix(request, "GET ") {
+				changes = append(changes, request)
+			}
+		}
+		if want := []string{"POST /projects/columns/23/cards", "POST /repos/docker/cli/issues/6/labels"}; !reflect.DeepEqual(changes, want) {
+			t.Errorf("%s: handleBackportMerged() changed %v, want %v", tt.name, changes, want)
+		}
+		fake.Close()
+	}
+}
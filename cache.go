@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds the memory the response cache can take up.
+const maxCacheEntries = 10000
+
+// responseCache keeps GET responses of the GitHub API, like the labels of a
+// repository or the columns and cards of a project, shared by every client.
+// Responses younger than the TTL are served without asking GitHub, older
+// ones are revalidated with their ETag so a 304 answer doesn't count against
+// the rate limit. Webhooks and the bot's own changes invalidate what they
+// touch.
+type responseCache struct {
+	ttl      time.Duration
+	basePath string
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// cacheEntry is a cached response. Entries are shared by every worker so
+// header is never changed once it is cached, refresh swaps in a new one.
+type cacheEntry struct {
+	// path is relative to the API, like repos/docker/cli/labels
+	path    string
+	etag    string
+	header  http.Header
+	body    []byte
+	fetched time.Time
+	used    time.Time
+}
+
+// newResponseCache creates a cache for the API served under basePath, which
+// is / for https://api.github.com/ and /api/v3/ for GitHub Enterprise.
+func newResponseCache(ttl time.Duration, basePath string) *responseCache {
+	if basePath == "" {
+		basePath = "/"
+	}
+	return &responseCache{
+		ttl:      ttl,
+		basePath: basePath,
+		entries:  make(map[string]*cacheEntry),
+	}
+}
+
+// Transport wraps base so its responses are cached. Identity tells apart the
+// credentials of the client since they may not see the same things.
+func (c *responseCache) Transport(identity string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &cachingTransport{cache: c, identity: identity, base: base}
+}
+
+// Invalidate drops the cached responses of API paths starting with any of
+// the prefixes, like repos/docker/cli/labels.
+func (c *responseCache) Invalidate(prefixes ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		for _, prefix := range prefixes {
+			if entry.path == prefix || strings.HasPrefix(entry.path, prefix+"/") {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+func (c *responseCache) relativePath(req *http.Request) string {
+	return strings.ToLower(strings.TrimPrefix(req.URL.Path, c.basePath))
+}
+
+// get returns a copy of the entry cached under key, nil if there is none.
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key]
+	if entry == nil {
+		return nil
+	}
+	entry.used = time.Now()
+	copied := *entry
+	return &copied
+}
+
+func (c *responseCache) put(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		// Make room by dropping the least recently used entry
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range c.entries {
+			if oldestKey == "" || e.used.Before(oldest) {
+				oldestKey, oldest = k, e.used
+			}
+		}
+		delete(c.entries, oldestKey)
+	}
+	c.entries[key] = entry
+}
+
+// refresh marks the entry cached under key as just validated, taking the
+// rate limit headers of the 304 that validated it, and returns a copy of it.
+// An entry replaced or dropped since it was revalidated is left alone.
+func (c *responseCache) refresh(key string, entry *cacheEntry, header http.Header) *cacheEntry {
+	refreshed := *entry
+	refreshed.fetched = time.Now()
+	refreshed.header = make(http.Header, len(entry.header))
+	for k, v := range entry.header {
+		refreshed.header[k] = v
+	}
+	for k, v := range header {
+		if strings.HasPrefix(k, "X-Ratelimit-") {
+			refreshed.header[k] = v
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached := c.entries[key]; cached != nil && cached.etag == entry.etag {
+		cached.header, cached.fetched = refreshed.header, refreshed.fetched
+	}
+	return &refreshed
+}
+
+// mutationPrefix is what a change to path can affect. Cards and columns move
+// between each other so any change to a project drops all of projects/.
+func mutationPrefix(path string) string {
+	bits := strings.Split(path, "/")
+	switch {
+	case bits[0] == "repos" && len(bits) >= 4:
+		return strings.Join(bits[:4], "/")
+	case bits[0] == "orgs" && len(bits) >= 3:
+		return strings.Join(bits[:3], "/")
+	}
+	return bits[0]
+}
+
+type cachingTransport struct {
+	cache    *responseCache
+	identity string
+	base     http.RoundTripper
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := t.cache.relativePath(req)
+	if req.Method != "GET" {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 {
+			t.cache.Invalidate(mutationPrefix(path))
+		}
+		return resp, err
+	}
+	key := fmt.Sprintf("%s %s %s", t.identity, req.Header.Get("Accept"), req.URL.String())
+	entry := t.cache.get(key)
+	if entry != nil && time.Since(entry.fetched) < t.cache.ttl {
+		return entry.response(req), nil
+	}
+	if entry != nil {
+		// RoundTrippers must not modify the request they are given
+		r := new(http.Request)
+		*r = *req
+		r.Header = make(http.Header, len(req.Header))
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set("If-None-Match", entry.etag)
+		req = r
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		return t.cache.refresh(key, entry, resp.Header).response(req), nil
+	}
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	t.cache.put(key, &cacheEntry{
+		path:    path,
+		etag:    etag,
+		header:  resp.Header,
+		body:    body,
+		fetched: now,
+		used:    now,
+	})
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// response makes a fresh response out of a cached one.
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	header := make(http.Header, len(e.header))
+	for k, v := range e.header {
+		header[k] = v
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// invalidateFor drops what a webhook says has changed from the cache.
+func (c *responseCache) invalidateFor(event string, payload []byte) {
+	var p struct {
+		Repository *struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		Organization *struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+		Project *struct {
+			ID int `json:"id"`
+		} `json:"project"`
+		Issue *struct {
+			Number int `json:"number"`
+		} `json:"issue"`
+		PullRequest *struct {
+			Number int `json:"number"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return
+	}
+	repo := ""
+	if p.Repository != nil {
+		repo = "repos/" + strings.ToLower(p.Repository.FullName)
+	}
+	var prefixes []string
+	switch event {
+	case "label":
+		if repo != "" {
+			// The labels of issues carry the label's name and color too
+			prefixes = append(prefixes, repo+"/labels", repo+"/issues")
+		}
+	case "project":
+		if repo != "" {
+			prefixes = append(prefixes, repo+"/projects")
+		}
+		if p.Organization != nil {
+			prefixes = append(prefixes, "orgs/"+strings.ToLower(p.Organization.Login)+"/projects")
+		}
+		if p.Project != nil {
+			prefixes = append(prefixes, fmt.Sprintf("projects/%d", p.Project.ID))
+		}
+	case "project_column", "project_card":
+		prefixes = append(prefixes, "projects")
+	case "issues":
+		if repo != "" && p.Issue != nil {
+			prefixes = append(prefixes, fmt.Sprintf("%s/issues/%d", repo, p.Issue.Number))
+		}
+	case "pull_request":
+		if repo != "" && p.PullRequest != nil {
+			prefixes = append(prefixes,
+				fmt.Sprintf("%s/issues/%d", repo, p.PullRequest.Number),
+				fmt.Sprintf("%s/pulls/%d", repo, p.PullRequest.Number),
+			)
+		}
+	}
+	if len(prefixes) > 0 {
+		c.Invalidate(prefixes...)
+	}
+}
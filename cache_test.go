@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// etagServer serves the same body with an ETag under every path and counts
+// the requests it gets and the ones it answers with a 304.
+type etagServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	requests    int
+	notModified int
+}
+
+func newETagServer() *etagServer {
+	s := &etagServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			s.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`[{"name":"triage"}]`))
+	}))
+	return s
+}
+
+func (s *etagServer) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.notModified
+}
+
+// fetch makes a request through client and returns the body it got.
+func fetch(t *testing.T, client *http.Client, method, url string) string {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCacheServesFreshResponses(t *testing.T) {
+	server := newETagServer()
+	defer server.Close()
+	client := &http.Client{Transport: newResponseCache(time.Hour, "/").Transport("token", nil)}
+	for i := 0; i < 3; i++ {
+		if body := fetch(t, client, "GET", server.URL+"/repos/docker/cli/labels"); body != `[{"name":"triage"}]` {
+			t.Errorf("request %d got %s", i, body)
+		}
+	}
+	if requests, _ := server.counts(); requests != 1 {
+		t.Errorf("%d requests reached GitHub, want 1", requests)
+	}
+}
+
+func TestCacheRevalidatesWithETag(t *testing.T) {
+	server := newETagServer()
+	defer server.Close()
+	client := &http.Client{Transport: newResponseCache(0, "/").Transport("token", nil)}
+	for i := 0; i < 3; i++ {
+		if body := fetch(t, client, "GET", server.URL+"/repos/docker/cli/labels"); body != `[{"name":"triage"}]` {
+			t.Errorf("request %d got %s", i, body)
+		}
+	}
+	if requests, notModified := server.counts(); requests != 3 || notModified != 2 {
+		t.Errorf("%d requests with %d not modified reached GitHub, want 3 with 2 not modified", requests, notModified)
+	}
+}
+
+func TestCacheKeepsIdentitiesApart(t *testing.T) {
+	server := newETagServer()
+	defer server.Close()
+	cache := newResponseCache(time.Hour, "/")
+	for _, identity := range []string{"token a", "token b"} {
+		client := &http.Client{Transport: cache.Transport(identity, nil)}
+		fetch(t, client, "GET", server.URL+"/repos/docker/cli/labels")
+	}
+	if requests, _ := server.counts(); requests != 2 {
+		t.Errorf("%d requests reached GitHub, want one for each identity", requests)
+	}
+}
+
+func TestCacheIsInvalidatedByChanges(t *testing.T) {
+	server := newETagServer()
+	defer server.Close()
+	client := &http.Client{Transport: newResponseCache(time.Hour, "/").Transport("token", nil)}
+	fetch(t, client, "GET", server.URL+"/repos/docker/cli/labels")
+	fetch(t, client, "GET", server.URL+"/repos/docker/docker/labels")
+	fetch(t, client, "POST", server.URL+"/repos/docker/cli/labels")
+	fetch(t, client, "GET", server.URL+"/repos/docker/cli/labels")
+	fetch(t, client, "GET", server.URL+"/repos/docker/docker/labels")
+	// Only the labels of docker/cli are fetched again
+	if requests, _ := server.counts(); requests != 4 {
+		t.Errorf("%d requests reached GitHub, want 4", requests)
+	}
+}
+
+func TestMutationPrefix(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"repos/docker/cli/issues/1/labels", "repos/docker/cli/issues"},
+		{"repos/docker/cli/labels", "repos/docker/cli/labels"},
+		{"orgs/docker/projects", "orgs/docker/projects"},
+		{"projects/columns/cards/3/moves", "projects"},
+	}
+	for _, tt := range tests {
+		if got := mutationPrefix(tt.path); got != tt.want {
+			t.Errorf("mutationPrefix(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCacheInvalidateFor(t *testing.T) {
+	paths := []string{
+		"repos/docker/cli/labels",
+		"repos/docker/cli/issues/1",
+		"repos/docker/cli/issues/2",
+		"repos/docker/cli/pulls/2",
+		"repos/docker/cli/projects",
+		"repos/docker/docker/labels",
+		"orgs/docker/projects",
+		"projects/5",
+		"projects/5/columns",
+		"projects/columns/7/cards",
+	}
+	repo := `"repository":{"full_name":"Docker/CLI"}`
+	tests := []struct {
+		event   string
+		payload string
+		dropped []string
+	}{
+		{"label", `{` + repo + `}`, []string{"repos/docker/cli/labels", "repos/docker/cli/issues/1", "repos/docker/cli/issues/2"}},
+		{"issues", `{"issue":{"number":1},` + repo + `}`, []string{"repos/docker/cli/issues/1"}},
+		{"pull_request", `{"pull_request":{"number":2},` + repo + `}`, []string{"repos/docker/cli/issues/2", "repos/docker/cli/pulls/2"}},
+		{"project", `{"project":{"id":5},"organization":{"login":"docker"}}`, []string{"orgs/docker/projects", "projects/5", "projects/5/columns"}},
+		{"project_card", `{"project_card":{"id":9}}`, []string{"projects/5", "projects/5/columns", "projects/columns/7/cards"}},
+		{"push", `{` + repo + `}`, nil},
+		{"label", `not json`, nil},
+	}
+	for _, tt := range tests {
+		cache := newResponseCache(time.Hour, "/")
+		for _, path := range paths {
+			cache.put(path, &cacheEntry{path: path})
+		}
+		cache.invalidateFor(tt.event, []byte(tt.payload))
+		dropped := make(map[string]bool)
+		for _, path := range tt.dropped {
+			dropped[path] = true
+		}
+		for _, path := range paths {
+			if cached := cache.get(path) != nil; cached == dropped[path] {
+				t.Errorf("%s %s: %s cached %v, want %v", tt.event, tt.payload, path, cached, !dropped[path])
+			}
+		}
+	}
+}
+
+func TestCacheRefreshLeavesHeldEntriesAlone(t *testing.T) {
+	cache := newResponseCache(time.Hour, "/")
+	cache.put("repos/docker/cli/labels", &cacheEntry{path: "repos/docker/cli/labels", etag: `"1"`, header: http.Header{"X-Ratelimit-Remaining": {"10"}}})
+	held := cache.get("repos/docker/cli/labels")
+	revalidated := cache.get("repos/docker/cli/labels")
+	refreshed := cache.refresh("repos/docker/cli/labels", revalidated, http.Header{"X-Ratelimit-Remaining": {"9"}})
+	if got := held.header.Get("X-Ratelimit-Remaining"); got != "10" {
+		t.Errorf("refresh() changed the header of an entry another worker holds to %s", got)
+	}
+	if got := refreshed.header.Get("X-Ratelimit-Remaining"); got != "9" {
+		t.Errorf("refreshed entry has X-Ratelimit-Remaining %s, want 9", got)
+	}
+	if got := cache.get("repos/docker/cli/labels").header.Get("X-Ratelimit-Remaining"); got != "9" {
+		t.Errorf("cached entry has X-Ratelimit-Remaining %s, want 9", got)
+	}
+	// An entry replaced in the meantime isn't refreshed
+	cache.put("repos/docker/cli/labels", &cacheEntry{path: "repos/docker/cli/labels", etag: `"2"`, header: http.Header{}})
+	cache.refresh("repos/docker/cli/labels", revalidated, http.Header{"X-Ratelimit-Remaining": {"8"}})
+	if got := cache.get("repos/docker/cli/labels"); got.etag != `"2"` || got.header.Get("X-Ratelimit-Remaining") != "" {
+		t.Errorf("refresh() changed the entry that replaced the one revalidated")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/seemethere/release-bot/paginate"
+	log "github.com/sirupsen/logrus"
+)
+
+// cherryPickBranch is the branch a change is cherry-picked onto for a
+// release, which is also how the pull request is recognized once it merges.
+func cherryPickBranch(number int, release *Release) string {
+	return fmt.Sprintf("cherry-pick-%d-%s", number, release.Prefix)
+}
+
+// When an issue or pull request gets the workflow's cherry_pick label, like
+// 17.06.1-ee-1/cherry-pick, the change is replayed onto the release branch
+// and a pull request is opened against it. Pull requests that haven't merged
+// yet are cherry-picked once they do.
+func (mon *githubMonitor) handleCherryPickLabel(item *boardItem, label string, d *delivery) error {
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	wf := mon.config.workflowFor(item.Owner, item.Repo)
+	branchTemplate := mon.config.releaseBranchFor(item.Owner, item.Repo)
+	if wf.CherryPick == "" || branchTemplate == "" {
+		return nil
+	}
+	grammar := mon.config.grammarFor(item.Owner, item.Repo)
+	projectPrefix, labelSuffix, err := grammar.ParseLabel(label)
+	if err != nil || labelSuffix != wf.CherryPick {
+		return nil
+	}
+	release, err := grammar.Parse(projectPrefix)
+	if err != nil {
+		return nil
+	}
+	sha, err := mon.cherryPickSource(ctx, item, d)
+	if err != nil || sha == "" {
+		return err
+	}
+	return mon.cherryPick(ctx, item, sha, release, release.Format(branchTemplate), d)
+}
+
+// cherryPickSource returns the commit that has to be cherry-picked for an
+// issue or pull request: the merge commit of a pull request or the commit
+// that closed an issue. It is empty if there is nothing to cherry-pick yet.
+func (mon *githubMonitor) cherryPickSource(ctx context.Context, item *boardItem, d *delivery) (string, error) {
+	if item.ContentType == "PullRequest" {
+		pr, _, err := mon.client.PullRequests.Get(ctx, item.Owner, item.Repo, item.Number)
+		if err != nil {
+			return "", err
+		}
+		if pr.Merged == nil || !*pr.Merged || pr.MergeCommitSHA == nil {
+			log.Infof("%s Pull request #%d will be cherry-picked once it is merged", d.URI, item.Number)
+			return "", nil
+		}
+		return *pr.MergeCommitSHA, nil
+	}
+	sha := ""
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		events, resp, err := mon.client.Issues.ListIssueEvents(ctx, item.Owner, item.Repo, item.Number, listPage(page))
+		if err != nil {
+			return 0, err
+		}
+		for _, event := range events {
+			if event.Event != nil && *event.Event == "closed" && event.CommitID != nil {
+				sha = *event.CommitID
+			}
+		}
+		return resp.NextPage, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if sha == "" {
+		log.Infof("%s Issue #%d was not closed by a commit, nothing to cherry-pick", d.URI, item.Number)
+	}
+	return sha, nil
+}
+
+// cherryPick replays commit sha onto branch and opens a pull request for it.
+//
+// The Git Data API has no cherry-pick, so the change is merged instead: a
+// temporary commit with the tree of the release branch and the parent of sha
+// makes that parent the merge base, which leaves exactly the changes of sha
+// to be applied. The merged tree is then committed on top of the release
+// branch on its own.
+func (mon *githubMonitor) cherryPick(ctx context.Context, item *boardItem, sha string, release *Release, branch string, d *delivery) error {
+	owner, repo := item.Owner, item.Repo
+	head := cherryPickBranch(item.Number, release)
+	if existing, err := mon.getBranch(ctx, owner, repo, head); err != nil {
+		return err
+	} else if existing != nil {
+		// Picked on an earlier attempt
+		return mon.openCherryPickPullRequest(ctx, item, sha, release, branch, head, d)
+	}
+	base, err := mon.getBranch(ctx, owner, repo, branch)
+	if err != nil {
+		return err
+	}
+	if base == nil {
+		return mon.comment(ctx, item, fmt.Sprintf(
+			"Could not cherry-pick %s for %s, the release branch `%s` does not exist.",
+			sha, release.Prefix, branch,
+		))
+	}
+	baseSHA := *base.Object.SHA
+	commit, _, err := mon.client.Git.GetCommit(ctx, owner, repo, sha)
+	if err != nil {
+		return err
+	}
+	if len(commit.Parents) == 0 {
+		return permanent(fmt.Errorf("commit %s has no parent to cherry-pick it from", sha))
+	}
+	baseCommit, _, err := mon.client.Git.GetCommit(ctx, owner, repo, baseSHA)
+	if err != nil {
+		return err
+	}
+	temp, _, err := mon.client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
+		Message: github.String(fmt.Sprintf("Temporary commit to cherry-pick %s", sha)),
+		Tree:    baseCommit.Tree,
+		Parents: []github.Commit{{SHA: commit.Parents[0].SHA}},
+	})
+	if err != nil {
+		return err
+	}
+	ref := "refs/heads/" + head
+	if _, _, err := mon.client.Git.CreateRef(ctx, owner, repo, &github.Reference{
+		Ref:    github.String(ref),
+		Object: &github.GitObject{SHA: temp.SHA},
+	}); err != nil {
+		return err
+	}
+	// Don't leave a half picked branch behind for the next attempt to find
+	picked := false
+	defer func() {
+		if !picked {
+			if _, err := mon.client.Git.DeleteRef(ctx, owner, repo, "heads/"+head); err != nil {
+				log.Errorf("%s Could not delete branch %s: %v", d.URI, head, err)
+			}
+		}
+	}()
+	merged, resp, err := mon.client.Repositories.Merge(ctx, owner, repo, &github.RepositoryMergeRequest{
+		Base: github.String(head),
+		Head: github.String(sha),
+	})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			log.Infof("%s Cherry-pick of %s onto %s conflicts", d.URI, sha, branch)
+			return mon.comment(ctx, item, cherryPickConflict(sha, len(commit.Parents) > 1, branch, head))
+		}
+		return err
+	}
+	// A pretended merge tells nothing about what is already on the branch,
+	// and there is no branch to clean up either
+	if mon.dryRun {
+		picked = true
+		log.Infof("%s Would cherry-pick %s onto %s and open a pull request against %s", d.URI, sha, head, branch)
+		return nil
+	}
+	if merged == nil || merged.SHA == nil {
+		log.Infof("%s %s is already on %s, nothing to cherry-pick", d.URI, sha, branch)
+		return nil
+	}
+	final, _, err := mon.client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
+		Message: github.String(fmt.Sprintf("%s\n\n(cherry picked from commit %s)", strings.TrimSpace(*commit.Message), sha)),
+		Author:  commit.Author,
+		Tree:    merged.Commit.Tree,
+		Parents: []github.Commit{{SHA: github.String(baseSHA)}},
+	})
+	if err != nil {
+		return err
+	}
+	if _, _, err := mon.client.Git.UpdateRef(ctx, owner, repo, &github.Reference{
+		Ref:    github.String(ref),
+		Object: &github.GitObject{SHA: final.SHA},
+	}, true); err != nil {
+		return err
+	}
+	picked = true
+	log.Infof("%s Cherry-picked %s onto %s as %s", d.URI, sha, head, *final.SHA)
+	return mon.openCherryPickPullRequest(ctx, item, sha, release, branch, head, d)
+}
+
+// getBranch returns the ref of a branch, or nil if it doesn't exist. GitHub
+// answers with every ref starting with the name when there is no exact match,
+// which counts as not existing too.
+func (mon *githubMonitor) getBranch(ctx context.Context, owner, repo, branch string) (*github.Reference, error) {
+	ref, resp, err := mon.client.Git.GetRef(ctx, owner, repo, "heads/"+branch)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusOK) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ref, nil
+}
+
+// openCherryPickPullRequest opens the pull request of a cherry-pick branch
+// against the release branch unless there already is one.
+func (mon *githubMonitor) openCherryPickPullRequest(ctx context.Context, item *boardItem, sha string, release *Release, branch, head string, d *delivery) error {
+	existing, _, err := mon.client.PullRequests.List(ctx, item.Owner, item.Repo, &github.PullRequestListOptions{
+		State: "all",
+		Head:  fmt.Sprintf("%s:%s", item.Owner, head),
+	})
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		log.Debugf("%s Cherry-pick pull request #%d already exists", d.URI, *existing[0].Number)
+		return nil
+	}
+	original, _, err := mon.client.Issues.Get(ctx, item.Owner, item.Repo, item.Number)
+	if err != nil {
+		return err
+	}
+	pr, _, err := mon.client.PullRequests.Create(ctx, item.Owner, item.Repo, &github.NewPullRequest{
+		Title: github.String(fmt.Sprintf("[%s] %s", branch, *original.Title)),
+		Head:  github.String(head),
+		Base:  github.String(branch),
+		Body: github.String(fmt.Sprintf(
+			"Cherry-pick of #%d for %s.\n\n(cherry picked from commit %s)",
+			item.Number, release.Prefix, sha,
+		)),
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("%s Opened cherry-pick pull request #%d for #%d", d.URI, *pr.Number, item.Number)
+	return nil
+}
+
+func cherryPickConflict(sha string, isMerge bool, branch, head string) string {
+	mainline := ""
+	if isMerge {
+		mainline = "-m1 "
+	}
+	return fmt.Sprintf(
+		"Could not cherry-pick %s onto `%s` automatically because it conflicts. "+
+			"To cherry-pick it by hand:\n\n"+
+			"```\n"+
+			"git fetch origin\n"+
+			"git checkout -b %s origin/%s\n"+
+			"git cherry-pick -x %s%s\n"+
+			"```\n\n"+
+			"Then resolve the conflicts and open a pull request against `%s`.",
+		sha, branch, head, branch, mainline, sha, branch,
+	)
+}
+
+// comment posts a comment on an issue or pull request.
+func (mon *githubMonitor) comment(ctx context.Context, item *boardItem, body string) error {
+	_, _, err := mon.client.Issues.CreateComment(ctx, item.Owner, item.Repo, item.Number, &github.IssueComment{
+		Body: github.String(body),
+	})
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCherryPickBranch(t *testing.T) {
+	release := &Release{Name: "17.06.1-ee-1-rc3", Version: "17.06.1", Edition: "ee", Build: "1", Stage: "rc3", Prefix: "17.06.1-ee-1"}
+	if got := cherryPickBranch(42, release); got != "cherry-pick-42-17.06.1-ee-1" {
+		t.Errorf("cherryPickBranch(42) = %q, want cherry-pick-42-17.06.1-ee-1", got)
+	}
+	if got := release.Format("release/{version}-{edition}"); got != "release/17.06.1-ee" {
+		t.Errorf("Format(release/{version}-{edition}) = %q, want release/17.06.1-ee", got)
+	}
+}
+
+func TestCherryPickConflict(t *testing.T) {
+	tests := []struct {
+		isMerge bool
+		command string
+	}{
+		{false, "git cherry-pick -x abc123\n"},
+		{true, "git cherry-pick -x -m1 abc123\n"},
+	}
+	for _, tt := range tests {
+		comment := cherryPickConflict("abc123", tt.isMerge, "release/17.06", "cherry-pick-42-17.06")
+		if !strings.Contains(comment, tt.command) || !strings.Contains(comment, "git checkout -b cherry-pick-42-17.06 origin/release/17.06\n") {
+			t.Errorf("cherryPickConflict(merge %v) = %q, want it to show %q", tt.isMerge, comment, tt.command)
+		}
+	}
+}
+
+// cherryPickResponses are the responses of GitHub to cherry-picking commit
+// abc123 of docker/cli#42 onto release/17.06, merging as mergeResponse.
+func cherryPickResponses(mergeResponse fakeResponse) map[string]fakeResponse {
+	return map[string]fakeResponse{
+		"GET /repos/docker/cli/git/refs/heads/release/17.06":           {body: `{"ref":"refs/heads/release/17.06","object":{"sha":"base"}}`},
+		"GET /repos/docker/cli/git/commits/abc123":                     {body: `{"sha":"abc123","message":"Fix the thing\n","tree":{"sha":"tree"},"parents":[{"sha":"parent"}]}`},
+		"GET /repos/docker/cli/git/commits/base":                       {body: `{"sha":"base","tree":{"sha":"base-tree"}}`},
+		"POST /repos/docker/cli/git/commits":                           {code: http.StatusCreated, body: `{"sha":"picked"}`},
+		"POST /repos/docker/cli/git/refs":                              {code: http.StatusCreated, body: `{"ref":"refs/heads/cherry-pick-42-17.06"}`},
+		"POST /repos/docker/cli/merges":                                mergeResponse,
+		"PATCH /repos/docker/cli/git/refs/heads/cherry-pick-42-17.06":  {body: `{"ref":"refs/heads/cherry-pick-42-17.06"}`},
+		"DELETE /repos/docker/cli/git/refs/heads/cherry-pick-42-17.06": {code: http.StatusNoContent},
+		"GET /repos/docker/cli/pulls":                                  {body: `[]`},
+		"GET /repos/docker/cli/issues/42":                              {body: `{"number":42,"title":"Fix the thing"}`},
+		"POST /repos/docker/cli/pulls":                                 {code: http.StatusCreated, body: `{"number":43}`},
+		"POST /repos/docker/cli/issues/42/comments":                    {code: http.StatusCreated, body: `{"id":1}`},
+	}
+}
+
+func TestCherryPick(t *testing.T) {
+	tests := []struct {
+		name  string
+		merge fakeResponse
+		want  []string
+	}{
+		{
+			"clean",
+			fakeResponse{code: http.StatusCreated, body: `{"sha":"merged","commit":{"tree":{"sha":"merged-tree"}}}`},
+			[]string{
+				"GET /repos/docker/cli/git/refs/heads/cherry-pick-42-17.06",
+				"GET /repos/docker/cli/git/refs/heads/release/17.06",
+				"GET /repos/docker/cli/git/commits/abc123",
+				"GET /repos/docker/cli/git/commits/base",
+				"POST /repos/docker/cli/git/commits",
+				"POST /repos/docker/cli/git/refs",
+				"POST /repos/docker/cli/merges",
+				"POST /repos/docker/cli/git/commits",
+				"PATCH /repos/docker/cli/git/refs/heads/cherry-pick-42-17.06",
+				"GET /repos/docker/cli/pulls",
+				"GET /repos/docker/cli/issues/42",
+				"POST /repos/docker/cli/pulls",
+			},
+		},
+		{
+			"conflict",
+			fakeResponse{code: http.StatusConflict, body: `{"message":"Merge conflict"}`},
+			[]string{
+				"GET /repos/docker/cli/git/refs/heads/cherry-pick-42-17.06",
+				"GET /repos/docker/cli/git/refs/heads/release/17.06",
+				"GET /repos/docker/cli/git/commits/abc123",
+				"GET /repos/docker/cli/git/commits/base",
+				"POST /repos/docker/cli/git/commits",
+				"POST /repos/docker/cli/git/refs",
+				"POST /repos/docker/cli/merges",
+				"POST /repos/docker/cli/issues/42/comments",
+				"DELETE /repos/docker/cli/git/refs/heads/cherry-pick-42-17.06",
+			},
+		},
+	}
+	for _, tt := range tests {
+		fake := newFakeGitHub(cherryPickResponses(tt.merge))
+		mon := &githubMonitor{ctx: context.Background(), client: fake.client()}
+		item := &boardItem{Owner: "docker", Repo: "cli", Number: 42, ContentType: "Issue"}
+		release := &Release{Name: "17.06", Version: "17.06", Prefix: "17.06"}
+		err := mon.cherryPick(context.Background(), item, "abc123", release, "release/17.06", &delivery{URI: "/docker/cli"})
+		if err != nil {
+			t.Errorf("%s: cherryPick() = %v", tt.name, err)
+		}
+		if got := fake.sent(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: cherryPick() sent\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+		if tt.name == "clean" && !strings.Contains(fake.body("POST /repos/docker/cli/pulls"), `"title":"[release/17.06] Fix the thing"`) {
+			t.Errorf("%s: opened pull request %s", tt.name, fake.body("POST /repos/docker/cli/pulls"))
+		}
+		fake.Close()
+	}
+}
+
+func TestCherryPickDryRun(t *testing.T) {
+	fake := newFakeGitHub(cherryPickResponses(fakeResponse{code: http.StatusCreated}))
+	defer fake.Close()
+	clients, err := newClientSource(context.Background(), fake.URL+"/", "token", nil, 0, newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon := &githubMonitor{ctx: context.Background(), client: clients.forToken("token", true), dryRun: true}
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	item := &boardItem{Owner: "docker", Repo: "cli", Number: 42, ContentType: "Issue"}
+	release := &Release{Name: "17.06", Version: "17.06", Prefix: "17.06"}
+	if err := mon.cherryPick(context.Background(), item, "abc123", release, "release/17.06", &delivery{URI: "/docker/cli"}); err != nil {
+		t.Fatal(err)
+	}
+	// The pretended merge answers 204 like one of a commit already on the branch
+	if got := out.String(); strings.Contains(got, "already on") || !strings.Contains(got, "Would cherry-pick abc123 onto cherry-pick-42-17.06") {
+		t.Errorf("dry run logged:\n%s", got)
+	}
+	for _, request := range fake.sent() {
+		if !strings.HasPrefix(request, "GET ") {
+			t.Errorf("GitHub got %s in a dry run", request)
+		}
+	}
+}
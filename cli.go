@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// subcommands run instead of the server when named after the flags, like
+// `release-bot -config config.json notes docker 17.06.1-ee-1`.
+var subcommands = map[string]func(mon *githubMonitor, args []string) error{
+	"audit":     auditCommand,
+	"notes":     notesCommand,
+	"reconcile": reconcileCommand,
+	"replay":    replayCommand,
+	"revert":    revertCommand,
+	"rotate":    rotateCommand,
+}
+
+// runSubcommand runs the subcommand named by args[0].
+func runSubcommand(mon *githubMonitor, args []string) error {
+	command, ok := subcommands[args[0]]
+	if !ok {
+		var names []string
+		for name := range subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, expected one of %s", args[0], strings.Join(names, ", "))
+	}
+	return command(mon, args[1:])
+}
+
+// splitBoard splits an owner/name argument, leaving name empty for an
+// organization.
+func splitBoard(board string) (string, string) {
+	bits := strings.SplitN(board, "/", 2)
+	if len(bits) == 1 {
+		return bits[0], ""
+	}
+	return bits[0], bits[1]
+}
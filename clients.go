@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/seemethere/release-bot/githubapp"
+	"github.com/seemethere/release-bot/ratelimit"
+	"golang.org/x/oauth2"
+)
+
+// clientSource hands out GitHub clients. Running as a GitHub App every
+// installation gets a client of its own, otherwise everything shares the
+// personal access token from RELEASE_BOT_GITHUB_TOKEN. Each comes in a
+// dry-run flavor too, which only pretends to change anything.
+type clientSource struct {
+	ctx     context.Context
+	baseURL *url.URL
+	token   string
+	app     *githubapp.App
+	cache   *responseCache
+	limiter *ratelimit.Transport
+
+	mu      sync.Mutex
+	clients map[string]*github.Client
+	// logins are who GitHub says made the changes of each identity
+	logins map[string]string
+}
+
+// newClientSource creates the clients for the API at baseURL, empty meaning
+// https://api.github.com/, falling back to token when not running as app.
+// Their responses are cached for cacheTTL and the requests they make are
+// counted in stats.
+func newClientSource(ctx context.Context, baseURL, token string, app *githubapp.App, cacheTTL time.Duration, stats *metrics) (*clientSource, error) {
+	s := &clientSource{
+		ctx:     ctx,
+		token:   token,
+		app:     app,
+		clients: make(map[string]*github.Client),
+		logins:  make(map[string]string),
+	}
+	basePath := "/"
+	if baseURL != "" {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, err
+		}
+		s.baseURL = u
+		basePath = u.Path
+		if app != nil {
+			app.BaseURL = baseURL
+		}
+	}
+	s.cache = newResponseCache(cacheTTL, basePath)
+	s.limiter = ratelimit.New(stats.Transport(basePath, nil))
+	if app != nil {
+		app.Client = &http.Client{Transport: withCredential(appIdentity, s.limiter)}
+	}
+	return s, nil
+}
+
+// newClient creates a client whose responses are cached under the identity
+// of its credentials. Dry-run clients share the cache with the others.
+func (s *clientSource) newClient(identity string, httpClient *http.Client, dryRun bool) *github.Client {
+	httpClient.Transport = s.cache.Transport(identity, httpClient.Transport)
+	if dryRun {
+		httpClient.Transport = &dryRunTransport{base: httpClient.Transport}
+	}
+	client := github.NewClient(httpClient)
+	if s.baseURL != nil {
+		client.BaseURL = s.baseURL
+	}
+	return client
+}
+
+// forToken returns a client authenticated with a personal access token.
+func (s *clientSource) forToken(token string, dryRun bool) *github.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := tokenIdentity(token)
+	if client := s.clients[clientKey(key, dryRun)]; client != nil {
+		return client
+	}
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	ctx := context.WithValue(s.ctx, oauth2.HTTPClient, &http.Client{Transport: withCredential(credentialName(key), s.limiter)})
+	client := s.newClient(key, oauth2.NewClient(ctx, ts), dryRun)
+	s.clients[clientKey(key, dryRun)] = client
+	return client
+}
+
+// forInstallation returns a client acting as an installation of the app.
+func (s *clientSource) forInstallation(installationID int64, dryRun bool) (*github.Client, error) {
+	if s.app == nil {
+		return nil, fmt.Errorf("release-bot is not running as a GitHub App")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := installationIdentity(installationID)
+	if client := s.clients[clientKey(key, dryRun)]; client != nil {
+		return client, nil
+	}
+	client := s.newClient(key, &http.Client{Transport: s.app.Transport(installationID, withCredential(key, s.limiter))}, dryRun)
+	s.clients[clientKey(key, dryRun)] = client
+	return client, nil
+}
+
+func tokenIdentity(token string) string {
+	return "token:" + token
+}
+
+func installationIdentity(installationID int64) string {
+	return fmt.Sprintf("installation:%d", installationID)
+}
+
+// credentialName names an identity in metrics, which tokens only appear in
+// hashed.
+func credentialName(identity string) string {
+	if strings.HasPrefix(identity, "token:") {
+		sum := sha256.Sum256([]byte(identity))
+		return fmt.Sprintf("token:%x", sum[:4])
+	}
+	return identity
+}
+
+// appIdentity stands for every installation of the app in logins, they all
+// act as the same bot user.
+const appIdentity = "app"
+
+// resolveLogins looks up who GitHub will say made the changes of the app and
+// of each of the tokens, so telling the bot's changes apart never has to wait
+// on GitHub.
+func (s *clientSource) resolveLogins(ctx context.Context, tokens []string) error {
+	logins := make(map[string]string)
+	if s.app != nil {
+		slug, err := s.app.Slug(ctx)
+		if err != nil {
+			return err
+		}
+		logins[appIdentity] = slug + "[bot]"
+	}
+	for _, token := range tokens {
+		user, _, err := s.forToken(token, false).Users.Get(ctx, "")
+		if err != nil {
+			return fmt.Errorf("could not look up the owner of a token: %v", err)
+		}
+		logins[tokenIdentity(token)] = user.GetLogin()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for identity, login := range logins {
+		s.logins[identity] = login
+	}
+	return nil
+}
+
+// login returns the login webhooks name as the sender of changes made with
+// the credentials of identity: the owner of a token, or "<slug>[bot]" for an
+// installation of the app. It is only known once resolveLogins looked it up.
+func (s *clientSource) login(identity string) (string, bool) {
+	if strings.HasPrefix(identity, "installation:") {
+		identity = appIdentity
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login, ok := s.logins[identity]
+	return login, ok
+}
+
+func clientKey(identity string, dryRun bool) string {
+	if dryRun {
+		return "dry-run " + identity
+	}
+	return identity
+}
+
+// installationID pulls the app installation a webhook was sent for out of its
+// payload, or 0 if the webhook isn't from an app.
+func installationID(payload []byte) int64 {
+	var p struct {
+		Installation *struct {
+			ID int64 `json:"id"`
+		} `json:"installation"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil || p.Installation == nil {
+		return 0
+	}
+	return p.Installation.ID
+}
+
+// forDelivery returns a copy of the monitor whose client acts for the
+// repository or organization the delivery is about. That is their own token
+// if they have one, the app installation the delivery was sent to when running as an
+// app, and RELEASE_BOT_GITHUB_TOKEN otherwise.
+func (mon *githubMonitor) forDelivery(d *delivery) (*githubMonitor, error) {
+	owner, name := payloadOwner(d.Payload)
+	m, err := mon.actingFor(owner, name, func() (int64, error) {
+		id := installationID(d.Payload)
+		if id == 0 {
+			return 0, permanent(fmt.Errorf("delivery %s was not sent to an app installation", d.ID))
+		}
+		return id, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.delivery = d
+	return m, nil
+}
+
+// forOwner returns a copy of the monitor whose client acts for a repository,
+// or an organization if name is empty, outside of a delivery. That is their
+// own token if they have one, the installation of the app on them when
+// running as an app, and RELEASE_BOT_GITHUB_TOKEN otherwise.
+func (mon *githubMonitor) forOwner(ctx context.Context, owner, name string) (*githubMonitor, error) {
+	return mon.actingFor(owner, name, func() (int64, error) {
+		if name == "" {
+			return mon.clients.app.OrgInstallation(ctx, owner)
+		}
+		return mon.clients.app.Installation(ctx, owner, name)
+	})
+}
+
+// actingFor returns a copy of the monitor with the client for owner/name,
+// only looking up the app installation when it is needed. Changes are only
+// pretended if the server or owner/name is in dry-run mode.
+func (mon *githubMonitor) actingFor(owner, name string, installation func() (int64, error)) (*githubMonitor, error) {
+	m := *mon
+	m.dryRun = mon.dryRun || mon.config.dryRun(owner, name)
+	for _, rc := range mon.config.settingsFor(owner, name) {
+		if rc.Token != "" {
+			m.client, m.identity = mon.clients.forToken(rc.Token, m.dryRun), tokenIdentity(rc.Token)
+			return &m, nil
+		}
+	}
+	if mon.clients.app == nil {
+		m.client, m.identity = mon.clients.forToken(mon.clients.token, m.dryRun), tokenIdentity(mon.clients.token)
+		return &m, nil
+	}
+	id, err := installation()
+	if err != nil {
+		return nil, err
+	}
+	m.identity = installationIdentity(id)
+	m.client, err = mon.clients.forInstallation(id, m.dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// A command is a line of its own like "/cherry-pick 17.06", the release being
+// optional for some of them.
+var commandPattern = regexp.MustCompile(`^/([a-z][a-z0-9-]*)(?:\s+(\S+))?\s*$`)
+
+// slashCommand is a command found in a comment.
+type slashCommand struct {
+	Name    string
+	Release string
+	Line    string
+}
+
+// parseCommands returns the commands in a comment, skipping code blocks.
+// Lines like "/cc @someone" that aren't one of the names are left alone, they
+// are meant for people or other bots.
+func parseCommands(body string, names []string) []slashCommand {
+	var commands []slashCommand
+	inCode := false
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		if m := commandPattern.FindStringSubmatch(line); m != nil && containsString(names, m[1]) {
+			commands = append(commands, slashCommand{Name: m[1], Release: m[2], Line: line})
+		}
+	}
+	return commands
+}
+
+// Release captains can type the label suffixes of the workflow as commands,
+// like "/cherry-pick 17.06", instead of finding the exact label. "/untrack"
+// takes an issue off a release and "/status" lists where it is tracked.
+// Commenters need write access to the repository. The comment gets a reaction
+// and a reply with the result of each command.
+func (mon *githubMonitor) handleIssueCommentEvent(e *github.IssueCommentEvent, d *delivery) error {
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	if *e.Action != "created" || e.Comment.Body == nil {
+		return nil
+	}
+	if e.Sender != nil && e.Sender.Type != nil && *e.Sender.Type == "Bot" {
+		return nil
+	}
+	owner, name := *e.Repo.Owner.Login, *e.Repo.Name
+	commands := parseCommands(*e.Comment.Body, knownCommands(mon.config.workflowFor(owner, name)))
+	if len(commands) == 0 {
+		return nil
+	}
+	user := *e.Comment.User.Login
+	commentID := *e.Comment.ID
+	level, _, err := mon.client.Repositories.GetPermissionLevel(ctx, owner, name, user)
+	if err != nil {
+		return err
+	}
+	if level.Permission == nil || (*level.Permission != "admin" && *level.Permission != "write") {
+		log.Infof("%s Ignoring commands from %s who can not write to %s/%s", d.URI, user, owner, name)
+		if err := mon.react(ctx, owner, name, commentID, "-1"); err != nil {
+			return err
+		}
+		return mon.comment(ctx, issueItem(e.Repo, e.Issue), fmt.Sprintf("@%s only collaborators with write access can use release-bot commands.", user))
+	}
+	item := issueItem(e.Repo, e.Issue)
+	if e.Issue.PullRequestLinks != nil {
+		if item, _, err = mon.getItem(ctx, issueRef{owner, name, *e.Issue.Number}); err != nil {
+			return err
+		}
+	}
+	reaction := "+1"
+	var results []string
+	for _, command := range commands {
+		result, err := mon.runCommand(ctx, item, command, d)
+		if err != nil {
+			if _, ok := err.(permanentError); !ok {
+				return err
+			}
+			reaction = "confused"
+			result = err.Error()
+		}
+		results = append(results, fmt.Sprintf("`%s`: %s", command.Line, result))
+	}
+	if err := mon.react(ctx, owner, name, commentID, reaction); err != nil {
+		return err
+	}
+	return mon.comment(ctx, item, strings.Join(results, "\n"))
+}
+
+// runCommand runs a single command and describes what it did. Mistakes in the
+// command come back as permanent errors.
+func (mon *githubMonitor) runCommand(ctx context.Context, item *boardItem, command slashCommand, d *delivery) (string, error) {
+	wf := mon.config.workflowFor(item.Owner, item.Repo)
+	switch command.Name {
+	case "status":
+		return mon.trackingStatus(ctx, item)
+	case "untrack":
+		prefixes, err := mon.commandReleases(ctx, item, command)
+		if err != nil {
+			return "", err
+		}
+		labels, err := mon.releaseLabels(ctx, item)
+		if err != nil {
+			return "", err
+		}
+		grammar := mon.config.grammarFor(item.Owner, item.Repo)
+		var untracked []string
+		for _, label := range labels {
+			prefix, _, _ := grammar.ParseLabel(label)
+			if !containsString(prefixes, prefix) {
+				continue
+			}
+			if err := mon.handleUnlabelEvent(item, label, d); err != nil {
+				return "", err
+			}
+			if _, err := mon.removeLabel(ctx, item.Owner, item.Repo, item.Number, label); err != nil {
+				return "", err
+			}
+			untracked = append(untracked, prefix)
+		}
+		if len(untracked) == 0 {
+			return "", permanent(fmt.Errorf("not tracked for %s", strings.Join(prefixes, ", ")))
+		}
+		return fmt.Sprintf("no longer tracked for %s", strings.Join(untracked, ", ")), nil
+	}
+	if _, ok := wf.labelSuffix(wf.columnName(command.Name)); !ok {
+		return "", permanent(fmt.Errorf("unknown command, try %s, /untrack or /status", strings.Join(commandNames(wf), ", ")))
+	}
+	prefixes, err := mon.commandReleases(ctx, item, command)
+	if err != nil {
+		return "", err
+	}
+	column := wf.columnName(command.Name)
+	for _, prefix := range prefixes {
+		if err := mon.handleLabelEvent(item, fmt.Sprintf("%s/%s", prefix, command.Name), d); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("moved to %s for %s", column, strings.Join(prefixes, ", ")), nil
+}
+
+// commandReleases resolves the release of a command to label prefixes of open
+// releases. A release like 17.06 picks the single open release it is the
+// start of, and leaving it out means every release the issue is tracked for.
+func (mon *githubMonitor) commandReleases(ctx context.Context, item *boardItem, command slashCommand) ([]string, error) {
+	grammar := mon.config.grammarFor(item.Owner, item.Repo)
+	if command.Release == "" {
+		labels, err := mon.releaseLabels(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		var prefixes []string
+		for _, label := range labels {
+			prefix, _, _ := grammar.ParseLabel(label)
+			if !containsString(prefixes, prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		if len(prefixes) == 0 {
+			return nil, permanent(fmt.Errorf("not tracked for any release yet, name one like `/%s 17.06.1-ee-1`", command.Name))
+		}
+		return prefixes, nil
+	}
+	projects, err := mon.openProjects(ctx, item.Owner, item.Repo)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, project := range projects {
+		release, err := grammar.Parse(*project.Name)
+		if err != nil || containsString(matches, release.Prefix) {
+			continue
+		}
+		if release.Prefix == command.Release {
+			return []string{release.Prefix}, nil
+		}
+		if strings.HasPrefix(release.Prefix, command.Release+".") || strings.HasPrefix(release.Prefix, command.Release+"-") {
+			matches = append(matches, release.Prefix)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, permanent(fmt.Errorf("no open release matches %s", command.Release))
+	case 1:
+		return matches, nil
+	}
+	return nil, permanent(fmt.Errorf("%s could be any of %s", command.Release, strings.Join(matches, ", ")))
+}
+
+// trackingStatus describes the releases an issue is tracked for.
+func (mon *githubMonitor) trackingStatus(ctx context.Context, item *boardItem) (string, error) {
+	labels, err := mon.releaseLabels(ctx, item)
+	if err != nil {
+		return "", err
+	}
+	if len(labels) == 0 {
+		return "not tracked for any release", nil
+	}
+	wf := mon.config.workflowFor(item.Owner, item.Repo)
+	grammar := mon.config.grammarFor(item.Owner, item.Repo)
+	var status []string
+	for _, label := range labels {
+		prefix, suffix, _ := grammar.ParseLabel(label)
+		status = append(status, fmt.Sprintf("%s in %s", prefix, wf.columnName(suffix)))
+	}
+	return strings.Join(status, ", "), nil
+}
+
+func commandNames(wf *workflow) []string {
+	var names []string
+	for _, column := range wf.Columns {
+		names = append(names, "/"+column.Label)
+	}
+	return names
+}
+
+// knownCommands returns the names of the commands of a workflow.
+func knownCommands(wf *workflow) []string {
+	names := []string{"status", "untrack"}
+	for _, column := range wf.Columns {
+		names = append(names, column.Label)
+	}
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// react adds a reaction to an issue comment. The vendored go-github can only
+// list reactions.
+func (mon *githubMonitor) react(ctx context.Context, owner, name string, commentID int, content string) error {
+	req, err := mon.client.NewRequest(
+		"POST",
+		fmt.Sprintf("repos/%s/%s/issues/comments/%d/reactions", owner, name, commentID),
+		map[string]string{"content": content},
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.squirrel-girl-preview")
+	_, err = mon.client.Do(ctx, req, nil)
+	return err
+}
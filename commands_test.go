@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestParseCommands(t *testing.T) {
+	names := []string{"status", "untrack", "triage", "cherry-pick"}
+	tests := []struct {
+		body string
+		want []slashCommand
+	}{
+		{"/cherry-pick 17.06", []slashCommand{{Name: "cherry-pick", Release: "17.06", Line: "/cherry-pick 17.06"}}},
+		{"  /status  \r\n/untrack 17.06.1-ee-1", []slashCommand{
+			{Name: "status", Line: "/status"},
+			{Name: "untrack", Release: "17.06.1-ee-1", Line: "/untrack 17.06.1-ee-1"},
+		}},
+		// Commands meant for people or other bots are left alone
+		{"/cc @someone\n/lgtm\n/assign", nil},
+		{"/triage 17.06 and more", nil},
+		{"Please /triage 17.06", nil},
+		{"```\n/status\n```\n/triage", []slashCommand{{Name: "triage", Line: "/triage"}}},
+		{"/Status", nil},
+	}
+	for _, tt := range tests {
+		if got := parseCommands(tt.body, names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCommands(%q) = %+v, want %+v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestHandleIssueCommentEventChecksPermission(t *testing.T) {
+	comment := func(sender string) string {
+		return `{
+			"action": "created",
+			"comment": {"id": 5, "body": "/triage 17.06", "user": {"login": "` + sender + `"}},
+			"issue": {"id": 100, "number": 42, "url": "https://api.github.com/repos/docker/cli/issues/42"},
+			"repository": {"name": "cli", "owner": {"login": "docker"}},
+			"sender": {"login": "` + sender + `", "type": "User"}
+		}`
+	}
+	tests := []struct {
+		name       string
+		payload    string
+		permission string
+		want       []string
+	}{
+		{"read access", comment("someone"), "read", []string{
+			"GET /repos/docker/cli/collaborators/someone/permission",
+			"POST /repos/docker/cli/issues/comments/5/reactions",
+			"POST /repos/docker/cli/issues/42/comments",
+		}},
+		{"bot", strings.Replace(comment("release-bot"), `"type": "User"`, `"type": "Bot"`, 1), "admin", nil},
+		{"no command", strings.Replace(comment("someone"), "/triage 17.06", "LGTM", 1), "admin", nil},
+		{"someone else's command", strings.Replace(comment("someone"), "/triage 17.06", "/cc @alice", 1), "read", nil},
+	}
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		fake := newFakeGitHub(map[string]fakeResponse{
+			"GET /repos/docker/cli/collaborators/someone/permission": {body: `{"permission": "` + tt.permission + `"}`},
+			"POST /repos/docker/cli/issues/comments/5/reactions":     {code: http.StatusCreated, body: `{}`},
+			"POST /repos/docker/cli/issues/42/comments":              {code: http.StatusCreated, body: `{}`},
+		})
+		mon := &githubMonitor{ctx: context.Background(), client: fake.client(), config: cfg}
+		event, err := github.ParseWebHook("issue_comment", []byte(tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mon.handleIssueCommentEvent(event.(*github.IssueCommentEvent), &delivery{URI: "/docker/cli"}); err != nil {
+			t.Errorf("%s: handleIssueCommentEvent() = %v", tt.name, err)
+		}
+		if got := fake.sent(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: handleIssueCommentEvent() sent %v, want %v", tt.name, got, tt.want)
+		}
+		fake.Close()
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var colorPattern = regexp.MustCompile("^[0-9a-fA-F]{6}$")
+
+// config is the file passed with -config. Workflows are defined once by name
+// and every repository picks the one it uses, falling back to "default".
+type config struct {
+	Workflows     map[string]*workflow   `json:"workflows"`
+	Repositories  map[string]*repoConfig `json:"repositories"`
+	Organizations map[string]*orgConfig  `json:"organizations"`
+	// Release is the grammar of project names, either a preset (docker,
+	// semver, calver) or a pattern. Defaults to docker.
+	Release string `json:"release"`
+
+	grammar *releaseGrammar
+}
+
+// repoConfig holds the settings for a single owner/name repository. Secrets
+// and tokens may reference environment variables like ${RELEASE_SECRET} so
+// they don't have to live in the config file.
+type repoConfig struct {
+	Workflow string `json:"workflow"`
+	// Release overrides the config wide release grammar.
+	Release string `json:"release"`
+	// Secrets are the webhook secrets deliveries may be signed with. Listing
+	// more than one allows rotating a secret. Secrets naming a variable that
+	// isn't set are left out. Defaults to RELEASE_BOT_WEBHOOK_SECRET.
+	Secrets []string `json:"secrets"`
+	// Token is a personal access token used for this repository instead of
+	// the app installation or RELEASE_BOT_GITHUB_TOKEN.
+	Token string `json:"token"`
+	// Disabled repositories have their deliveries acknowledged and dropped.
+	Disabled bool `json:"disabled"`
+	// DryRun repositories have their deliveries handled without changing
+	// anything, logging what would have been done instead.
+	DryRun bool `json:"dry_run"`
+	// ReleaseBranch is the branch of a release, like "release/{version}".
+	// Cherry-pick pull requests are only opened when it is set.
+	ReleaseBranch string `json:"release_branch"`
+	// Reconcile says whether the "board", the "labels" or, by default, the
+	// "latest" change of the two wins when they disagree.
+	Reconcile string `json:"reconcile"`
+
+	grammar *releaseGrammar
+}
+
+// orgConfig holds the settings for an organization wide webhook. Repositories
+// listed here track their issues and pull requests on the organization's
+// release projects instead of their own, while the release labels are kept in
+// each of them. Their own settings take precedence over the organization's.
+type orgConfig struct {
+	repoConfig
+	Repositories []string `json:"repositories"`
+}
+
+// workflow describes the columns of a release project, in board order, and
+// the label suffixes that map onto them.
+type workflow struct {
+	Columns []workflowColumn `json:"columns"`
+	// OnOpen is the label suffix applied to newly opened issues for every
+	// open release. Leave it empty to not label new issues.
+	OnOpen string `json:"on_open"`
+	// OnMerge maps label suffixes to the one a merged pull request's cards
+	// advance to, like {"cherry-pick": "cherry-picked"}.
+	OnMerge map[string]string `json:"on_merge"`
+	// CherryPick is the label suffix that has the change of an issue or pull
+	// request cherry-picked onto the release branch.
+	CherryPick string `json:"cherry_pick"`
+	// CherryPicked is the label suffix applied to what a pull request
+	// backports once it merges into a release branch.
+	CherryPicked string `json:"cherry_picked"`
+	// Rotate are the label suffixes of the columns whose cards are carried
+	// over to the next release candidate when a project is closed.
+	Rotate []string `json:"rotate"`
+	// PriorityLabel is what the labels ranking carried over cards start with,
+	// followed by the rank: with priority/p the cards of priority/p0 go on top
+	// of those of priority/p1. Defaults to priority/p.
+	PriorityLabel string `json:"priority_label"`
+}
+
+const defaultPriorityLabel = "priority/p"
+
+type workflowColumn struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Color string `json:"color"`
+}
+
+// defaultWorkflow is the Triage -> Cherry Pick -> Cherry Picked board used by
+// docker/release-tracking.
+var defaultWorkflow = &workflow{
+	Columns: []workflowColumn{
+		{Name: "Triage", Label: "triage", Color: "eeeeee"},
+		{Name: "Cherry Pick", Label: "cherry-pick", Color: "a98bf3"},
+		{Name: "Cherry Picked", Label: "cherry-picked", Color: "bfe5bf"},
+	},
+	OnOpen:        "triage",
+	CherryPick:    "cherry-pick",
+	CherryPicked:  "cherry-picked",
+	Rotate:        []string{"triage", "cherry-pick"},
+	PriorityLabel: defaultPriorityLabel,
+}
+
+// loadConfig reads the config file at path. An empty path gives a config
+// that uses the default workflow everywhere.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %v", path, err)
+		}
+	}
+	if cfg.Workflows == nil {
+		cfg.Workflows = make(map[string]*workflow)
+	}
+	if cfg.Workflows["default"] == nil {
+		cfg.Workflows["default"] = defaultWorkflow
+	}
+	for name, wf := range cfg.Workflows {
+		if err := wf.validate(); err != nil {
+			return nil, fmt.Errorf("Workflow %s: %v", name, err)
+		}
+	}
+	var err error
+	if cfg.grammar, err = newReleaseGrammar(cfg.Release); err != nil {
+		return nil, fmt.Errorf("Release grammar: %v", err)
+	}
+	// GitHub treats owner and repository names case insensitively
+	repositories := make(map[string]*repoConfig)
+	for repo, rc := range cfg.Repositories {
+		if len(strings.Split(repo, "/")) != 2 {
+			return nil, fmt.Errorf("Repository %q is not of the form owner/name", repo)
+		}
+		if err := rc.prepare(cfg); err != nil {
+			return nil, fmt.Errorf("Repository %s: %v", repo, err)
+		}
+		repositories[strings.ToLower(repo)] = rc
+	}
+	cfg.Repositories = repositories
+	organizations := make(map[string]*orgConfig)
+	for org, oc := range cfg.Organizations {
+		if err := oc.prepare(cfg); err != nil {
+			return nil, fmt.Errorf("Organization %s: %v", org, err)
+		}
+		for _, repo := range oc.Repositories {
+			bits := strings.Split(repo, "/")
+			if len(bits) != 2 || !strings.EqualFold(bits[0], org) {
+				return nil, fmt.Errorf("Organization %s: %q is not a repository of the organization", org, repo)
+			}
+		}
+		organizations[strings.ToLower(org)] = oc
+	}
+	cfg.Organizations = organizations
+	return cfg, nil
+}
+
+// prepare checks the settings and fills in secrets from the environment.
+func (rc *repoConfig) prepare(cfg *config) error {
+	if rc.Workflow != "" && cfg.Workflows[rc.Workflow] == nil {
+		return fmt.Errorf("unknown workflow %s", rc.Workflow)
+	}
+	if rc.Release != "" {
+		var err error
+		if rc.grammar, err = newReleaseGrammar(rc.Release); err != nil {
+			return fmt.Errorf("release grammar: %v", err)
+		}
+	}
+	switch rc.Reconcile {
+	case "", reconcileBoard, reconcileLabels, reconcileLatest:
+	default:
+		return fmt.Errorf("reconcile must be %s, %s or %s, not %q", reconcileBoard, reconcileLabels, reconcileLatest, rc.Reconcile)
+	}
+	// A secret whose variable isn't set would let anyone sign deliveries
+	var secrets []string
+	for _, secret := range rc.Secrets {
+		if secret = os.ExpandEnv(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	if len(rc.Secrets) > 0 && len(secrets) == 0 {
+		return fmt.Errorf("none of the secrets %s is set", strings.Join(rc.Secrets, ", "))
+	}
+	rc.Secrets = secrets
+	rc.Token = os.ExpandEnv(rc.Token)
+	return nil
+}
+
+// repository returns the settings of owner/name, or nil if the repository
+// isn't in the config.
+func (cfg *config) repository(owner, name string) *repoConfig {
+	return cfg.Repositories[strings.ToLower(fmt.Sprintf("%s/%s", owner, name))]
+}
+
+// organization returns the settings of an organization, or nil if the
+// organization isn't in the config.
+func (cfg *config) organization(org string) *orgConfig {
+	return cfg.Organizations[strings.ToLower(org)]
+}
+
+// projectOrg returns the organization whose projects track the issues of
+// owner/name, or "" if the repository uses its own projects.
+func (cfg *config) projectOrg(owner, name string) string {
+	oc := cfg.organization(owner)
+	if oc == nil {
+		return ""
+	}
+	for _, repo := range oc.Repositories {
+		if strings.EqualFold(repo, fmt.Sprintf("%s/%s", owner, name)) {
+			return owner
+		}
+	}
+	return ""
+}
+
+// settingsFor returns the settings that apply to owner/name, in order of
+// precedence. An empty name gives the organization's settings.
+func (cfg *config) settingsFor(owner, name string) []*repoConfig {
+	var settings []*repoConfig
+	if rc := cfg.repository(owner, name); rc != nil {
+		settings = append(settings, rc)
+	}
+	if name == "" || cfg.projectOrg(owner, name) != "" {
+		if oc := cfg.organization(owner); oc != nil {
+			settings = append(settings, &oc.repoConfig)
+		}
+	}
+	return settings
+}
+
+// workflowFor returns the workflow configured for owner/name.
+func (cfg *config) workflowFor(owner, name string) *workflow {
+	for _, rc := range cfg.settingsFor(owner, name) {
+		if rc.Workflow != "" {
+			return cfg.Workflows[rc.Workflow]
+		}
+	}
+	return cfg.Workflows["default"]
+}
+
+// grammarFor returns the release grammar used for project names of owner/name.
+func (cfg *config) grammarFor(owner, name string) *releaseGrammar {
+	for _, rc := range cfg.settingsFor(owner, name) {
+		if rc.grammar != nil {
+			return rc.grammar
+		}
+	}
+	return cfg.grammar
+}
+
+// releaseBranchFor returns the release branch template of owner/name, empty
+// if it doesn't cherry-pick automatically.
+func (cfg *config) releaseBranchFor(owner, name string) string {
+	for _, rc := range cfg.settingsFor(owner, name) {
+		if rc.ReleaseBranch != "" {
+			return rc.ReleaseBranch
+		}
+	}
+	return ""
+}
+
+// dryRun reports whether changes to owner/name are only pretended.
+func (cfg *config) dryRun(owner, name string) bool {
+	for _, rc := range cfg.settingsFor(owner, name) {
+		if rc.DryRun {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileFor returns what wins when the board and the labels of owner/name
+// disagree.
+func (cfg *config) reconcileFor(owner, name string) string {
+	for _, rc := range cfg.settingsFor(owner, name) {
+		if rc.Reconcile != "" {
+			return rc.Reconcile
+		}
+	}
+	return reconcileLatest
+}
+
+// tokens returns the personal access tokens of the repositories and
+// organizations.
+func (cfg *config) tokens() []string {
+	var tokens []string
+	for _, rc := range cfg.Repositories {
+		if rc.Token != "" && !containsString(tokens, rc.Token) {
+			tokens = append(tokens, rc.Token)
+		}
+	}
+	for _, oc := range cfg.Organizations {
+		if oc.Token != "" && !containsString(tokens, oc.Token) {
+			tokens = append(tokens, oc.Token)
+		}
+	}
+	return tokens
+}
+
+func (wf *workflow) validate() error {
+	if len(wf.Columns) == 0 {
+		return fmt.Errorf("no columns defined")
+	}
+	names := make(map[string]bool)
+	labels := make(map[string]bool)
+	for _, column := range wf.Columns {
+		if column.Name == "" || column.Label == "" {
+			return fmt.Errorf("columns need both a name and a label")
+		}
+		if strings.Contains(column.Label, "/") {
+			return fmt.Errorf("label %q can not contain a /", column.Label)
+		}
+		if !colorPattern.MatchString(column.Color) {
+			return fmt.Errorf("label %q has invalid color %q", column.Label, column.Color)
+		}
+		if names[column.Name] || labels[column.Label] {
+			return fmt.Errorf("column %q is defined twice", column.Name)
+		}
+		names[column.Name] = true
+		labels[column.Label] = true
+	}
+	if wf.OnOpen != "" && !labels[wf.OnOpen] {
+		return fmt.Errorf("on_open label %q is not one of the columns", wf.OnOpen)
+	}
+	if wf.CherryPick != "" && !labels[wf.CherryPick] {
+		return fmt.Errorf("cherry_pick label %q is not one of the columns", wf.CherryPick)
+	}
+	if wf.CherryPicked != "" && !labels[wf.CherryPicked] {
+		return fmt.Errorf("cherry_picked label %q is not one of the columns", wf.CherryPicked)
+	}
+	for _, label := range wf.Rotate {
+		if !labels[label] {
+			return fmt.Errorf("rotate label %q is not one of the columns", label)
+		}
+	}
+	for from, to := range wf.OnMerge {
+		if !labels[from] || !labels[to] {
+			return fmt.Errorf("on_merge %q -> %q does not map between columns", from, to)
+		}
+	}
+	return nil
+}
+
+// priorityLabel returns what the labels ranking carried over cards start with.
+func (wf *workflow) priorityLabel() string {
+	if wf.PriorityLabel == "" {
+		return defaultPriorityLabel
+	}
+	return wf.PriorityLabel
+}
+
+// columnName returns the column a label suffix moves cards into. Suffixes
+// that aren't part of the workflow map onto a column of the same name.
+func (wf *workflow) columnName(labelSuffix string) string {
+	for _, column := range wf.Columns {
+		if column.Label == labelSuffix {
+			return column.Name
+		}
+	}
+	return labelSuffix
+}
+
+// labelSuffix returns the label suffix of a workflow column.
+func (wf *workflow) labelSuffix(columnName string) (string, bool) {
+	for _, column := range wf.Columns {
+		if column.Name == columnName {
+			return column.Label, true
+		}
+	}
+	return "", false
+}
+
+// labels returns the full label names of every workflow column for a release,
+// like 17.06.1-ee-1/triage.
+func (wf *workflow) labels(labelPrefix string) []string {
+	var labels []string
+	for _, column := range wf.Columns {
+		labels = append(labels, fmt.Sprintf("%s/%s", labelPrefix, column.Label))
+	}
+	return labels
+}
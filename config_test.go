@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file for loadConfig, returning its path.
+func writeConfig(t *testing.T, content string) (string, func()) {
+	f, err := ioutil.TempFile("", "release-bot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	for _, name := range []string{"RELEASE_TRACKING_SECRET", "STAGING_RELEASE_TRACKING_SECRET", "DOCKER_ORG_SECRET"} {
+		os.Setenv(name, strings.ToLower(name))
+		defer os.Unsetenv(name)
+	}
+	cfg, err := loadConfig("config.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The old secret is only set while rotating
+	if got := cfg.repository("docker", "release-tracking").Secrets; !reflect.DeepEqual(got, []string{"release_tracking_secret"}) {
+		t.Errorf("docker/release-tracking has secrets %q, want only the one that is set", got)
+	}
+	wf := cfg.workflowFor("docker", "staging-release-tracking")
+	if got := wf.columnName("needs-backport"); got != "Needs Backport" {
+		t.Errorf("staging-release-tracking moves needs-backport cards to %q, want Needs Backport", got)
+	}
+	if got := cfg.workflowFor("docker", "release-tracking"); got != cfg.Workflows["default"] {
+		t.Errorf("release-tracking uses %+v, want the default workflow", got)
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.workflowFor("docker", "cli"); got != defaultWorkflow {
+		t.Errorf("workflowFor(docker, cli) = %+v, want the default workflow", got)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{`{"workflows": {`, "Could not parse"},
+		{`{"repositories": {"docker/cli": {"workflow": "missing"}}}`, "unknown workflow missing"},
+		{`{"workflows": {"default": {"columns": []}}}`, "Workflow default: no columns defined"},
+		{`{"release": "^(\\d+)$"}`, "Release grammar"},
+		{`{"repositories": {"cli": {}}}`, "not of the form owner/name"},
+		{`{"organizations": {"docker": {"repositories": ["moby/moby"]}}}`, "not a repository of the organization"},
+		{`{"repositories": {"docker/cli": {"secrets": ["${RELEASE_BOT_TEST_UNSET_SECRET}"]}}}`, "none of the secrets"},
+	}
+	for _, tt := range tests {
+		path, cleanup := writeConfig(t, tt.config)
+		_, err := loadConfig(path)
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadConfig(%s) = %v, want an error containing %q", tt.config, err, tt.want)
+		}
+	}
+}
+
+func TestConfigOrganizations(t *testing.T) {
+	path, cleanup := writeConfig(t, `{
+		"workflows": {"backport": {"columns": [{"name": "Backport", "label": "backport", "color": "eeeeee"}]}},
+		"repositories": {"docker/cli": {"workflow": "default"}},
+		"organizations": {"Docker": {"workflow": "backport", "release": "semver", "repositories": ["docker/cli", "docker/docker"]}}
+	}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		owner, name string
+		projectOrg  string
+		workflow    *workflow
+		grammar     *releaseGrammar
+	}{
+		// The repository's own settings take precedence
+		{"docker", "cli", "docker", cfg.Workflows["default"], cfg.organization("docker").grammar},
+		{"docker", "docker", "docker", cfg.Workflows["backport"], cfg.organization("docker").grammar},
+		// Repositories not listed use their own projects and the defaults
+		{"docker", "compose", "", cfg.Workflows["default"], cfg.grammar},
+		{"moby", "moby", "", cfg.Workflows["default"], cfg.grammar},
+		// Organization projects
+		{"docker", "", "", cfg.Workflows["backport"], cfg.organization("docker").grammar},
+	}
+	for _, tt := range tests {
+		if got := cfg.projectOrg(tt.owner, tt.name); got != tt.projectOrg {
+			t.Errorf("projectOrg(%s, %s) = %q, want %q", tt.owner, tt.name, got, tt.projectOrg)
+		}
+		if got := cfg.workflowFor(tt.owner, tt.name); got != tt.workflow {
+			t.Errorf("workflowFor(%s, %s) = %+v, want %+v", tt.owner, tt.name, got, tt.workflow)
+		}
+		if got := cfg.grammarFor(tt.owner, tt.name); got != tt.grammar {
+			t.Errorf("grammarFor(%s, %s) = %+v, want %+v", tt.owner, tt.name, got, tt.grammar)
+		}
+	}
+}
+
+func TestWorkflowValidate(t *testing.T) {
+	column := func(name, label, color string) workflowColumn {
+		return workflowColumn{Name: name, Label: label, Color: color}
+	}
+	tests := []struct {
+		name string
+		wf   *workflow
+		want string
+	}{
+		{"default", defaultWorkflow, ""},
+		{"no columns", &workflow{}, "no columns defined"},
+		{"no label", &workflow{Columns: []workflowColumn{column("Triage", "", "eeeeee")}}, "need both a name and a label"},
+		{"slash", &workflow{Columns: []workflowColumn{column("Triage", "tri/age", "eeeeee")}}, "can not contain a /"},
+		{"color", &workflow{Columns: []workflowColumn{column("Triage", "triage", "#eeeeee")}}, "invalid color"},
+		{"twice", &workflow{Columns: []workflowColumn{column("Triage", "triage", "eeeeee"), column("Triage", "todo", "eeeeee")}}, "defined twice"},
+		{"on_open", &workflow{Columns: []workflowColumn{column("Triage", "triage", "eeeeee")}, OnOpen: "todo"}, "on_open label"},
+		{"cherry_pick", &workflow{Columns: []workflowColumn{column("Triage", "triage", "eeeeee")}, CherryPick: "pick"}, "cherry_pick label"},
+		{"cherry_picked", &workflow{Columns: []workflowColumn{column("Triage", "triage", "eeeeee")}, CherryPicked: "picked"}, "cherry_picked label"},
+		{"rotate", &workflow{Columns: []workflowColumn{column("Triage", "triage", "eeeeee")}, Rotate: []string{"todo"}}, "rotate label"},
+		{"on_merge", &workflow{Columns: []workflowColumn{column("Triage", "triage", "eeeeee")}, OnMerge: map[string]string{"triage": "done"}}, "does not map between columns"},
+	}
+	for _, tt := range tests {
+		err := tt.wf.validate()
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: validate() = %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: validate() = %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestWorkflowColumns(t *testing.T) {
+	wf := defaultWorkflow
+	if got := wf.columnName("cherry-pick"); got != "Cherry Pick" {
+		t.Errorf("columnName(cherry-pick) = %q, want Cherry Pick", got)
+	}
+	if got := wf.columnName("Backlog"); got != "Backlog" {
+		t.Errorf("columnName(Backlog) = %q, want Backlog", got)
+	}
+	if got, ok := wf.labelSuffix("Cherry Picked"); got != "cherry-picked" || !ok {
+		t.Errorf("labelSuffix(Cherry Picked) = %q, %v, want cherry-picked", got, ok)
+	}
+	if _, ok := wf.labelSuffix("Backlog"); ok {
+		t.Errorf("labelSuffix(Backlog) found a label for a column that isn't in the workflow")
+	}
+	want := []string{"17.06.1-ee-1/triage", "17.06.1-ee-1/cherry-pick", "17.06.1-ee-1/cherry-picked"}
+	if got := wf.labels("17.06.1-ee-1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels(17.06.1-ee-1) = %v, want %v", got, want)
+	}
+	if got := (&workflow{}).priorityLabel(); got != "priority/p" {
+		t.Errorf("priorityLabel() of a workflow without one = %q, want priority/p", got)
+	}
+	if got := (&workflow{PriorityLabel: "P"}).priorityLabel(); got != "P" {
+		t.Errorf("priorityLabel() = %q, want P", got)
+	}
+}
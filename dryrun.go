@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dryRunSHA is the SHA of commits that were only pretended to be made.
+const dryRunSHA = "0000000000000000000000000000000000000000"
+
+// dryRunTransport stands in for GitHub on every request that would change
+// something, logging what would have been done instead. Reads go through to
+// base so the handlers see the real state of things.
+type dryRunTransport struct {
+	base http.RoundTripper
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return t.base.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("Would have %s %s %s", req.Method, req.URL.Path, bytes.TrimSpace(body))
+	return dryRunResponse(req, body), nil
+}
+
+// dryRunResponse makes up GitHub's answer to a change so the handlers carry
+// on as if it was made. Objects are echoed back with an ID, number and SHA
+// of zero, deletions and merges have nothing to say.
+func dryRunResponse(req *http.Request, body []byte) *http.Response {
+	status := http.StatusOK
+	var answer []byte
+	switch {
+	case req.Method == "DELETE" || strings.HasSuffix(req.URL.Path, "/merges"):
+		status = http.StatusNoContent
+	case bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")):
+		// Like the labels added to an issue
+		answer = []byte("[]")
+	default:
+		fields := make(map[string]interface{})
+		json.Unmarshal(body, &fields)
+		// Commits are created from SHAs but come back with objects
+		if strings.HasSuffix(req.URL.Path, "/git/commits") {
+			if tree, ok := fields["tree"].(string); ok {
+				fields["tree"] = map[string]string{"sha": tree}
+			}
+			if parents, ok := fields["parents"].([]interface{}); ok {
+				for i, parent := range parents {
+					parents[i] = map[string]interface{}{"sha": parent}
+				}
+			}
+		}
+		for field, value := range map[string]interface{}{"id": 0, "number": 0, "sha": dryRunSHA} {
+			if _, ok := fields[field]; !ok {
+				fields[field] = value
+			}
+		}
+		answer, _ = json.Marshal(fields)
+		if req.Method == "POST" {
+			status = http.StatusCreated
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(answer)),
+		ContentLength: int64(len(answer)),
+		Request:       req,
+	}
+}
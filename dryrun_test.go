@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRunResponse(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		answer string
+	}{
+		{"POST", "/repos/docker/cli/labels", `{"name":"17.06.1-ee-1/triage","color":"eeeeee"}`, http.StatusCreated,
+			`{"color":"eeeeee","id":0,"name":"17.06.1-ee-1/triage","number":0,"sha":"` + dryRunSHA + `"}`},
+		{"POST", "/repos/docker/cli/issues/1/labels", `["17.06.1-ee-1/triage"]`, http.StatusOK, `[]`},
+		{"PATCH", "/repos/docker/cli/git/refs/heads/17.06", `{"sha":"abc123"}`, http.StatusOK,
+			`{"id":0,"number":0,"sha":"abc123"}`},
+		{"POST", "/repos/docker/cli/git/commits", `{"message":"Fix","tree":"abc","parents":["def"]}`, http.StatusCreated,
+			`{"id":0,"message":"Fix","number":0,"parents":[{"sha":"def"}],"sha":"` + dryRunSHA + `","tree":{"sha":"abc"}}`},
+		{"DELETE", "/projects/columns/cards/31", ``, http.StatusNoContent, ``},
+		{"POST", "/repos/docker/cli/merges", `{"base":"17.06"}`, http.StatusNoContent, ``},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "https://api.github.com"+tt.path, nil)
+		resp := dryRunResponse(req, []byte(tt.body))
+		answer, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status || string(answer) != tt.answer {
+			t.Errorf("%s %s: answered %d %s, want %d %s", tt.method, tt.path, resp.StatusCode, answer, tt.status, tt.answer)
+		}
+	}
+}
+
+func TestDryRunTransportOnlyReads(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"GET /repos/docker/cli/labels": {body: `[]`},
+	})
+	defer fake.Close()
+	client := &http.Client{Transport: &dryRunTransport{base: http.DefaultTransport}}
+	resp, err := client.Get(fake.URL + "/repos/docker/cli/labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Post(fake.URL+"/repos/docker/cli/labels", "application/json", bytes.NewBufferString(`{"name":"triage"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var label map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&label)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || label["name"] != "triage" {
+		t.Errorf("pretended POST answered %d %v, want 201 with the label", resp.StatusCode, label)
+	}
+	if sent, want := fake.sent(), []string{"GET /repos/docker/cli/labels"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("GitHub got %v, want %v", sent, want)
+	}
+}
+
+func TestDryRunRepositories(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"POST /repos/docker/cli/issues/1/labels": {body: `[{"name":"17.06.1-ee-1/triage"}]`},
+	})
+	defer fake.Close()
+	path, cleanup := writeConfig(t, `{"repositories": {"docker/cli": {}, "docker/docker": {"dry_run": true}}}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, cleanupAudit := newTestAuditLog(t)
+	defer cleanupAudit()
+	stats := newMetrics()
+	clients, err := newClientSource(context.Background(), fake.URL+"/", "token", nil, time.Minute, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon := &githubMonitor{ctx: context.Background(), clients: clients, config: cfg, metrics: stats, audit: audit}
+	ctx := context.Background()
+	for _, name := range []string{"cli", "docker"} {
+		m, err := mon.forOwner(ctx, "docker", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.dryRun != (name == "docker") {
+			t.Errorf("docker/%s has dry run %v", name, m.dryRun)
+		}
+		if err := m.addLabels(ctx, "docker", name, 1, []string{"17.06.1-ee-1/triage"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent, want := fake.sent(), []string{"POST /repos/docker/cli/issues/1/labels"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("GitHub got %v, want %v", sent, want)
+	}
+	records, err := audit.query(&auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].DryRun || !records[1].DryRun {
+		t.Errorf("audit log has %+v, want only the change to docker/docker marked as a dry run", records)
+	}
+	// The whole server can be in dry-run mode too
+	mon.dryRun = true
+	if m, err := mon.forOwner(ctx, "docker", "cli"); err != nil || !m.dryRun {
+		t.Errorf("forOwner(docker, cli) of a dry-run server = %+v, %v", m, err)
+	}
+	if !strings.Contains(scrape(stats), `release_bot_github_requests_total{method="POST",endpoint="repos/:owner/:repo/issues/:number/labels",status="200"} 1`) {
+		t.Errorf("pretended requests were counted as made")
+	}
+}
+
+func TestDryRunLeavesCardIndexAlone(t *testing.T) {
+	fake := newFakeGitHub(reconcileResponses())
+	defer fake.Close()
+	mon, cleanup := newReconcileMonitor(t, fake, reconcileBoard)
+	defer cleanup()
+	mon.dryRun = true
+	mon.client = mon.clients.forToken("token", true)
+	d := &delivery{URI: "/docker/cli"}
+	item := func(number int) *boardItem {
+		return &boardItem{Owner: "docker", Repo: "cli", Number: number, URL: fmt.Sprintf("https://api.github.com/repos/docker/cli/issues/%d", number), ContentID: 100 + number, ContentType: "Issue"}
+	}
+	// Moving the card of #1 and adding one for #2 is only pretended
+	if err := mon.handleLabelEvent(item(1), "17.06.1-ee-1/cherry-pick", d); err != nil {
+		t.Fatal(err)
+	}
+	if err := mon.handleLabelEvent(item(2), "17.06.1-ee-1/triage", d); err != nil {
+		t.Fatal(err)
+	}
+	if loc, found := mon.cards.find(2, item(1).URL); !found || loc.ColumnID != 21 {
+		t.Errorf("card of #1 is indexed in %+v, want still in Triage", loc)
+	}
+	if loc, found := mon.cards.find(2, item(2).URL); found {
+		t.Errorf("pretended card of #2 was indexed as %+v", loc)
+	}
+	for _, request := range fake.sent() {
+		if !strings.HasPrefix(request, "GET ") {
+			t.Errorf("GitHub got %s in a dry run", request)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// echoLedger remembers the changes the bot made for a while, so the webhooks
+// GitHub sends about them can be told apart from changes made by people.
+// Handling those echoes would only have the bot check its own work, or worse,
+// undo it when two changes race.
+type echoLedger struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]time.Time
+	swept   time.Time
+}
+
+// newEchoLedger creates a ledger remembering changes for window, 0 to not
+// recognize any echoes.
+func newEchoLedger(window time.Duration) *echoLedger {
+	return &echoLedger{window: window, pending: make(map[string]time.Time)}
+}
+
+// expect notes a change that is about to be made.
+func (l *echoLedger) expect(key string) {
+	if l == nil || l.window == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.pending[key] = now.Add(l.window)
+	// Not every change has its webhook delivered
+	if now.Sub(l.swept) > l.window {
+		for k, expires := range l.pending {
+			if now.After(expires) {
+				delete(l.pending, k)
+			}
+		}
+		l.swept = now
+	}
+}
+
+// seen reports whether a change was made recently. The change stays in the
+// ledger since the same webhook can be delivered to both the repository and
+// the organization.
+func (l *echoLedger) seen(key string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expires, ok := l.pending[key]
+	return ok && time.Now().Before(expires)
+}
+
+func labelEchoKey(action, owner, name string, number int, label string) string {
+	return fmt.Sprintf("%s %s/%s#%d %s", action, strings.ToLower(owner), strings.ToLower(name), number, label)
+}
+
+func cardEchoKey(action string, cardID, columnID int) string {
+	return fmt.Sprintf("card %s %d %d", action, cardID, columnID)
+}
+
+// expectEcho notes a change about to be made, unless it is only pretended.
+func (mon *githubMonitor) expectEcho(key string) {
+	if !mon.dryRun {
+		mon.echoes.expect(key)
+	}
+}
+
+// echoKey returns the ledger key of the change a delivery is about, empty if
+// the bot doesn't make that kind of change.
+func echoKey(event string, payload []byte) string {
+	var p struct {
+		Action string `json:"action"`
+		Number int    `json:"number"`
+		Label  *struct {
+			Name string `json:"name"`
+		} `json:"label"`
+		Issue *struct {
+			Number int `json:"number"`
+		} `json:"issue"`
+		ProjectCard *struct {
+			ID       int `json:"id"`
+			ColumnID int `json:"column_id"`
+		} `json:"project_card"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ""
+	}
+	switch {
+	case (event == "issues" || event == "pull_request") && (p.Action == "labeled" || p.Action == "unlabeled") && p.Label != nil:
+		number := p.Number
+		if p.Issue != nil {
+			number = p.Issue.Number
+		}
+		owner, name := payloadRepository(payload)
+		return labelEchoKey(p.Action, owner, name, number, p.Label.Name)
+	case event == "project_card" && p.ProjectCard != nil:
+		return cardEchoKey(p.Action, p.ProjectCard.ID, p.ProjectCard.ColumnID)
+	}
+	return ""
+}
+
+// isEcho reports whether a delivery is about a change the bot just made: it
+// was sent by the bot and the change is in the ledger. Without a login for the
+// bot the ledger alone decides.
+func (mon *githubMonitor) isEcho(d *delivery) bool {
+	key := echoKey(d.Event, d.Payload)
+	if key == "" || !mon.echoes.seen(key) {
+		return false
+	}
+	login, ok := mon.clients.login(mon.identity)
+	return !ok || strings.EqualFold(payloadSender(d.Payload), login)
+}
+
+// resolveLogins looks up the logins the bot's changes are sent by, unless
+// echoes aren't recognized anyway.
+func (mon *githubMonitor) resolveLogins() error {
+	if mon.echoes == nil || mon.echoes.window == 0 {
+		return nil
+	}
+	var tokens []string
+	if mon.clients.token != "" {
+		tokens = append(tokens, mon.clients.token)
+	}
+	for _, token := range mon.config.tokens() {
+		if !containsString(tokens, token) {
+			tokens = append(tokens, token)
+		}
+	}
+	ctx, cancel := context.WithTimeout(mon.ctx, time.Minute)
+	defer cancel()
+	return mon.clients.resolveLogins(ctx, tokens)
+}
+
+// handleEcho handles a delivery about a change the bot made itself. The board
+// and labels already agree, only a cherry-pick label still has its cherry-pick
+// to make.
+func (mon *githubMonitor) handleEcho(event interface{}, d *delivery) error {
+	log.Debugf("%s Skipping %s %s made by release-bot", d.URI, d.Event, payloadAction(d.Payload))
+	mon.metrics.echoes.add(1, d.Event)
+	switch e := event.(type) {
+	case *github.IssuesEvent:
+		if *e.Action == "labeled" {
+			return mon.handleCherryPickLabel(issueItem(e.Repo, e.Issue), *e.Label.Name, d)
+		}
+	case *github.PullRequestEvent:
+		if *e.Action == "labeled" {
+			pr, err := parsePullRequestEvent(d.Payload)
+			if err != nil {
+				return permanent(err)
+			}
+			return mon.handleCherryPickLabel(pullRequestItem(pr.Repo, pr.PullRequest), *pr.Label.Name, d)
+		}
+	}
+	return nil
+}
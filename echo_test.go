@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEchoKey(t *testing.T) {
+	tests := []struct {
+		event   string
+		payload string
+		want    string
+	}{
+		{
+			"issues",
+			`{"action":"labeled","issue":{"number":5},"label":{"name":"17.06.1-ee-1/triage"},"repository":{"name":"CLI","owner":{"login":"Docker"}}}`,
+			"labeled docker/cli#5 17.06.1-ee-1/triage",
+		},
+		{
+			"issues",
+			`{"action":"unlabeled","issue":{"number":5},"label":{"name":"17.06.1-ee-1/triage"},"repository":{"name":"cli","owner":{"login":"docker"}}}`,
+			"unlabeled docker/cli#5 17.06.1-ee-1/triage",
+		},
+		{
+			"pull_request",
+			`{"action":"labeled","number":7,"pull_request":{"number":7},"label":{"name":"17.06.1-ee-1/cherry-pick"},"repository":{"name":"cli","owner":{"login":"docker"}}}`,
+			"labeled docker/cli#7 17.06.1-ee-1/cherry-pick",
+		},
+		{
+			"project_card",
+			`{"action":"moved","project_card":{"id":3,"column_id":4}}`,
+			"card moved 3 4",
+		},
+		{"issues", `{"action":"opened","issue":{"number":5}}`, ""},
+		{"issue_comment", `{"action":"created","issue":{"number":5},"label":{"name":"x"}}`, ""},
+		{"issues", `not json`, ""},
+	}
+	for _, tt := range tests {
+		if got := echoKey(tt.event, []byte(tt.payload)); got != tt.want {
+			t.Errorf("echoKey(%s, %s) = %q, want %q", tt.event, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestEchoKeyMatchesLedgerKeys(t *testing.T) {
+	// What the bot expects has to be what the webhook comes back as
+	payload := `{"action":"labeled","issue":{"number":5},"label":{"name":"17.06/triage"},"repository":{"name":"cli","owner":{"login":"docker"}}}`
+	if echoKey("issues", []byte(payload)) != labelEchoKey("labeled", "Docker", "cli", 5, "17.06/triage") {
+		t.Error("label echo keys don't match")
+	}
+	payload = `{"action":"created","project_card":{"id":3,"column_id":4}}`
+	if echoKey("project_card", []byte(payload)) != cardEchoKey("created", 3, 4) {
+		t.Error("card echo keys don't match")
+	}
+}
+
+func TestEchoLedger(t *testing.T) {
+	l := newEchoLedger(50 * time.Millisecond)
+	l.expect("labeled docker/cli#5 17.06/triage")
+	if !l.seen("labeled docker/cli#5 17.06/triage") {
+		t.Error("expected change was not seen")
+	}
+	// Seen again when delivered to the organization too
+	if !l.seen("labeled docker/cli#5 17.06/triage") || l.seen("unlabeled docker/cli#5 17.06/triage") {
+		t.Error("ledger doesn't tell changes apart")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if l.seen("labeled docker/cli#5 17.06/triage") {
+		t.Error("change was seen after the window")
+	}
+	// A window of 0 and no ledger at all recognize nothing
+	for _, l := range []*echoLedger{newEchoLedger(0), nil} {
+		l.expect("card moved 3 4")
+		if l.seen("card moved 3 4") {
+			t.Errorf("ledger %v recognized an echo", l)
+		}
+	}
+}
+
+func TestIsEcho(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"GET /user": {body: `{"login":"release-bot"}`},
+	})
+	defer fake.Close()
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := newClientSource(context.Background(), fake.URL+"/", "token", nil, 0, newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon := &githubMonitor{
+		ctx:      context.Background(),
+		clients:  clients,
+		config:   cfg,
+		identity: tokenIdentity("token"),
+		echoes:   newEchoLedger(time.Minute),
+	}
+	if err := mon.resolveLogins(); err != nil {
+		t.Fatal(err)
+	}
+	mon.expectEcho(labelEchoKey("labeled", "docker", "cli", 5, "17.06/triage"))
+	labeled := func(sender string) *delivery {
+		return &delivery{Event: "issues", Payload: []byte(`{"action":"labeled","issue":{"number":5},"label":{"name":"17.06/triage"},` +
+			`"repository":{"name":"cli","owner":{"login":"docker"}},"sender":{"login":"` + sender + `"}}`)}
+	}
+	if !mon.isEcho(labeled("Release-Bot")) {
+		t.Error("the bot's own label change is not an echo")
+	}
+	// Someone else making the same change in the meantime
+	if mon.isEcho(labeled("alice")) {
+		t.Error("alice's label change is an echo")
+	}
+	// The login is looked up once, not for every delivery
+	if sent := fake.sent(); len(sent) != 1 {
+		t.Errorf("GitHub got %v, want the login looked up once", sent)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+
+	"github.com/google/go-github/github"
+)
+
+// fakeResponse is what fakeGitHub answers a request with.
+type fakeResponse struct {
+	code int
+	body string
+}
+
+// fakeGitHub serves canned responses by "METHOD /path?query", falling back
+// to "METHOD /path", and records the requests it gets. Requests without a
+// response get a 404.
+type fakeGitHub struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]fakeResponse
+	requests  []string
+	bodies    map[string]string
+}
+
+func newFakeGitHub(responses map[string]fakeResponse) *fakeGitHub {
+	f := &fakeGitHub{responses: responses, bodies: make(map[string]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	key := fmt.Sprintf("%s %s", r.Method, r.URL.Path)
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests = append(f.requests, key)
+	f.bodies[key] = string(body)
+	resp, ok := f.responses[key+"?"+r.URL.RawQuery]
+	if !ok {
+		resp, ok = f.responses[key]
+	}
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"Not Found"}`)
+		return
+	}
+	if resp.code == 0 {
+		resp.code = http.StatusOK
+	}
+	w.WriteHeader(resp.code)
+	fmt.Fprint(w, resp.body)
+}
+
+// client returns a go-github client talking to the fake.
+func (f *fakeGitHub) client() *github.Client {
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(f.URL + "/")
+	return client
+}
+
+// sent returns the requests made so far, like "GET /repos/docker/cli".
+func (f *fakeGitHub) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// body returns the body of the last request made as key.
+func (f *fakeGitHub) body(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bodies[key]
+}
@@ -0,0 +1,257 @@
+// Package githubapp authenticates against GitHub as a GitHub App.
+//
+// The app signs a short lived JWT with its private key and exchanges it for
+// installation access tokens, which are cached and refreshed shortly before
+// they expire. Transport adds the token of an installation to every request,
+// so an App plugs into any http.Client whatever GitHub library sits on top.
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBaseURL is the GitHub API the app talks to unless told otherwise.
+	DefaultBaseURL = "https://api.github.com/"
+
+	acceptHeader = "application/vnd.github.machine-man-preview+json"
+	// Installation tokens live for an hour, refresh them well before that.
+	refreshBefore = 5 * time.Minute
+)
+
+// App is a GitHub App identified by its ID and private key.
+type App struct {
+	ID      int64
+	BaseURL string
+	// Client is used to request installation tokens.
+	Client *http.Client
+
+	key *rsa.PrivateKey
+
+	// mu guards tokens, each installation has its own lock so requesting a
+	// token for one doesn't hold up the others
+	mu     sync.Mutex
+	tokens map[int64]*installation
+
+	slugMu sync.Mutex
+	slug   string
+}
+
+type installation struct {
+	mu    sync.Mutex
+	token *installationToken
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// New creates an App from a PEM encoded private key.
+func New(id int64, privateKey []byte) (*App, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not an RSA key")
+		}
+		key = rsaKey
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+	return &App{
+		ID:      id,
+		BaseURL: DefaultBaseURL,
+		Client:  http.DefaultClient,
+		key:     key,
+		tokens:  make(map[int64]*installation),
+	}, nil
+}
+
+// NewFromFile creates an App from a PEM encoded private key on disk.
+func NewFromFile(id int64, path string) (*App, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(id, data)
+}
+
+// JWT returns a signed token identifying the app itself. It is only good for
+// the /app endpoints and for requesting installation tokens.
+func (a *App) JWT() (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]int64{
+		// Allow for some clock drift between us and GitHub
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := encodeSegment(header) + "." + encodeSegment(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encodeSegment(signature), nil
+}
+
+// Token returns an access token for an installation, requesting a new one
+// if there is no cached token or it is about to expire.
+func (a *App) Token(ctx context.Context, installationID int64) (string, error) {
+	a.mu.Lock()
+	inst := a.tokens[installationID]
+	if inst == nil {
+		inst = &installation{}
+		a.tokens[installationID] = inst
+	}
+	a.mu.Unlock()
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if t := inst.token; t != nil && time.Now().Add(refreshBefore).Before(t.ExpiresAt) {
+		return t.Token, nil
+	}
+	var t installationToken
+	path := fmt.Sprintf("app/installations/%d/access_tokens", installationID)
+	if err := a.do(ctx, "POST", path, &t); err != nil {
+		return "", fmt.Errorf("could not get token for installation %d: %v", installationID, err)
+	}
+	inst.token = &t
+	return t.Token, nil
+}
+
+// Installation looks up the installation of the app on a repository.
+func (a *App) Installation(ctx context.Context, owner, repo string) (int64, error) {
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	if err := a.do(ctx, "GET", fmt.Sprintf("repos/%s/%s/installation", owner, repo), &installation); err != nil {
+		return 0, fmt.Errorf("app is not installed on %s/%s: %v", owner, repo, err)
+	}
+	return installation.ID, nil
+}
+
+// OrgInstallation looks up the installation of the app on an organization.
+func (a *App) OrgInstallation(ctx context.Context, org string) (int64, error) {
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	if err := a.do(ctx, "GET", fmt.Sprintf("orgs/%s/installation", org), &installation); err != nil {
+		return 0, fmt.Errorf("app is not installed on %s: %v", org, err)
+	}
+	return installation.ID, nil
+}
+
+// Slug returns the URL friendly name of the app. Changes the app makes are
+// sent by the user "<slug>[bot]".
+func (a *App) Slug(ctx context.Context) (string, error) {
+	a.slugMu.Lock()
+	defer a.slugMu.Unlock()
+	if a.slug != "" {
+		return a.slug, nil
+	}
+	var app struct {
+		Slug string `json:"slug"`
+	}
+	if err := a.do(ctx, "GET", "app", &app); err != nil {
+		return "", fmt.Errorf("could not look up app %d: %v", a.ID, err)
+	}
+	a.slug = app.Slug
+	return a.slug, nil
+}
+
+// do sends a request authenticated with the app JWT and decodes the response.
+func (a *App) do(ctx context.Context, method, path string, v interface{}) error {
+	jwt, err := a.JWT()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(a.BaseURL, "/")+"/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", acceptHeader)
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %d %s", method, req.URL, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Transport returns an http.RoundTripper that authenticates every request as
+// the given installation. A nil base uses http.DefaultTransport.
+func (a *App) Transport(installationID int64, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{app: a, installationID: installationID, base: base}
+}
+
+type transport struct {
+	app            *App
+	installationID int64
+	base           http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.app.Token(req.Context(), t.installationID)
+	if err != nil {
+		return nil, err
+	}
+	// RoundTrippers must not modify the request they are given
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "token "+token)
+	return t.base.RoundTrip(r)
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
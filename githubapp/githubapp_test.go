@@ -0,0 +1,225 @@
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestApp(t *testing.T) (*App, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := New(42, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, key
+}
+
+// verifyJWT checks the signature of a JWT and returns its claims.
+func verifyJWT(t *testing.T, jwt string, key *rsa.PublicKey) map[string]int64 {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT %q does not have three parts", jwt)
+	}
+	var header map[string]string
+	decodeSegment(t, parts[0], &header)
+	if header["alg"] != "RS256" || header["typ"] != "JWT" {
+		t.Errorf("JWT header is %v, want RS256 JWT", header)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		t.Errorf("JWT signature does not verify: %v", err)
+	}
+	var claims map[string]int64
+	decodeSegment(t, parts[1], &claims)
+	return claims
+}
+
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	app, key := newTestApp(t)
+	jwt, err := app.JWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := verifyJWT(t, jwt, &key.PublicKey)
+	now := time.Now().Unix()
+	if claims["iss"] != 42 {
+		t.Errorf("iss is %d, want 42", claims["iss"])
+	}
+	if iat := claims["iat"]; iat > now || iat < now-120 {
+		t.Errorf("iat is %d, want shortly before %d", iat, now)
+	}
+	// GitHub rejects tokens that are valid for more than 10 minutes
+	if exp := claims["exp"]; exp <= now || exp-claims["iat"] > 600 {
+		t.Errorf("exp is %d, want after %d and at most 10 minutes after iat %d", exp, now, claims["iat"])
+	}
+}
+
+func TestNewRejectsBadKeys(t *testing.T) {
+	for _, key := range []string{
+		"not a key",
+		"-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	} {
+		if _, err := New(42, []byte(key)); err == nil {
+			t.Errorf("New(%q) succeeded, want an error", key)
+		}
+	}
+}
+
+// tokenServer is a fake token endpoint handing out tokens that expire after
+// lifetime.
+type tokenServer struct {
+	*httptest.Server
+	requests int32
+}
+
+func newTokenServer(t *testing.T, key *rsa.PublicKey, lifetime time.Duration) *tokenServer {
+	s := &tokenServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/app/installations/7/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		verifyJWT(t, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), key)
+		n := atomic.AddInt32(&s.requests, 1)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(installationToken{
+			Token:     fmt.Sprintf("token-%d", n),
+			ExpiresAt: time.Now().Add(lifetime),
+		})
+	}))
+	return s
+}
+
+func TestTokenIsCached(t *testing.T) {
+	app, key := newTestApp(t)
+	server := newTokenServer(t, &key.PublicKey, time.Hour)
+	defer server.Close()
+	app.BaseURL = server.URL
+	for i := 0; i < 2; i++ {
+		token, err := app.Token(context.Background(), 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "token-1" {
+			t.Errorf("Token() = %q, want token-1", token)
+		}
+	}
+	if n := atomic.LoadInt32(&server.requests); n != 1 {
+		t.Errorf("%d tokens requested, want 1", n)
+	}
+}
+
+func TestTokenIsRefreshedBeforeItExpires(t *testing.T) {
+	app, key := newTestApp(t)
+	server := newTokenServer(t, &key.PublicKey, refreshBefore-time.Minute)
+	defer server.Close()
+	app.BaseURL = server.URL
+	for _, want := range []string{"token-1", "token-2"} {
+		token, err := app.Token(context.Background(), 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != want {
+			t.Errorf("Token() = %q, want %s", token, want)
+		}
+	}
+}
+
+func TestSlowInstallationDoesNotHoldUpOthers(t *testing.T) {
+	app, _ := newTestApp(t)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app/installations/8/access_tokens" {
+			<-release
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(installationToken{Token: r.URL.Path, ExpiresAt: time.Now().Add(time.Hour)})
+	}))
+	defer server.Close()
+	defer close(release)
+	app.BaseURL = server.URL
+	go app.Token(context.Background(), 8)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Give the slow request time to take its lock
+	time.Sleep(10 * time.Millisecond)
+	if _, err := app.Token(ctx, 7); err != nil {
+		t.Errorf("Token() of another installation = %v while one is slow", err)
+	}
+}
+
+func TestTokenError(t *testing.T) {
+	app, _ := newTestApp(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	app.BaseURL = server.URL
+	token, err := app.Token(context.Background(), 7)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Token() = %q, %v, want a 401 error", token, err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	app, key := newTestApp(t)
+	server := newTokenServer(t, &key.PublicKey, time.Hour)
+	defer server.Close()
+	app.BaseURL = server.URL
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer api.Close()
+	client := &http.Client{Transport: app.Transport(7, nil)}
+	req, err := http.NewRequest("GET", api.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	authorization, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(authorization) != "token token-1" {
+		t.Errorf("request was sent with Authorization %q, want token token-1", authorization)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("Transport modified the request it was given")
+	}
+}
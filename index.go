@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// cardIndex maps the content URL of issues and pull requests to their cards,
+// per project, so finding the card of an issue doesn't mean listing every
+// card of every column. A project is indexed the first time it is needed,
+// kept current from project_card webhooks and the bot's own changes, and
+// indexed again once it is older than refresh in case a webhook got lost.
+type cardIndex struct {
+	refresh time.Duration
+
+	mu       sync.Mutex
+	projects map[int]*projectCards
+	// columns maps the columns of indexed projects to their project
+	columns map[int]int
+}
+
+type projectCards struct {
+	columns []*github.ProjectColumn
+	cards   map[string]cardLocation
+	built   time.Time
+}
+
+// cardLocation is where the card of an issue or pull request is in a project.
+type cardLocation struct {
+	ColumnID int
+	CardID   int
+}
+
+func newCardIndex(refresh time.Duration) *cardIndex {
+	return &cardIndex{
+		refresh:  refresh,
+		projects: make(map[int]*projectCards),
+		columns:  make(map[int]int),
+	}
+}
+
+// indexProject makes sure a project is indexed and up to date.
+func (mon *githubMonitor) indexProject(ctx context.Context, projectID int) error {
+	idx := mon.cards
+	idx.mu.Lock()
+	p := idx.projects[projectID]
+	fresh := p != nil && time.Since(p.built) < idx.refresh
+	idx.mu.Unlock()
+	if fresh {
+		return nil
+	}
+	p = &projectCards{cards: make(map[string]cardLocation), built: time.Now()}
+	var err error
+	if p.columns, err = mon.projectColumns(ctx, projectID); err != nil {
+		return err
+	}
+	for _, column := range p.columns {
+		cards, err := mon.columnCards(ctx, *column.ID)
+		if err != nil {
+			return err
+		}
+		for _, card := range cards {
+			if card.ContentURL != nil {
+				p.cards[*card.ContentURL] = cardLocation{ColumnID: *column.ID, CardID: *card.ID}
+			}
+		}
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.projects[projectID] = p
+	for _, column := range p.columns {
+		idx.columns[*column.ID] = projectID
+	}
+	return nil
+}
+
+// find returns the card of an issue or pull request in an indexed project.
+func (idx *cardIndex) find(projectID int, contentURL string) (cardLocation, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	p := idx.projects[projectID]
+	if p == nil {
+		return cardLocation{}, false
+	}
+	loc, ok := p.cards[contentURL]
+	return loc, ok
+}
+
+// column returns the column of an indexed project by ID or, if id is 0, by
+// name.
+func (idx *cardIndex) column(projectID, id int, name string) *github.ProjectColumn {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	p := idx.projects[projectID]
+	if p == nil {
+		return nil
+	}
+	for _, column := range p.columns {
+		if (id != 0 && *column.ID == id) || (id == 0 && *column.Name == name) {
+			return column
+		}
+	}
+	return nil
+}
+
+// set records a card in a column, if the column belongs to an indexed
+// project.
+func (idx *cardIndex) set(columnID, cardID int, contentURL string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	projectID, ok := idx.columns[columnID]
+	if !ok || idx.projects[projectID] == nil {
+		return
+	}
+	idx.projects[projectID].cards[contentURL] = cardLocation{ColumnID: columnID, CardID: cardID}
+}
+
+// remove drops a card from the index.
+func (idx *cardIndex) remove(cardID int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, p := range idx.projects {
+		for url, loc := range p.cards {
+			if loc.CardID == cardID {
+				delete(p.cards, url)
+			}
+		}
+	}
+}
+
+// forget drops a project from the index so it is indexed again when needed.
+func (idx *cardIndex) forget(projectID int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.projects, projectID)
+	for columnID, id := range idx.columns {
+		if id == projectID {
+			delete(idx.columns, columnID)
+		}
+	}
+}
+
+// updateFor applies what project, project_column and project_card webhooks
+// say has changed to the index.
+func (idx *cardIndex) updateFor(event string, payload []byte) {
+	var p struct {
+		Action  string `json:"action"`
+		Project *struct {
+			ID int `json:"id"`
+		} `json:"project"`
+		ProjectColumn *struct {
+			ProjectURL string `json:"project_url"`
+		} `json:"project_column"`
+		ProjectCard *struct {
+			ID         int    `json:"id"`
+			ColumnURL  string `json:"column_url"`
+			ContentURL string `json:"content_url"`
+		} `json:"project_card"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return
+	}
+	switch {
+	case event == "project" && p.Project != nil:
+		idx.forget(p.Project.ID)
+	case event == "project_column" && p.ProjectColumn != nil:
+		if projectID, err := lastID(p.ProjectColumn.ProjectURL); err == nil {
+			idx.forget(projectID)
+		}
+	case event == "project_card" && p.ProjectCard != nil:
+		if p.Action == "deleted" {
+			idx.remove(p.ProjectCard.ID)
+			return
+		}
+		columnID, err := lastID(p.ProjectCard.ColumnURL)
+		if err != nil || p.ProjectCard.ContentURL == "" {
+			return
+		}
+		idx.set(columnID, p.ProjectCard.ID, p.ProjectCard.ContentURL)
+	}
+}
+
+// lastID pulls the ID at the end of an API URL like
+// https://api.github.com/projects/columns/367
+func lastID(apiURL string) (int, error) {
+	bits := strings.Split(apiURL, "/")
+	return strconv.Atoi(bits[len(bits)-1])
+}
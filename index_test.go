@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func indexResponses() map[string]fakeResponse {
+	return map[string]fakeResponse{
+		"GET /projects/2/columns": {body: `[{"id":21,"name":"Triage"},{"id":22,"name":"Cherry Pick"}]`},
+		"GET /projects/columns/21/cards": {body: `[
+			{"id":31,"content_url":"https://api.github.com/repos/docker/cli/issues/1"},
+			{"id":32,"note":"Just a note"}
+		]`},
+		"GET /projects/columns/22/cards": {body: `[{"id":33,"content_url":"https://api.github.com/repos/docker/cli/issues/2"}]`},
+	}
+}
+
+func TestIndexProject(t *testing.T) {
+	fake := newFakeGitHub(indexResponses())
+	defer fake.Close()
+	mon := &githubMonitor{ctx: context.Background(), client: fake.client(), cards: newCardIndex(time.Hour)}
+	for i := 0; i < 2; i++ {
+		if err := mon.indexProject(context.Background(), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The project is fresh the second time around
+	if n := len(fake.sent()); n != 3 {
+		t.Errorf("indexing made %d requests, want 3", n)
+	}
+	tests := []struct {
+		url   string
+		found bool
+		loc   cardLocation
+	}{
+		{"https://api.github.com/repos/docker/cli/issues/1", true, cardLocation{ColumnID: 21, CardID: 31}},
+		{"https://api.github.com/repos/docker/cli/issues/2", true, cardLocation{ColumnID: 22, CardID: 33}},
+		{"https://api.github.com/repos/docker/cli/issues/3", false, cardLocation{}},
+	}
+	for _, tt := range tests {
+		if loc, found := mon.cards.find(2, tt.url); found != tt.found || loc != tt.loc {
+			t.Errorf("find(2, %s) = %+v, %v, want %+v, %v", tt.url, loc, found, tt.loc, tt.found)
+		}
+	}
+	if column := mon.cards.column(2, 0, "Cherry Pick"); column == nil || *column.ID != 22 {
+		t.Errorf("column(2, 0, Cherry Pick) = %+v, want column 22", column)
+	}
+	if column := mon.cards.column(2, 21, ""); column == nil || *column.Name != "Triage" {
+		t.Errorf("column(2, 21) = %+v, want Triage", column)
+	}
+	if column := mon.cards.column(3, 21, ""); column != nil {
+		t.Errorf("column(3, 21) = %+v for a project that isn't indexed", column)
+	}
+}
+
+func TestIndexUpdateFor(t *testing.T) {
+	fake := newFakeGitHub(indexResponses())
+	defer fake.Close()
+	mon := &githubMonitor{ctx: context.Background(), client: fake.client(), cards: newCardIndex(time.Hour)}
+	if err := mon.indexProject(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	issue1 := "https://api.github.com/repos/docker/cli/issues/1"
+	issue4 := "https://api.github.com/repos/docker/cli/issues/4"
+	idx := mon.cards
+
+	idx.updateFor("project_card", []byte(`{"action":"moved","project_card":{"id":31,"column_url":"https://api.github.com/projects/columns/22","content_url":"`+issue1+`"}}`))
+	if loc, _ := idx.find(2, issue1); loc.ColumnID != 22 {
+		t.Errorf("moved card is in column %d, want 22", loc.ColumnID)
+	}
+	idx.updateFor("project_card", []byte(`{"action":"created","project_card":{"id":34,"column_url":"https://api.github.com/projects/columns/21","content_url":"`+issue4+`"}}`))
+	if loc, found := idx.find(2, issue4); !found || loc.CardID != 34 {
+		t.Errorf("created card is %+v, %v, want card 34", loc, found)
+	}
+	// Columns of projects that aren't indexed are ignored
+	idx.updateFor("project_card", []byte(`{"action":"created","project_card":{"id":35,"column_url":"https://api.github.com/projects/columns/99","content_url":"`+issue4+`"}}`))
+	if loc, _ := idx.find(2, issue4); loc.CardID != 34 {
+		t.Errorf("card of another project replaced card 34 with %d", loc.CardID)
+	}
+	idx.updateFor("project_card", []byte(`{"action":"deleted","project_card":{"id":31}}`))
+	if _, found := idx.find(2, issue1); found {
+		t.Errorf("deleted card is still indexed")
+	}
+	idx.updateFor("project_column", []byte(`{"action":"created","project_column":{"project_url":"https://api.github.com/projects/2"}}`))
+	if _, found := idx.find(2, issue4); found {
+		t.Errorf("project is still indexed after one of its columns changed")
+	}
+}
+
+func TestStaleCard(t *testing.T) {
+	tests := []struct {
+		code   int
+		forget bool
+	}{
+		{http.StatusNotFound, true},
+		{http.StatusUnprocessableEntity, true},
+		{http.StatusBadGateway, false},
+	}
+	for _, tt := range tests {
+		idx := newCardIndex(time.Hour)
+		idx.projects[2] = &projectCards{cards: make(map[string]cardLocation)}
+		mon := &githubMonitor{cards: idx}
+		if err := mon.staleCard(2, errorResponse(tt.code)); err == nil {
+			t.Errorf("staleCard(2, %d) returned no error", tt.code)
+		}
+		if forgot := idx.projects[2] == nil; forgot != tt.forget {
+			t.Errorf("staleCard(2, %d) forgot the project: %v, want %v", tt.code, forgot, tt.forget)
+		}
+	}
+}
+
+func TestLastID(t *testing.T) {
+	if id, err := lastID("https://api.github.com/projects/columns/367"); id != 367 || err != nil {
+		t.Errorf("lastID() = %d, %v, want 367", id, err)
+	}
+	if _, err := lastID("https://api.github.com/projects/columns/"); err == nil {
+		t.Errorf("lastID() of a URL without an ID succeeded")
+	}
+}
@@ -6,155 +6,339 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/gorilla/mux"
+	"github.com/seemethere/release-bot/githubapp"
+	"github.com/seemethere/release-bot/paginate"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
 )
 
 var (
 	webhookSecretEnvVariable = "RELEASE_BOT_WEBHOOK_SECRET"
 	githubTokenEnvVariable   = "RELEASE_BOT_GITHUB_TOKEN"
+	appIDEnvVariable         = "RELEASE_BOT_GITHUB_APP_ID"
+	appKeyEnvVariable        = "RELEASE_BOT_GITHUB_APP_KEY"
 	debugModeEnvVariable     = "RELEASE_BOT_DEBUG"
-	test                     = regexp.MustCompile("-(rc|tp|beta).*$")
+	adminTokenEnvVariable    = "RELEASE_BOT_ADMIN_TOKEN"
 )
 
 type githubMonitor struct {
-	ctx    context.Context
-	secret []byte
-	client *github.Client
+	ctx        context.Context
+	secret     []byte
+	adminToken []byte
+	client     *github.Client
+	clients    *clientSource
+	queue      *eventQueue
+	config     *config
+	metrics    *metrics
+	audit      *auditLog
+	// delivery is the webhook being handled, nil outside of one
+	delivery *delivery
+	// dryRun monitors only pretend to change anything
+	dryRun bool
+	// identity is who client acts as, see clientSource.login
+	identity string
+	// recorder records accepted deliveries, nil to not record them
+	recorder *deliveryRecorder
+
+	projectSetup *sync.Mutex
+	cards        *cardIndex
+	echoes       *echoLedger
 }
 
 func (mon *githubMonitor) handleGithubWebhook(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("%s Recieved webhook", r.RequestURI)
-	payload, err := github.ValidatePayload(r, mon.secret)
+	vars := mux.Vars(r)
+	owner, name := vars["user"], vars["name"]
+	// Once repositories are configured only those are served
+	settings := mon.config.repository(owner, name)
+	if settings == nil && len(mon.config.Repositories) > 0 {
+		log.Errorf("%s Repository %s/%s is not configured", r.RequestURI, owner, name)
+		http.Error(w, "Unknown repository", http.StatusNotFound)
+		return
+	}
+	payload, ok := mon.acceptPayload(w, r, settings)
+	if !ok {
+		return
+	}
+	// Don't let a secret for one repository be used to act on another
+	payloadOwner, payloadName := payloadRepository(payload)
+	if !strings.EqualFold(payloadOwner, owner) || !strings.EqualFold(payloadName, name) {
+		log.Errorf("%s Delivery is for %s/%s, not %s/%s", r.RequestURI, payloadOwner, payloadName, owner, name)
+		http.Error(w, "Repository does not match webhook URL", http.StatusBadRequest)
+		return
+	}
+	mon.enqueue(w, r, payload)
+}
+
+// handleOrgWebhook accepts deliveries of an organization wide webhook. Only
+// events about the organization's projects and the repositories tracked on
+// them are acted on.
+func (mon *githubMonitor) handleOrgWebhook(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("%s Recieved webhook", r.RequestURI)
+	org := mux.Vars(r)["org"]
+	settings := mon.config.organization(org)
+	if settings == nil {
+		log.Errorf("%s Organization %s is not configured", r.RequestURI, org)
+		http.Error(w, "Unknown organization", http.StatusNotFound)
+		return
+	}
+	payload, ok := mon.acceptPayload(w, r, &settings.repoConfig)
+	if !ok {
+		return
+	}
+	if payloadOrg := payloadOrganization(payload); !strings.EqualFold(payloadOrg, org) {
+		log.Errorf("%s Delivery is for organization %s, not %s", r.RequestURI, payloadOrg, org)
+		http.Error(w, "Organization does not match webhook URL", http.StatusBadRequest)
+		return
+	}
+	if owner, name := payloadRepository(payload); name != "" && mon.config.projectOrg(owner, name) == "" {
+		log.Debugf("%s Ignoring delivery for %s/%s which isn't tracked on organization projects", r.RequestURI, owner, name)
+		return
+	}
+	mon.enqueue(w, r, payload)
+}
+
+// acceptPayload checks the signature of a delivery and that it can be
+// parsed, writing an error response if it can't. Deliveries for disabled
+// repositories are acknowledged and dropped. Signed deliveries are recorded
+// for replay if -record-dir is set.
+func (mon *githubMonitor) acceptPayload(w http.ResponseWriter, r *http.Request, settings *repoConfig) ([]byte, bool) {
+	payload, body, err := validatePayload(r, mon.secretsFor(settings))
 	if err != nil {
 		log.Errorf("%s Failed to validate secret, %v", r.RequestURI, err)
+		mon.metrics.signatureFailures.add(1)
 		http.Error(w, "Secret did not match", http.StatusUnauthorized)
-		return
+		return nil, false
 	}
-	event, err := github.ParseWebHook(github.WebHookType(r), payload)
-	if err != nil {
+	mon.recorder.record(r, body)
+	if _, err := github.ParseWebHook(github.WebHookType(r), payload); err != nil {
 		log.Errorf("%s Failed to parse webhook, %v", r.RequestURI, err)
 		http.Error(w, "Bad webhook payload", http.StatusBadRequest)
+		return nil, false
+	}
+	if settings != nil && settings.Disabled {
+		log.Infof("%s Ignoring delivery for disabled %s", r.RequestURI, r.URL.Path)
+		return nil, false
+	}
+	return payload, true
+}
+
+// enqueue stores an accepted delivery in the queue.
+func (mon *githubMonitor) enqueue(w http.ResponseWriter, r *http.Request, payload []byte) {
+	d := &delivery{
+		ID:       github.DeliveryID(r),
+		Event:    github.WebHookType(r),
+		URI:      r.RequestURI,
+		Payload:  payload,
+		Received: time.Now(),
+	}
+	if d.ID == "" {
+		d.ID = strconv.FormatInt(d.Received.UnixNano(), 10)
+	}
+	// Only acknowledge the delivery once it is safely on disk, otherwise let
+	// GitHub know it failed so it can be redelivered.
+	if err := mon.queue.Enqueue(d); err != nil {
+		log.Errorf("%s Failed to queue delivery %s, %v", r.RequestURI, d.ID, err)
+		http.Error(w, "Could not queue delivery", http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleDelivery runs the handler for a queued delivery. Returning an error
+// makes the queue retry the delivery or move it to the dead letters.
+func (mon *githubMonitor) handleDelivery(d *delivery) (err error) {
+	defer func(started time.Time) {
+		mon.metrics.observeDelivery(d, started, err)
+	}(time.Now())
+	event, err := github.ParseWebHook(d.Event, d.Payload)
+	if err != nil {
+		return permanent(err)
+	}
+	mon.clients.cache.invalidateFor(d.Event, d.Payload)
+	mon.cards.updateFor(d.Event, d.Payload)
+	mon, err = mon.forDelivery(d)
+	if err != nil {
+		return err
+	}
+	if mon.isEcho(d) {
+		return mon.handleEcho(event, d)
+	}
 	switch e := event.(type) {
 	case *github.IssuesEvent:
+		item := issueItem(e.Repo, e.Issue)
 		switch *e.Action {
 		case "labeled":
-			go mon.handleLabelEvent(e, r)
+			if err := mon.handleLabelEvent(item, *e.Label.Name, d); err != nil {
+				return err
+			}
+			return mon.handleCherryPickLabel(item, *e.Label.Name, d)
 		case "opened":
-			go mon.handleIssueOpenedEvent(e, r)
+			return mon.handleOpenedEvent(item, d)
 		case "unlabeled":
-			go mon.handleUnlabelEvent(e, r)
+			return mon.handleUnlabelEvent(item, *e.Label.Name, d)
+		case "reopened":
+			return mon.handleReopenedEvent(item, d)
 		}
+	case *github.PullRequestEvent:
+		return mon.handlePullRequestEvent(d)
+	case *github.IssueCommentEvent:
+		return mon.handleIssueCommentEvent(e, d)
 	case *github.ProjectEvent:
 		switch *e.Action {
 		case "created":
-			go mon.handleProjectCreatedEvent(e, r)
+			return mon.handleProjectCreatedEvent(e, d)
+		case "closed":
+			return mon.handleProjectClosedEvent(e, d)
 		}
 	case *github.ProjectCardEvent:
 		switch *e.Action {
 		case "deleted":
-			go mon.handleProjectCardDeletedEvent(e, r)
+			return mon.handleProjectCardDeletedEvent(e, d)
 		case "created", "moved":
-			go mon.handleProjectCardChangedEvent(e, r)
+			return mon.handleProjectCardChangedEvent(e, d)
 		}
 	}
+	return nil
 }
 
-// Hey why is this one necessary?
-// Github decided to paginate their results which leads us to having to do
-// boilerplate code like the one below!
-// Returns all labels associated with a repo. Maybe this could be optimized
-// later by having a cache that expires?
+// Returns all labels associated with a repo. The pages come out of the
+// response cache as long as no label changed.
 func (mon *githubMonitor) allLabels(name, owner string) ([]*github.Label, error) {
 	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
 	defer cancel()
-	opt := &github.ListOptions{}
 	var labels []*github.Label
-	for {
-		labelsByPage, resp, err := mon.client.Issues.ListLabels(ctx, owner, name, opt)
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		labelsByPage, resp, err := mon.client.Issues.ListLabels(ctx, owner, name, listPage(page))
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 		labels = append(labels, labelsByPage...)
-		if resp.NextPage == 0 {
-			break
+		return resp.NextPage, nil
+	})
+	return labels, err
+}
+
+// issueLabels returns every label of an issue or pull request.
+func (mon *githubMonitor) issueLabels(ctx context.Context, owner, name string, number int) ([]*github.Label, error) {
+	var labels []*github.Label
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		labelsByPage, resp, err := mon.client.Issues.ListLabelsByIssue(ctx, owner, name, number, listPage(page))
+		if err != nil {
+			return 0, err
 		}
-		opt.Page = resp.NextPage
-	}
-	return labels, nil
+		labels = append(labels, labelsByPage...)
+		return resp.NextPage, nil
+	})
+	return labels, err
+}
+
+// projectColumns returns every column of a project, left to right.
+func (mon *githubMonitor) projectColumns(ctx context.Context, projectID int) ([]*github.ProjectColumn, error) {
+	var columns []*github.ProjectColumn
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		columnsByPage, resp, err := mon.client.Projects.ListProjectColumns(ctx, projectID, listPage(page))
+		if err != nil {
+			return 0, err
+		}
+		columns = append(columns, columnsByPage...)
+		return resp.NextPage, nil
+	})
+	return columns, err
+}
+
+// columnCards returns every card of a column, top to bottom.
+func (mon *githubMonitor) columnCards(ctx context.Context, columnID int) ([]*github.ProjectCard, error) {
+	var cards []*github.ProjectCard
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		cardsByPage, resp, err := mon.client.Projects.ListProjectCards(ctx, columnID, listPage(page))
+		if err != nil {
+			return 0, err
+		}
+		cards = append(cards, cardsByPage...)
+		return resp.NextPage, nil
+	})
+	return cards, err
 }
 
-// When a user submits an issue to docker/release-tracking we want that issue to
-// automagically have a `triage` label for all open projects.
-func (mon *githubMonitor) handleIssueOpenedEvent(e *github.IssuesEvent, r *http.Request) {
+// listPage asks for a page of as many items as GitHub hands out at once.
+func listPage(page int) *github.ListOptions {
+	return &github.ListOptions{Page: page, PerPage: paginate.PerPage}
+}
+
+// When a user submits an issue (or a pull request) to docker/release-tracking
+// we want it to automagically have a `triage` label (or whichever label the
+// workflow's on_open names) for all open projects.
+func (mon *githubMonitor) handleOpenedEvent(item *boardItem, d *delivery) error {
 	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
 	defer cancel()
-	labels, err := mon.allLabels(*e.Repo.Name, *e.Repo.Owner.Login)
+	labels, err := mon.allLabels(item.Repo, item.Owner)
 	if err != nil {
-		log.Errorf("%q", err)
-		return
+		return err
 	}
-	appliedLabelsStructs, _, err := mon.client.Issues.ListLabelsByIssue(ctx, *e.Repo.Owner.Login, *e.Repo.Name, *e.Issue.Number, nil)
-	appliedLabels := make(map[string]bool)
+	appliedLabelsStructs, err := mon.issueLabels(ctx, item.Owner, item.Repo, item.Number)
 	if err != nil {
-		log.Errorf("%q", err)
-		return
+		return err
 	}
+	appliedLabels := make(map[string]bool)
 	for _, labelStruct := range appliedLabelsStructs {
 		appliedLabels[*labelStruct.Name] = true
 	}
+	wf := mon.config.workflowFor(item.Owner, item.Repo)
+	if wf.OnOpen == "" {
+		return nil
+	}
+	grammar := mon.config.grammarFor(item.Owner, item.Repo)
 	var labelsToApply []string
 	for _, label := range labels {
-		matched, err := regexp.MatchString(".*/triage", *label.Name)
+		if !strings.HasSuffix(*label.Name, "/"+wf.OnOpen) {
+			continue
+		}
+		projectPrefix, _, err := grammar.ParseLabel(*label.Name)
 		if err != nil {
-			log.Errorf("%q", err)
-			return
+			continue
 		}
-		if matched {
-			projectPrefix, _, err := splitLabel(*label.Name)
-			if err != nil {
-				log.Errorf("%q", err)
-				return
-			}
-			// Only apply the label if there's a corresponding open project
-			if _, err := mon.getProject(projectPrefix, e); err != nil {
+		// Only apply the label if there's a corresponding open project
+		if _, err := mon.getProject(item.Owner, item.Repo, projectPrefix); err != nil {
+			if _, ok := err.(permanentError); ok {
 				continue
 			}
-			if appliedLabels[*label.Name] == false {
-				labelsToApply = append(labelsToApply, *label.Name)
+			// There is a project, which one is asked once the card is added
+			if _, ok := err.(*ambiguousProjectError); !ok {
+				return err
 			}
 		}
+		if !appliedLabels[*label.Name] {
+			labelsToApply = append(labelsToApply, *label.Name)
+		}
 	}
 	// We have labels to apply
 	if len(labelsToApply) > 0 {
-		log.Infof("%v Adding labels %v to issue #%v", r.RequestURI, labelsToApply, *e.Issue.Number)
-		_, _, err = mon.client.Issues.AddLabelsToIssue(
-			ctx,
-			*e.Repo.Owner.Login,
-			*e.Repo.Name,
-			*e.Issue.Number,
-			labelsToApply,
-		)
+		log.Infof("%v Adding labels %v to issue #%v", d.URI, labelsToApply, item.Number)
+		err = mon.addLabels(ctx, item.Owner, item.Repo, item.Number, labelsToApply)
 		if err != nil {
-			log.Errorf("%q", err)
-			return
+			return err
 		}
 	}
+	// The labeled webhooks are echoes, so the cards are added here
+	for _, label := range labelsToApply {
+		if err := mon.handleLabelEvent(item, label, d); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // When a user adds a label matching {projectPrefix}/{action} it should move the
 // issue in the corresponding open project to the correct column.
 //
-// Defined label -> column map:
+// The label -> column map comes from the repository's workflow, by default:
 //   * triage        -> Triage
 //   * cherry-pick   -> Cherry Pick
 //   * cherry-picked -> Cherry Picked
@@ -165,213 +349,226 @@ func (mon *githubMonitor) handleIssueOpenedEvent(e *github.IssuesEvent, r *http.
 //       For example a mapping of label `17.03.1-ee/bleh` should move that issue
 //       to the bleh column of the open project of 17.03.1-ee-1-rc1 if that column
 //       exists
-func (mon *githubMonitor) handleLabelEvent(e *github.IssuesEvent, r *http.Request) {
+func (mon *githubMonitor) handleLabelEvent(item *boardItem, label string, d *delivery) error {
 	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
 	defer cancel()
-	var columnID, cardID int
-	var sourceColumn, destColumn github.ProjectColumn
-	projectPrefix, labelSuffix, err := splitLabel(*e.Label.Name)
+	projectPrefix, labelSuffix, err := mon.config.grammarFor(item.Owner, item.Repo).ParseLabel(label)
 	if err != nil {
-		log.Errorf("%q", err)
-		return
+		log.Debugf("%s Ignoring label %s: %v", d.URI, label, err)
+		return nil
 	}
-	project, err := mon.getProject(projectPrefix, e)
-	if err != nil {
-		log.Errorf("%q", err)
-		return
-	}
-	columns, _, err := mon.client.Projects.ListProjectColumns(ctx, *project.ID, nil)
-	if err != nil {
-		log.Errorf("%q", err)
-		return
+	project, err := mon.projectFor(item, projectPrefix, d)
+	if err != nil || project == nil {
+		return err
 	}
-	columnName := map[string]string{
-		"triage":        "Triage",
-		"cherry-pick":   "Cherry Pick",
-		"cherry-picked": "Cherry Picked",
-	}[labelSuffix]
-	if columnName == "" {
-		columnName = labelSuffix
-	}
-	for _, column := range columns {
-		// Found our column to move into
-		if *column.Name == columnName {
-			destColumn = *column
-			columnID = *column.ID
-		}
-		cards, _, err := mon.client.Projects.ListProjectCards(ctx, *column.ID, nil)
-		if err != nil {
-			log.Errorf("%q", err)
-			return
-		}
-		for _, card := range cards {
-			if *card.ContentURL == *e.Issue.URL {
-				sourceColumn = *column
-				cardID = *card.ID
-			}
-		}
+	if err := mon.indexProject(ctx, *project.ID); err != nil {
+		return err
 	}
+	wf := mon.config.workflowFor(item.Owner, item.Repo)
+	columnName := wf.columnName(labelSuffix)
+	destColumn := mon.cards.column(*project.ID, 0, columnName)
 
 	// destination column doesn't exist
-	if destColumn == (github.ProjectColumn{}) {
+	if destColumn == nil {
 		log.Infof(
 			"%s Requested destination column '%v' does not exist for project '%v'",
+			d.URI,
 			columnName,
 			*project.Name,
 		)
-		return
+		return nil
 	}
 
 	// card does not exist
-	if cardID == 0 {
-		contentType := "Issue"
-		if e.Issue.PullRequestLinks != nil {
-			contentType = "PullRequest"
-		}
+	loc, found := mon.cards.find(*project.ID, item.URL)
+	if !found {
 		log.Infof(
 			"%s Creating card for issue #%v in project %v in column '%v'",
-			r.RequestURI,
-			*e.Issue.Number,
+			d.URI,
+			item.Number,
 			*project.Name,
 			*destColumn.Name,
 		)
-		_, _, err := mon.client.Projects.CreateProjectCard(
-			ctx,
-			columnID,
-			&github.ProjectCardOptions{
-				ContentID:   *e.Issue.ID,
-				ContentType: contentType,
-			},
-		)
+		card, _, err := mon.createCard(ctx, project, destColumn, item)
 		if err != nil {
 			log.Errorf(
 				"%s Failed creating card for issue #%v in project %v in column '%v':\n%v",
-				r.RequestURI,
-				*e.Issue.Number,
+				d.URI,
+				item.Number,
 				*project.Name,
 				*destColumn.Name,
 				err,
 			)
+			return mon.staleCard(*project.ID, err)
 		}
-	} else {
-		if *sourceColumn.ID == *destColumn.ID {
-			log.Debugf("%s Card for issue #%v is already where it needs to be", r.RequestURI, *e.Issue.Number)
-			return
+		// Pretended cards have no ID, the index is shared with real changes
+		if !mon.dryRun {
+			mon.cards.set(*destColumn.ID, *card.ID, item.URL)
 		}
-		log.Infof(
-			"%s Moving issue #%v in project %v from '%v' to '%v'",
-			r.RequestURI,
-			*e.Issue.Number,
+		// The webhook of the new card is an echo, so the labels follow here
+		return mon.syncLabels(ctx, item.Owner, item.Repo, item.Number, projectPrefix, wf, *destColumn.Name)
+	}
+	if loc.ColumnID == *destColumn.ID {
+		log.Debugf("%s Card for issue #%v is already where it needs to be", d.URI, item.Number)
+		return nil
+	}
+	sourceColumnName := "unknown column"
+	sourceColumn := mon.cards.column(*project.ID, loc.ColumnID, "")
+	if sourceColumn != nil {
+		sourceColumnName = *sourceColumn.Name
+	} else {
+		sourceColumn = &github.ProjectColumn{ID: &loc.ColumnID}
+	}
+	log.Infof(
+		"%s Moving issue #%v in project %v from '%v' to '%v'",
+		d.URI,
+		item.Number,
+		*project.Name,
+		sourceColumnName,
+		*destColumn.Name,
+	)
+	err = mon.moveCard(ctx, project, item, loc.CardID, sourceColumn, destColumn)
+	if err != nil {
+		log.Errorf(
+			"%s Move failed for issue #%v in project %v from '%v' to '%v':\n%v",
+			d.URI,
+			item.Number,
 			*project.Name,
-			*sourceColumn.Name,
+			sourceColumnName,
 			*destColumn.Name,
+			err,
 		)
-		_, err = mon.client.Projects.MoveProjectCard(
-			ctx,
-			cardID,
-			&github.ProjectCardMoveOptions{
-				Position: "top",
-				ColumnID: columnID,
-			},
-		)
+		return mon.staleCard(*project.ID, err)
+	}
+	if !mon.dryRun {
+		mon.cards.set(*destColumn.ID, loc.CardID, item.URL)
+	}
+	return mon.syncLabels(ctx, item.Owner, item.Repo, item.Number, projectPrefix, wf, *destColumn.Name)
+}
 
-		if err != nil {
-			log.Errorf(
-				"%s Move failed for issue #%v in project %v from '%v' to '%v':\n%v",
-				r.RequestURI,
-				*e.Issue.Number,
-				*project.Name,
-				*sourceColumn.Name,
-				*destColumn.Name,
-				err,
-			)
-		}
+// staleCard handles a failed change to a card. The card index may have been
+// out of date, like for a card deleted while its webhook was lost, so the
+// project is indexed again and the change retried.
+func (mon *githubMonitor) staleCard(projectID int, err error) error {
+	if e, ok := err.(*github.ErrorResponse); ok && (e.Response.StatusCode == http.StatusNotFound || e.Response.StatusCode == http.StatusUnprocessableEntity) {
+		mon.cards.forget(projectID)
+		return fmt.Errorf("card index of project %d was out of date: %v", projectID, err)
 	}
+	return err
 }
 
 // Remove the project card of an issue when the label connecting it to the project is removed
-func (mon *githubMonitor) handleUnlabelEvent(e *github.IssuesEvent, r *http.Request) {
+func (mon *githubMonitor) handleUnlabelEvent(item *boardItem, label string, d *delivery) error {
 	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
 	defer cancel()
-	var cardID int
-	projectPrefix, labelSuffix, err := splitLabel(*e.Label.Name)
+	projectPrefix, labelSuffix, err := mon.config.grammarFor(item.Owner, item.Repo).ParseLabel(label)
 	if err != nil {
-		log.Errorf("%q", err)
-		return
+		log.Debugf("%s Ignoring label %s: %v", d.URI, label, err)
+		return nil
 	}
-	project, err := mon.getProject(projectPrefix, e)
-	if err != nil {
-		log.Errorf("%q", err)
-		return
+	project, err := mon.projectFor(item, projectPrefix, d)
+	if err != nil || project == nil {
+		return err
 	}
-	columns, _, err := mon.client.Projects.ListProjectColumns(ctx, *project.ID, nil)
-	if err != nil {
-		log.Errorf("%q", err)
-		return
+	if err := mon.indexProject(ctx, *project.ID); err != nil {
+		return err
 	}
-	columnName := map[string]string{
-		"triage":        "Triage",
-		"cherry-pick":   "Cherry Pick",
-		"cherry-picked": "Cherry Picked",
-	}[labelSuffix]
-	if columnName == "" {
-		columnName = labelSuffix
+	columnName := mon.config.workflowFor(item.Owner, item.Repo).columnName(labelSuffix)
+	loc, found := mon.cards.find(*project.ID, item.URL)
+	if !found {
+		return nil
 	}
-	for _, column := range columns {
-		if *column.Name != columnName {
-			continue
-		}
-		// Found our column to move into
-		cards, _, err := mon.client.Projects.ListProjectCards(ctx, *column.ID, nil)
-		if err != nil {
-			log.Errorf("%q", err)
-			return
-		}
-		for _, card := range cards {
-			if *card.ContentURL == *e.Issue.URL {
-				cardID = *card.ID
-				_, err := mon.client.Projects.DeleteProjectCard(ctx, cardID)
-				if err != nil {
-					log.Error("%q", err)
-					return
-				}
-				return
-			}
-		}
+	// Only remove the card if it is still in the label's column
+	column := mon.cards.column(*project.ID, loc.ColumnID, "")
+	if column == nil || *column.Name != columnName {
+		return nil
+	}
+	log.Infof("%s Removing card for issue #%v from project %v", d.URI, item.Number, *project.Name)
+	if err := mon.deleteCard(ctx, project, item, loc.CardID, column); err != nil {
+		return mon.staleCard(*project.ID, err)
 	}
+	if !mon.dryRun {
+		mon.cards.remove(loc.CardID)
+	}
+	return nil
 }
 
-func (mon *githubMonitor) handleProjectCreatedEvent(e *github.ProjectEvent, r *http.Request) {
+func (mon *githubMonitor) handleProjectCreatedEvent(e *github.ProjectEvent, d *delivery) error {
 	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
 	defer cancel()
-	projectID := *e.Project.ID
-	projectName := *e.Project.Name
-	owner := *e.Repo.Owner.Login
-	name := *e.Repo.Name
-	columnsToCreate := []string{"Triage", "Cherry Pick", "Cherry Picked"}
-	for _, column := range columnsToCreate {
-		_, _, err := mon.client.Projects.CreateProjectColumn(
-			ctx,
-			projectID,
-			&github.ProjectColumnOptions{Name: column},
-		)
+	owner, name := boardOwner(e.Repo, e.Org)
+	return mon.setupProject(ctx, owner, name, *e.Project.ID, *e.Project.Name)
+}
+
+// setupProject creates the workflow columns of a release project and the
+// labels of its release.
+func (mon *githubMonitor) setupProject(ctx context.Context, owner, name string, projectID int, projectName string) error {
+	// The created webhook of a project the bot made itself may be handled at
+	// the same time
+	mon.projectSetup.Lock()
+	defer mon.projectSetup.Unlock()
+	wf := mon.config.workflowFor(owner, name)
+	existingColumns, err := mon.projectColumns(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	// A retried delivery may have already created some of the columns
+	existing := make(map[string]bool)
+	for _, column := range existingColumns {
+		existing[*column.Name] = true
+	}
+	// Columns are created in workflow order so they show up left to right
+	for _, column := range wf.Columns {
+		if existing[column.Name] {
+			continue
+		}
+		err := mon.createColumn(ctx, owner, name, projectID, projectName, column.Name)
 		if err != nil {
-			log.Errorf("Error creating column %s: %v", column, err)
-			return
+			log.Errorf("Error creating column %s: %v", column.Name, err)
+			return err
 		}
-		log.Infof("Created column %s", column)
+		log.Infof("Created column %s", column.Name)
+	}
+	mon.cards.forget(projectID)
+	release, err := mon.config.grammarFor(owner, name).Parse(projectName)
+	if err != nil {
+		log.Infof("Not creating labels for project %s: %v", projectName, err)
+		return nil
 	}
 	// Creates labels like 17.06.1-ee-1/triage from project names like 17.06.1-ee-1-rc3
-	labelsToCreate := map[string]string{
-		fmt.Sprintf("%s/triage", test.ReplaceAllString(projectName, "")):        "eeeeee",
-		fmt.Sprintf("%s/cherry-pick", test.ReplaceAllString(projectName, "")):   "a98bf3",
-		fmt.Sprintf("%s/cherry-picked", test.ReplaceAllString(projectName, "")): "bfe5bf",
+	labelsToCreate := make(map[string]string)
+	for _, column := range wf.Columns {
+		labelsToCreate[fmt.Sprintf("%s/%s", release.Prefix, column.Label)] = column.Color
+	}
+	// Organization projects track issues from several repositories, each of
+	// which needs the labels
+	var repos []string
+	if name != "" {
+		repos = []string{fmt.Sprintf("%s/%s", owner, name)}
+	} else if oc := mon.config.organization(owner); oc != nil {
+		repos = oc.Repositories
+	}
+	for _, repo := range repos {
+		bits := strings.Split(repo, "/")
+		if err := mon.createLabels(ctx, bits[0], bits[1], labelsToCreate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createLabels creates the labels, mapped to their color, that don't exist in
+// owner/name yet.
+func (mon *githubMonitor) createLabels(ctx context.Context, owner, name string, labels map[string]string) error {
+	labelsToCreate := make(map[string]string)
+	for label, color := range labels {
+		labelsToCreate[label] = color
 	}
 	// TODO: Add body for label filtering
 	existingLabels, err := mon.allLabels(name, owner)
 	if err != nil {
 		log.Errorf("Could not grab existing labels for %s/%s: %v", owner, name, err)
-		return
+		return err
 	}
 	for _, label := range existingLabels {
 		if labelsToCreate[*label.Name] != "" {
@@ -379,89 +576,116 @@ func (mon *githubMonitor) handleProjectCreatedEvent(e *github.ProjectEvent, r *h
 		}
 	}
 	for labelName, color := range labelsToCreate {
-		_, _, err = mon.client.Issues.CreateLabel(ctx, owner, name, &github.Label{Name: &labelName, Color: &color})
+		err = mon.createLabel(ctx, owner, name, labelName, color)
 		if err != nil {
 			log.Errorf("Error creating label %s for repo %s/%s: %v", labelName, owner, name, err)
-			return
+			return err
 		}
 		log.Infof("Created label %s", labelName)
 	}
+	return nil
 }
 
-func (mon *githubMonitor) handleProjectCardDeletedEvent(e *github.ProjectCardEvent, r *http.Request) {
+func (mon *githubMonitor) handleProjectCardDeletedEvent(e *github.ProjectCardEvent, d *delivery) error {
 	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
 	defer cancel()
+	if e.ProjectCard.ContentURL == nil {
+		// Notes aren't attached to an issue so there are no labels to sync
+		return nil
+	}
 	project, err := mon.getRelatedProject(ctx, e.ProjectCard)
 	if err != nil {
 		log.Errorf("Error getting project related to card: %v", err)
-		return
+		return err
 	}
-	labelPrefix := test.ReplaceAllString(*project.Name, "")
-	issueBits := strings.Split(*e.ProjectCard.ContentURL, "/")
-	issueNum, err := strconv.Atoi(issueBits[len(issueBits)-1])
+	board, boardName := boardOwner(e.Repo, e.Org)
+	release, err := mon.config.grammarFor(board, boardName).Parse(*project.Name)
 	if err != nil {
-		log.Errorf("%v", err)
-		return
+		log.Debugf("Project %s is not a release project: %v", *project.Name, err)
+		return nil
+	}
+	labelPrefix := release.Prefix
+	owner, name, issueNum, err := contentIssue(*e.ProjectCard.ContentURL)
+	if err != nil {
+		return permanent(err)
+	}
+	// Rotating deletes cards once they are on the next release candidate,
+	// whose labels are the same. This doesn't rely on recognizing the
+	// deletion as an echo, rotate may have run in another process.
+	carried, err := mon.carriedOver(ctx, board, boardName, project, release, *e.ProjectCard.ContentURL)
+	if err != nil {
+		return err
+	}
+	if carried {
+		log.Infof("%s Keeping the labels of %s/%s#%d, it is still on release %s", d.URI, owner, name, issueNum, labelPrefix)
+		return nil
 	}
 	// Creates labels like 17.06.1-ee-1/triage from project names like 17.06.1-ee-1-rc3
-	labelsToDelete := map[string]bool{
-		fmt.Sprintf("%s/triage", labelPrefix):        true,
-		fmt.Sprintf("%s/cherry-pick", labelPrefix):   true,
-		fmt.Sprintf("%s/cherry-picked", labelPrefix): true,
+	labelsToDelete := make(map[string]bool)
+	for _, label := range mon.config.workflowFor(board, boardName).labels(labelPrefix) {
+		labelsToDelete[label] = true
 	}
-	issueLabels, _, err := mon.client.Issues.ListLabelsByIssue(ctx, *e.Repo.Owner.Login, *e.Repo.Name, issueNum, nil)
+	issueLabels, err := mon.issueLabels(ctx, owner, name, issueNum)
 	if err != nil {
-		log.Errorf("Error getting labels for issue %s/%s$d", *e.Repo.Owner.Login, *e.Repo.Name, issueNum)
-		return
+		log.Errorf("Error getting labels for issue %s/%s#%d", owner, name, issueNum)
+		return err
 	}
 	for _, label := range issueLabels {
 		if labelsToDelete[*label.Name] {
-			log.Infof("Deleting label %s for issue %s/%s#%d", label, *e.Repo.Owner.Login, *e.Repo.Name, issueNum)
-			_, err = mon.client.Issues.RemoveLabelForIssue(ctx, *e.Repo.Owner.Login, *e.Repo.Name, issueNum, *label.Name)
+			log.Infof("Deleting label %s for issue %s/%s#%d", *label.Name, owner, name, issueNum)
+			resp, err := mon.removeLabel(ctx, owner, name, issueNum, *label.Name)
+			if resp != nil && resp.StatusCode == 404 {
+				continue
+			}
 			if err != nil {
-				log.Errorf("Error deleting label %s for issue %s/%s/#%d", *label.Name, *e.Repo.Owner.Login, *e.Repo.Name, *label.Name)
+				log.Errorf("Error deleting label %s for issue %s/%s#%d", *label.Name, owner, name, issueNum)
+				return err
 			}
 		}
-
 	}
+	return nil
 }
 
-func (mon *githubMonitor) handleProjectCardChangedEvent(e *github.ProjectCardEvent, r *http.Request) {
+func (mon *githubMonitor) handleProjectCardChangedEvent(e *github.ProjectCardEvent, d *delivery) error {
 	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
 	defer cancel()
+	if e.ProjectCard.ContentURL == nil {
+		// Notes aren't attached to an issue so there are no labels to sync
+		return nil
+	}
 	column, err := mon.getRelatedColumn(ctx, e.ProjectCard)
 	if err != nil {
 		log.Errorf("Error getting column related to card %s", *e.ProjectCard.URL)
-		return
+		return err
 	}
 	project, err := mon.getRelatedProject(ctx, e.ProjectCard)
 	if err != nil {
 		log.Errorf("Error getting project related to card %s", *e.ProjectCard.URL)
-		return
+		return err
 	}
-	labelPrefix := test.ReplaceAllString(*project.Name, "")
-	labelsToDelete := []string{
-		fmt.Sprintf("%s/triage", labelPrefix),
-		fmt.Sprintf("%s/cherry-pick", labelPrefix),
-		fmt.Sprintf("%s/cherry-picked", labelPrefix),
-	}
-	columnName := map[string]string{
-		"Triage":        "triage",
-		"Cherry Pick":   "cherry-pick",
-		"Cherry Picked": "cherry-picked",
-	}[*column.Name]
-	issueBits := strings.Split(*e.ProjectCard.ContentURL, "/")
-	issueNum, err := strconv.Atoi(issueBits[len(issueBits)-1])
-	if err != nil {
-		log.Errorf("%v", err)
-		return
+	release, err := mon.config.grammarFor(boardOwner(e.Repo, e.Org)).Parse(*project.Name)
+	if err != nil {
+		log.Debugf("Project %s is not a release project: %v", *project.Name, err)
+		return nil
 	}
-	appliedLabelsStructs, _, err := mon.client.Issues.ListLabelsByIssue(ctx, *e.Repo.Owner.Login, *e.Repo.Name, issueNum, nil)
-	appliedLabels := make(map[string]bool)
+	wf := mon.config.workflowFor(boardOwner(e.Repo, e.Org))
+	owner, name, issueNum, err := contentIssue(*e.ProjectCard.ContentURL)
 	if err != nil {
-		log.Errorf("%q", err)
-		return
+		return permanent(err)
 	}
+	return mon.syncLabels(ctx, owner, name, issueNum, release.Prefix, wf, *column.Name)
+}
+
+// syncLabels makes the release labels of an issue match the column its card
+// is in: the label of the column is added and those of other columns removed.
+func (mon *githubMonitor) syncLabels(ctx context.Context, owner, name string, issueNum int, labelPrefix string, wf *workflow, column string) error {
+	labelsToDelete := wf.labels(labelPrefix)
+	columnName, _ := wf.labelSuffix(column)
+	appliedLabelsStructs, err := mon.issueLabels(ctx, owner, name, issueNum)
+	if err != nil {
+		return err
+	}
+	appliedLabels := make(map[string]bool)
 	for _, labelStruct := range appliedLabelsStructs {
 		appliedLabels[*labelStruct.Name] = true
 	}
@@ -469,25 +693,29 @@ func (mon *githubMonitor) handleProjectCardChangedEvent(e *github.ProjectCardEve
 		// Only remove labels that don't relate to our column name
 		if label == fmt.Sprintf("%s/%s", labelPrefix, columnName) {
 			if !appliedLabels[label] {
-				_, _, err := mon.client.Issues.AddLabelsToIssue(ctx, *e.Repo.Owner.Login, *e.Repo.Name, issueNum, []string{label})
+				err := mon.addLabels(ctx, owner, name, issueNum, []string{label})
 				if err != nil {
-					log.Errorf("Error applying label %s from %s/%s#%d: %v", label, *e.Repo.Owner.Login, *e.Repo.Name, issueNum, err)
+					log.Errorf("Error applying label %s from %s/%s#%d: %v", label, owner, name, issueNum, err)
+					return err
 				}
-				log.Infof("Added label %s to %s/%s#%d", label, *e.Repo.Owner.Login, *e.Repo.Name, issueNum)
+				log.Infof("Added label %s to %s/%s#%d", label, owner, name, issueNum)
 			}
 		} else {
 			if appliedLabels[label] {
-				resp, err := mon.client.Issues.RemoveLabelForIssue(ctx, *e.Repo.Owner.Login, *e.Repo.Name, issueNum, label)
+				resp, err := mon.removeLabel(ctx, owner, name, issueNum, label)
 				// Most errors occur when label does not exist
-				if resp.StatusCode == 404 && err != nil {
-					log.Debugf("Label %s for %s/%s#%d not found moving on...", label, *e.Repo.Owner.Login, *e.Repo.Name, issueNum)
+				if resp != nil && resp.StatusCode == 404 && err != nil {
+					log.Debugf("Label %s for %s/%s#%d not found moving on...", label, owner, name, issueNum)
+					continue
 				} else if err != nil {
-					log.Errorf("Error removing label %s from %s/%s#%d: %v", label, *e.Repo.Owner.Login, *e.Repo.Name, issueNum, err)
+					log.Errorf("Error removing label %s from %s/%s#%d: %v", label, owner, name, issueNum, err)
+					return err
 				}
-				log.Infof("Removed label %s from %s/%s#%d", label, *e.Repo.Owner.Login, *e.Repo.Name, issueNum)
+				log.Infof("Removed label %s from %s/%s#%d", label, owner, name, issueNum)
 			}
 		}
 	}
+	return nil
 }
 
 func (mon *githubMonitor) getRelatedColumn(ctx context.Context, card *github.ProjectCard) (*github.ProjectColumn, error) {
@@ -520,6 +748,61 @@ func (mon *githubMonitor) getRelatedProject(ctx context.Context, card *github.Pr
 	return project, nil
 }
 
+// boardItem is an issue or pull request that can have a card on a release
+// board.
+type boardItem struct {
+	Owner  string
+	Repo   string
+	Number int
+	// URL is the API URL of the issue, which is what cards point at
+	URL string
+	// ContentID and ContentType are what cards for the item are created with
+	ContentID   int
+	ContentType string
+}
+
+func issueItem(repo *github.Repository, issue *github.Issue) *boardItem {
+	item := &boardItem{
+		Owner:       *repo.Owner.Login,
+		Repo:        *repo.Name,
+		Number:      *issue.Number,
+		URL:         *issue.URL,
+		ContentID:   *issue.ID,
+		ContentType: "Issue",
+	}
+	if issue.PullRequestLinks != nil {
+		item.ContentType = "PullRequest"
+	}
+	return item
+}
+
+// contentIssue pulls the repository and issue number out of a card's content
+// URL such as https://api.github.com/repos/docker/release-tracking/issues/42
+func contentIssue(contentURL string) (string, string, int, error) {
+	issueBits := strings.Split(contentURL, "/")
+	if len(issueBits) < 4 {
+		return "", "", 0, fmt.Errorf("%s is not an issue URL", contentURL)
+	}
+	number, err := strconv.Atoi(issueBits[len(issueBits)-1])
+	if err != nil {
+		return "", "", 0, err
+	}
+	return issueBits[len(issueBits)-4], issueBits[len(issueBits)-3], number, nil
+}
+
+// boardOwner returns who a project belongs to from the repository and
+// organization of a project webhook. Organization projects have no
+// repository, in which case name is empty.
+func boardOwner(repo *github.Repository, org *github.Organization) (string, string) {
+	if repo != nil {
+		return *repo.Owner.Login, *repo.Name
+	}
+	if org != nil && org.Login != nil {
+		return *org.Login, ""
+	}
+	return "", ""
+}
+
 func splitLabel(label string) (string, string, error) {
 	splitResults := strings.Split(label, "/")
 	if len(splitResults) != 2 {
@@ -528,46 +811,231 @@ func splitLabel(label string) (string, string, error) {
 	return splitResults[0], splitResults[1], nil
 }
 
-func (mon *githubMonitor) getProject(projectPrefix string, e *github.IssuesEvent) (*github.Project, error) {
+// openProjects lists the open projects of the board issues of owner/name are
+// tracked on, which are the organization's if the repository is tracked on
+// organization projects.
+func (mon *githubMonitor) openProjects(ctx context.Context, owner, name string) ([]*github.Project, error) {
+	if org := mon.config.projectOrg(owner, name); org != "" {
+		return mon.listProjects(ctx, org, "", "open")
+	}
+	return mon.listProjects(ctx, owner, name, "open")
+}
+
+// listProjects lists the projects of a repository, or of an organization if
+// name is empty, in the given state.
+func (mon *githubMonitor) listProjects(ctx context.Context, owner, name, state string) ([]*github.Project, error) {
+	var projects []*github.Project
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		opt := &github.ProjectListOptions{State: state, ListOptions: *listPage(page)}
+		var projectsByPage []*github.Project
+		var resp *github.Response
+		var err error
+		if name == "" {
+			projectsByPage, resp, err = mon.client.Organizations.ListProjects(ctx, owner, opt)
+		} else {
+			projectsByPage, resp, err = mon.client.Repositories.ListProjects(ctx, owner, name, opt)
+		}
+		if err != nil {
+			return 0, err
+		}
+		projects = append(projects, projectsByPage...)
+		return resp.NextPage, nil
+	})
+	return projects, err
+}
+
+// getProject returns the open project labels with projectPrefix go with.
+func (mon *githubMonitor) getProject(owner, name, projectPrefix string) (*github.Project, error) {
 	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
 	defer cancel()
-	projects, _, err := mon.client.Repositories.ListProjects(
-		ctx,
-		*e.Repo.Owner.Login,
-		*e.Repo.Name,
-		&github.ProjectListOptions{State: "open"},
-	)
+	projects, err := mon.openProjects(ctx, owner, name)
 	if err != nil {
 		return nil, err
 	}
+	return releaseProject(projects, mon.config.grammarFor(owner, name), projectPrefix)
+}
+
+// ambiguousProjectError is returned when several open projects could be the
+// one of a release and there is no telling which.
+type ambiguousProjectError struct {
+	Prefix   string
+	Projects []string
+}
+
+func (e *ambiguousProjectError) Error() string {
+	return fmt.Sprintf("projects %s are all open for %s", strings.Join(e.Projects, ", "), e.Prefix)
+}
+
+// releaseProject picks the project of a release among open projects: the one
+// whose release has projectPrefix as its label prefix, or the newest
+// pre-release if there are several, like 17.06.1-ee-1-rc3 over
+// 17.06.1-ee-1-rc2.
+func releaseProject(projects []*github.Project, grammar *releaseGrammar, projectPrefix string) (*github.Project, error) {
+	var candidates []*github.Project
+	var releases []*Release
 	for _, project := range projects {
-		if strings.HasPrefix(*project.Name, projectPrefix) {
-			return project, nil
+		release, err := grammar.Parse(*project.Name)
+		if err == nil && release.Prefix == projectPrefix {
+			candidates = append(candidates, project)
+			releases = append(releases, release)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, permanent(fmt.Errorf("No project found with prefix %s", projectPrefix))
+	}
+	newest := 0
+	for i := range releases {
+		if order, ok := compareStages(releases[i].Stage, releases[newest].Stage); ok && order > 0 {
+			newest = i
+		}
+	}
+	// Every other candidate has to be older than the newest one
+	for i := range releases {
+		if order, ok := compareStages(releases[i].Stage, releases[newest].Stage); i != newest && (!ok || order > 0) {
+			e := &ambiguousProjectError{Prefix: projectPrefix}
+			for _, project := range candidates {
+				e.Projects = append(e.Projects, *project.Name)
+			}
+			return nil, e
 		}
 	}
-	return nil, fmt.Errorf("No project found with prefix %s", projectPrefix)
+	return candidates[newest], nil
+}
+
+// projectFor returns the project of a release label of an item. When it can't
+// be told which project is meant the item is told in a comment, and neither a
+// project nor an error is returned so the label is left alone.
+func (mon *githubMonitor) projectFor(item *boardItem, projectPrefix string, d *delivery) (*github.Project, error) {
+	project, err := mon.getProject(item.Owner, item.Repo, projectPrefix)
+	e, ok := err.(*ambiguousProjectError)
+	if !ok {
+		return project, err
+	}
+	log.Warnf("%s Not acting on %s labels of #%d: %v", d.URI, projectPrefix, item.Number, err)
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	return nil, mon.comment(ctx, item, fmt.Sprintf(
+		"Could not tell which project the %s labels are for, %s are all open. "+
+			"Close the projects that are done and label this again.",
+		projectPrefix, strings.Join(e.Projects, ", "),
+	))
 }
 
 func main() {
 	debug := flag.Bool("debug", false, "Toggle debug mode")
 	port := flag.String("port", "8080", "Port to bind release-bot to")
+	queueDir := flag.String("queue-dir", "queue", "Directory to persist queued webhook deliveries in")
+	workers := flag.Int("workers", 4, "Number of workers processing queued deliveries")
+	maxAttempts := flag.Int("max-attempts", 10, "Attempts before a failing delivery is moved to the dead letters")
+	configFile := flag.String("config", "", "Path to a JSON file with workflow and repository settings")
+	githubURL := flag.String("github-url", "", "Base URL of the GitHub API, defaults to https://api.github.com/")
+	echoWindow := flag.Duration("echo-window", 5*time.Minute, "How long webhooks about the bot's own changes are recognized and skipped, 0 to handle them like any other")
+	indexRefresh := flag.Duration("index-refresh", 15*time.Minute, "How often the card index of a project is rebuilt from scratch")
+	cacheTTL := flag.Duration("cache-ttl", time.Minute, "How long GitHub responses are used before they are revalidated, 0 to always revalidate")
+	auditLogFile := flag.String("audit-log", "audit.jsonl", "File to append a JSON line to for every change made to labels and projects, empty to turn off")
+	dryRun := flag.Bool("dry-run", false, "Handle deliveries without changing anything on GitHub, logging what would have been done")
+	reconcileInterval := flag.Duration("reconcile-interval", 0, "How often to fix drift between release labels and the project boards in -config, 0 to only reconcile on demand")
+	recordDir := flag.String("record-dir", "", "Directory to record every signed webhook delivery to, for release-bot replay")
+	serveNotes := flag.Bool("notes", false, "Serve release notes at /notes/{owner}/{name}/{project} and /notes/{org}/{project} to holders of the admin token")
 	flag.Parse()
 	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: os.Getenv(githubTokenEnvVariable)},
-	)
-	client := github.NewClient(oauth2.NewClient(ctx, ts))
+	// Run as a GitHub App when an app is configured, otherwise fall back to
+	// the personal access token
+	var app *githubapp.App
+	if appID := os.Getenv(appIDEnvVariable); appID != "" {
+		id, err := strconv.ParseInt(appID, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", appIDEnvVariable, err)
+		}
+		app, err = githubapp.NewFromFile(id, os.Getenv(appKeyEnvVariable))
+		if err != nil {
+			log.Fatalf("Could not load GitHub App private key: %v", err)
+		}
+		log.Infof("Running as GitHub App %d", id)
+	}
+	stats := newMetrics()
+	clients, err := newClientSource(ctx, *githubURL, os.Getenv(githubTokenEnvVariable), app, *cacheTTL, stats)
+	if err != nil {
+		log.Fatalf("Invalid GitHub URL %s: %v", *githubURL, err)
+	}
+	client := clients.forToken(clients.token, *dryRun)
 	if *debug || os.Getenv(debugModeEnvVariable) != "" {
 		log.SetLevel(log.DebugLevel)
 		log.Debug("Log level set to debug")
 	}
-	monitor := githubMonitor{
-		ctx:    ctx,
-		secret: []byte(os.Getenv(webhookSecretEnvVariable)),
-		client: client,
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Could not load config: %v", err)
+	}
+	audit, err := openAuditLog(*auditLogFile)
+	if err != nil {
+		log.Fatalf("Could not open audit log: %v", err)
+	}
+	monitor := &githubMonitor{
+		ctx:        ctx,
+		secret:     []byte(os.Getenv(webhookSecretEnvVariable)),
+		adminToken: []byte(os.Getenv(adminTokenEnvVariable)),
+		client:     client,
+		clients:    clients,
+		config:     cfg,
+		metrics:    stats,
+		audit:      audit,
+		dryRun:     *dryRun,
+
+		projectSetup: &sync.Mutex{},
+		cards:        newCardIndex(*indexRefresh),
+		echoes:       newEchoLedger(*echoWindow),
+	}
+	if flag.NArg() > 0 {
+		if err := runSubcommand(monitor, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Deliveries signed with an empty secret are signed by anyone
+	if len(monitor.secret) == 0 {
+		log.Fatalf("%s is not set", webhookSecretEnvVariable)
+	}
+	if err := monitor.resolveLogins(); err != nil {
+		log.Fatalf("Could not look up who release-bot acts as: %v", err)
+	}
+	if *reconcileInterval > 0 && len(monitor.config.boards()) == 0 {
+		log.Fatalf("Could not reconcile every %s: %v", *reconcileInterval, errNoBoards)
+	}
+	queue, err := newEventQueue(*queueDir, *maxAttempts, monitor.handleDelivery)
+	if err != nil {
+		log.Fatalf("Could not open queue in %s: %v", *queueDir, err)
+	}
+	monitor.queue = queue
+	stats.depth = queue.Depth
+	queue.Start(*workers)
+	if *reconcileInterval > 0 {
+		go monitor.reconcileEvery(*reconcileInterval)
 	}
 	router := mux.NewRouter()
-	router.Handle("/{user:.*}/{name:.*}", http.HandlerFunc(monitor.handleGithubWebhook)).Methods("POST")
+	router.Handle("/metrics", stats).Methods("GET")
+	if len(monitor.adminToken) > 0 {
+		router.Handle("/audit", http.HandlerFunc(monitor.handleAudit)).Methods("GET")
+		router.Handle("/revert", http.HandlerFunc(monitor.handleRevert)).Methods("POST")
+		router.Handle("/reconcile", http.HandlerFunc(monitor.handleReconcile)).Methods("POST")
+	}
+	if *serveNotes {
+		router.Handle("/notes/{owner}/{project}", http.HandlerFunc(monitor.handleNotes)).Methods("GET")
+		router.Handle("/notes/{owner}/{name}/{project}", http.HandlerFunc(monitor.handleNotes)).Methods("GET")
+	}
+	monitor.webhookRoutes(router)
+	if *recordDir != "" {
+		if monitor.recorder, err = newDeliveryRecorder(*recordDir); err != nil {
+			log.Fatalf("Could not record deliveries to %s: %v", *recordDir, err)
+		}
+	}
 	log.Infof("Starting release-bot on port %s", *port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", *port), router))
 }
+
+// webhookRoutes routes webhooks of organizations and repositories. They come
+// last since they match any path.
+func (mon *githubMonitor) webhookRoutes(router *mux.Router) {
+	router.Handle("/{org:[^/]+}", http.HandlerFunc(mon.handleOrgWebhook)).Methods("POST")
+	router.Handle("/{user:.*}/{name:.*}", http.HandlerFunc(mon.handleGithubWebhook)).Methods("POST")
+}
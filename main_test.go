@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestReleaseProject(t *testing.T) {
+	tests := []struct {
+		projects []string
+		prefix   string
+		want     string
+		// ambiguous is whether no project can be picked among several
+		ambiguous bool
+	}{
+		{[]string{"17.06.1-ee-1-rc2", "17.07.0-ce-rc1"}, "17.06.1-ee-1", "17.06.1-ee-1-rc2", false},
+		{[]string{"17.06.1-ee-1-rc2", "17.06.1-ee-1-rc10", "17.06.1-ee-1-rc3"}, "17.06.1-ee-1", "17.06.1-ee-1-rc10", false},
+		{[]string{"17.06.1-ee-1-rc1", "17.06.1-ee-1-beta3", "17.06.1-ee-1-tp5"}, "17.06.1-ee-1", "17.06.1-ee-1-rc1", false},
+		{[]string{"17.06.1-ee-1-rc4", "17.06.1-ee-1"}, "17.06.1-ee-1", "17.06.1-ee-1", false},
+		// Prefixes are matched exactly, not as the start of a name
+		{[]string{"17.06.1-ee-10-rc1", "17.06.1-ee-1-rc1"}, "17.06.1-ee-1", "17.06.1-ee-1-rc1", false},
+		{[]string{"17.06.1-ee-10-rc1", "Backlog"}, "17.06.1-ee-1", "", false},
+		{nil, "17.06.1-ee-1", "", false},
+		{[]string{"17.06.1-ee-1-rc2", "17.06.1-ee-1-rc2"}, "17.06.1-ee-1", "", true},
+		{[]string{"17.06.1-ee-1-rc", "17.06.1-ee-1-rc0"}, "17.06.1-ee-1", "", true},
+	}
+	grammar, err := newReleaseGrammar("docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var projects []*github.Project
+		for i := range tt.projects {
+			projects = append(projects, &github.Project{Name: &tt.projects[i]})
+		}
+		project, err := releaseProject(projects, grammar, tt.prefix)
+		if tt.want != "" {
+			if err != nil || project.GetName() != tt.want {
+				t.Errorf("releaseProject(%v, %q) = %v, %v, want %s", tt.projects, tt.prefix, project.GetName(), err, tt.want)
+			}
+			continue
+		}
+		if _, ok := err.(*ambiguousProjectError); ok != tt.ambiguous || project != nil {
+			t.Errorf("releaseProject(%v, %q) = %v, %v, want no project, ambiguous %v", tt.projects, tt.prefix, project.GetName(), err, tt.ambiguous)
+		}
+		if _, ok := err.(permanentError); !tt.ambiguous && !ok {
+			t.Errorf("releaseProject(%v, %q) = %v, want a permanent error", tt.projects, tt.prefix, err)
+		}
+	}
+}
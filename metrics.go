@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are served at /metrics in the Prometheus text format. There is no
+// Prometheus client library vendored, and counters, gauges and a histogram
+// are all the bot needs.
+type metrics struct {
+	deliveries        *metricVec
+	signatureFailures *metricVec
+	handlerDuration   *histogramVec
+	githubRequests    *metricVec
+	rateLimit         *metricVec
+	queueDepth        *metricVec
+	cardsMoved        *metricVec
+	echoes            *metricVec
+
+	// depth reports the queue depth when scraped, nil before the queue runs
+	depth func() int
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		deliveries: newMetricVec("release_bot_webhook_deliveries_total", "counter",
+			"Webhook deliveries handled by event, action and result.", "event", "action", "result"),
+		signatureFailures: newMetricVec("release_bot_webhook_signature_failures_total", "counter",
+			"Webhook deliveries rejected for a bad signature."),
+		handlerDuration: newHistogramVec("release_bot_handler_duration_seconds",
+			"Time spent handling a webhook delivery by event and action.",
+			[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}, "event", "action"),
+		githubRequests: newMetricVec("release_bot_github_requests_total", "counter",
+			"Requests made to the GitHub API by method, endpoint and status.", "method", "endpoint", "status"),
+		rateLimit: newMetricVec("release_bot_github_rate_limit_remaining", "gauge",
+			"Remaining GitHub API rate limit last reported, by resource and credential.", "resource", "credential"),
+		queueDepth: newMetricVec("release_bot_queue_depth", "gauge",
+			"Deliveries waiting to be processed or retried."),
+		cardsMoved: newMetricVec("release_bot_cards_moved_total", "counter",
+			"Project cards created or moved by the bot, by project.", "project"),
+		echoes: newMetricVec("release_bot_echoes_skipped_total", "counter",
+			"Deliveries about the bot's own changes that were skipped, by event.", "event"),
+	}
+	// Alerts on an increase need a sample to start from
+	m.signatureFailures.add(0)
+	return m
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.depth != nil {
+		m.queueDepth.set(float64(m.depth()))
+	}
+	var buf bytes.Buffer
+	m.deliveries.write(&buf)
+	m.signatureFailures.write(&buf)
+	m.handlerDuration.write(&buf)
+	m.githubRequests.write(&buf)
+	m.rateLimit.write(&buf)
+	m.queueDepth.write(&buf)
+	m.cardsMoved.write(&buf)
+	m.echoes.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// metricVec is a counter or gauge with a value per combination of labels.
+type metricVec struct {
+	name, kind, help string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, kind: kind, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// add increases the value for the label values, in the order of the labels.
+func (v *metricVec) add(n float64, values ...string) {
+	key := labelPairs(v.labels, values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] += n
+}
+
+func (v *metricVec) set(n float64, values ...string) {
+	key := labelPairs(v.labels, values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] = n
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, key, formatValue(v.values[key]))
+	}
+}
+
+// histogramVec is a histogram with a set of buckets per combination of
+// labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	// values holds the label values so bucket labels can be added to them
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, histograms: make(map[string]*histogram)}
+}
+
+func (v *histogramVec) observe(seconds float64, values ...string) {
+	key := labelPairs(v.labels, values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h := v.histograms[key]
+	if h == nil {
+		h = &histogram{values: values, counts: make([]uint64, len(v.buckets))}
+		v.histograms[key] = h
+	}
+	for i, bound := range v.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (v *histogramVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.histograms))
+	for key := range v.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string(nil), v.labels...), "le")
+	for _, key := range keys {
+		h := v.histograms[key]
+		values := append(append([]string(nil), h.values...), "")
+		for i, bound := range v.buckets {
+			values[len(values)-1] = formatValue(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelPairs(labels, values), h.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelPairs(labels, values), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, key, formatValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, key, h.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats label values as {name="value",...}, which doubles as
+// the key of the value.
+func labelPairs(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, labelEscaper.Replace(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Transport wraps base so the requests it makes to the GitHub API at
+// basePath, and the rate limit they report, are counted.
+func (m *metrics) Transport(basePath string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &metricsTransport{metrics: m, basePath: basePath, base: base}
+}
+
+type metricsTransport struct {
+	metrics  *metrics
+	basePath string
+	base     http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := apiEndpoint(strings.TrimPrefix(req.URL.Path, t.basePath))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.metrics.githubRequests.add(1, req.Method, endpoint, "error")
+		return nil, err
+	}
+	t.metrics.githubRequests.add(1, req.Method, endpoint, strconv.Itoa(resp.StatusCode))
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		resource := resp.Header.Get("X-RateLimit-Resource")
+		if resource == "" {
+			resource = "core"
+		}
+		t.metrics.rateLimit.set(float64(remaining), resource, requestCredential(req))
+	}
+	return resp, nil
+}
+
+// credentialKey is the context key of who a request is made as, so that the
+// quotas of the app and of each installation and token are told apart.
+type credentialKey struct{}
+
+// withCredential marks the requests made through base as made as credential.
+// It goes between the authenticating transport and the shared one counting
+// requests.
+func withCredential(credential string, base http.RoundTripper) http.RoundTripper {
+	return &credentialTransport{credential: credential, base: base}
+}
+
+type credentialTransport struct {
+	credential string
+	base       http.RoundTripper
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(context.WithValue(req.Context(), credentialKey{}, t.credential)))
+}
+
+func requestCredential(req *http.Request) string {
+	if credential, ok := req.Context().Value(credentialKey{}).(string); ok {
+		return credential
+	}
+	return "unknown"
+}
+
+// apiEndpoint turns an API path into the endpoint it calls by replacing
+// owners, names, numbers and refs with placeholders, so
+// repos/docker/cli/issues/42/labels becomes
+// repos/:owner/:repo/issues/:number/labels.
+func apiEndpoint(path string) string {
+	bits := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case bits[0] == "repos" && len(bits) >= 3:
+		bits[1], bits[2] = ":owner", ":repo"
+	case (bits[0] == "orgs" || bits[0] == "users") && len(bits) >= 2:
+		bits[1] = ":" + strings.TrimSuffix(bits[0], "s")
+	}
+	for i := 1; i < len(bits); i++ {
+		if _, err := strconv.Atoi(bits[i]); err == nil {
+			bits[i] = ":number"
+			continue
+		}
+		switch bits[i-1] {
+		case "labels", "collaborators":
+			bits[i] = ":name"
+		case "commits", "trees", "blobs":
+			bits[i] = ":sha"
+		case "refs", "branches":
+			// Refs and branches may contain slashes themselves
+			return strings.Join(append(bits[:i], ":ref"), "/")
+		}
+	}
+	return strings.Join(bits, "/")
+}
+
+// observeDelivery records how handling a delivery went.
+func (m *metrics) observeDelivery(d *delivery, started time.Time, err error) {
+	event, action := d.Event, payloadAction(d.Payload)
+	result := "success"
+	if err != nil {
+		result = "error"
+		if !isTransient(err) {
+			result = "failed"
+		}
+	}
+	m.deliveries.add(1, event, action, result)
+	m.handlerDuration.observe(time.Since(started).Seconds(), event, action)
+}
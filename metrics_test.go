@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIEndpoint(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"repos/docker/cli/issues/42/labels", "repos/:owner/:repo/issues/:number/labels"},
+		{"/repos/docker/cli/labels/triage", "repos/:owner/:repo/labels/:name"},
+		{"repos/docker/cli/git/refs/heads/17.06", "repos/:owner/:repo/git/refs/:ref"},
+		{"repos/docker/cli/commits/abc123/pulls", "repos/:owner/:repo/commits/:sha/pulls"},
+		{"orgs/docker/projects", "orgs/:org/projects"},
+		{"projects/columns/cards/3/moves", "projects/columns/cards/:number/moves"},
+		{"rate_limit", "rate_limit"},
+	}
+	for _, tt := range tests {
+		if got := apiEndpoint(tt.path); got != tt.want {
+			t.Errorf("apiEndpoint(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+// scrape returns what /metrics serves.
+func scrape(m *metrics) string {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := newMetrics()
+	m.depth = func() int { return 3 }
+	d := &delivery{Event: "issues", Payload: []byte(`{"action":"labeled"}`)}
+	m.observeDelivery(d, time.Now().Add(-2*time.Second), nil)
+	m.observeDelivery(d, time.Now(), errors.New("connection reset by peer"))
+	m.observeDelivery(d, time.Now(), permanent(errors.New("bad payload")))
+	m.cardsMoved.add(1, `17.06 "ee"`)
+	got := scrape(m)
+	for _, want := range []string{
+		"# TYPE release_bot_webhook_deliveries_total counter\n",
+		`release_bot_webhook_deliveries_total{event="issues",action="labeled",result="success"} 1` + "\n",
+		`release_bot_webhook_deliveries_total{event="issues",action="labeled",result="error"} 1` + "\n",
+		`release_bot_webhook_deliveries_total{event="issues",action="labeled",result="failed"} 1` + "\n",
+		"release_bot_webhook_signature_failures_total 0\n",
+		"# TYPE release_bot_handler_duration_seconds histogram\n",
+		`release_bot_handler_duration_seconds_bucket{event="issues",action="labeled",le="1"} 2` + "\n",
+		`release_bot_handler_duration_seconds_bucket{event="issues",action="labeled",le="2.5"} 3` + "\n",
+		`release_bot_handler_duration_seconds_bucket{event="issues",action="labeled",le="+Inf"} 3` + "\n",
+		`release_bot_handler_duration_seconds_count{event="issues",action="labeled"} 3` + "\n",
+		"release_bot_queue_depth 3\n",
+		`release_bot_cards_moved_total{project="17.06 \"ee\""} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remaining := "4321"
+		if r.Header.Get("Authorization") == "token other" {
+			remaining = "12"
+		}
+		w.Header().Set("X-RateLimit-Remaining", remaining)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	m := newMetrics()
+	base := m.Transport("/", nil)
+	get := func(transport http.RoundTripper, authorization string) {
+		req, _ := http.NewRequest("GET", server.URL+"/repos/docker/cli/issues/42", nil)
+		req.Header.Set("Authorization", authorization)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	get(base, "")
+	// Every installation has a quota of its own
+	get(withCredential("installation:1", base), "token one")
+	get(withCredential("installation:2", base), "token other")
+	got := scrape(m)
+	for _, want := range []string{
+		`release_bot_github_requests_total{method="GET",endpoint="repos/:owner/:repo/issues/:number",status="404"} 3` + "\n",
+		`release_bot_github_rate_limit_remaining{resource="core",credential="unknown"} 4321` + "\n",
+		`release_bot_github_rate_limit_remaining{resource="core",credential="installation:1"} 4321` + "\n",
+		`release_bot_github_rate_limit_remaining{resource="core",credential="installation:2"} 12` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestCredentialName(t *testing.T) {
+	if got := credentialName(installationIdentity(7)); got != "installation:7" {
+		t.Errorf("credentialName(installation 7) = %q, want installation:7", got)
+	}
+	got := credentialName(tokenIdentity("secret"))
+	if strings.Contains(got, "secret") || !strings.HasPrefix(got, "token:") || got == credentialName(tokenIdentity("other")) {
+		t.Errorf("credentialName(token) = %q, want a hash of the token", got)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// releaseNotes are the issues and pull requests of a column of a release
+// project, grouped by their area/* and kind/* labels.
+type releaseNotes struct {
+	Project      string       `json:"project"`
+	Column       string       `json:"column"`
+	Areas        []*notesArea `json:"areas"`
+	Contributors []string     `json:"contributors"`
+	areas        map[string]*notesArea
+}
+
+type notesArea struct {
+	Name  string       `json:"name"`
+	Kinds []*notesKind `json:"kinds"`
+	kinds map[string]*notesKind
+}
+
+type notesKind struct {
+	Name    string        `json:"name"`
+	Entries []*notesEntry `json:"entries"`
+}
+
+type notesEntry struct {
+	Repository  string `json:"repository"`
+	Number      int    `json:"number"`
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Author      string `json:"author"`
+	PullRequest bool   `json:"pull_request"`
+}
+
+// notesLabelGroup turns the first label with a prefix like "area/" into a
+// heading, "area/networking" becoming "Networking".
+func notesLabelGroup(labels []github.Label, prefix, fallback string) string {
+	var names []string
+	for _, label := range labels {
+		if label.Name != nil && strings.HasPrefix(*label.Name, prefix) && len(*label.Name) > len(prefix) {
+			names = append(names, strings.TrimPrefix(*label.Name, prefix))
+		}
+	}
+	if len(names) == 0 {
+		return fallback
+	}
+	sort.Strings(names)
+	name := strings.Replace(names[0], "-", " ", -1)
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func (n *releaseNotes) add(issue *github.Issue, repository string) {
+	areaName := notesLabelGroup(issue.Labels, "area/", "Other")
+	kindName := notesLabelGroup(issue.Labels, "kind/", "Other")
+	area := n.areas[areaName]
+	if area == nil {
+		area = &notesArea{Name: areaName, kinds: make(map[string]*notesKind)}
+		n.areas[areaName] = area
+		n.Areas = append(n.Areas, area)
+	}
+	kind := area.kinds[kindName]
+	if kind == nil {
+		kind = &notesKind{Name: kindName}
+		area.kinds[kindName] = kind
+		area.Kinds = append(area.Kinds, kind)
+	}
+	entry := &notesEntry{
+		Repository:  repository,
+		Number:      *issue.Number,
+		Title:       *issue.Title,
+		URL:         *issue.HTMLURL,
+		Author:      *issue.User.Login,
+		PullRequest: issue.PullRequestLinks != nil,
+	}
+	kind.Entries = append(kind.Entries, entry)
+	if !containsString(n.Contributors, entry.Author) {
+		n.Contributors = append(n.Contributors, entry.Author)
+	}
+}
+
+// sort orders areas and kinds by name, leaving Other last, and entries by
+// repository and number so the notes don't depend on the order of the cards.
+func (n *releaseNotes) sort() {
+	byName := func(a, b string) bool {
+		if a == "Other" || b == "Other" {
+			return b == "Other" && a != "Other"
+		}
+		return a < b
+	}
+	sort.Slice(n.Areas, func(i, j int) bool { return byName(n.Areas[i].Name, n.Areas[j].Name) })
+	for _, area := range n.Areas {
+		sort.Slice(area.Kinds, func(i, j int) bool { return byName(area.Kinds[i].Name, area.Kinds[j].Name) })
+		for _, kind := range area.Kinds {
+			sort.Slice(kind.Entries, func(i, j int) bool {
+				a, b := kind.Entries[i], kind.Entries[j]
+				if a.Repository != b.Repository {
+					return a.Repository < b.Repository
+				}
+				return a.Number < b.Number
+			})
+		}
+	}
+	sort.Strings(n.Contributors)
+}
+
+// releaseNotes collects the notes of a column of a project on the board of
+// owner/name, or of the organization owner if name is empty. The column
+// defaults to the workflow's cherry_picked column.
+func (mon *githubMonitor) releaseNotes(ctx context.Context, owner, name, projectName, columnName string) (*releaseNotes, error) {
+	if columnName == "" {
+		wf := mon.config.workflowFor(owner, name)
+		columnName = wf.columnName(wf.CherryPicked)
+		if wf.CherryPicked == "" {
+			columnName = wf.Columns[len(wf.Columns)-1].Name
+		}
+	}
+	projects, err := mon.listProjects(ctx, owner, name, "all")
+	if err != nil {
+		return nil, err
+	}
+	var project *github.Project
+	for _, p := range projects {
+		if *p.Name == projectName {
+			project = p
+		}
+	}
+	if project == nil {
+		return nil, permanent(fmt.Errorf("No project named %s", projectName))
+	}
+	notes := &releaseNotes{
+		Project: projectName,
+		Column:  columnName,
+		areas:   make(map[string]*notesArea),
+	}
+	columns, err := mon.projectColumns(ctx, *project.ID)
+	if err != nil {
+		return nil, err
+	}
+	var column *github.ProjectColumn
+	for _, c := range columns {
+		if *c.Name == columnName {
+			column = c
+			break
+		}
+	}
+	if column == nil {
+		return nil, permanent(fmt.Errorf("No column named %s", columnName))
+	}
+	cards, err := mon.columnCards(ctx, *column.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, card := range cards {
+		// Notes on the board aren't part of the release
+		if card.ContentURL == nil {
+			continue
+		}
+		issueOwner, issueRepo, number, err := contentIssue(*card.ContentURL)
+		if err != nil {
+			return nil, err
+		}
+		issue, _, err := mon.client.Issues.Get(ctx, issueOwner, issueRepo, number)
+		if err != nil {
+			return nil, err
+		}
+		notes.add(issue, fmt.Sprintf("%s/%s", issueOwner, issueRepo))
+	}
+	notes.sort()
+	return notes, nil
+}
+
+var notesMarkdown = texttemplate.Must(texttemplate.New("markdown").Parse(
+	`# {{.Project}}
+{{range .Areas}}
+## {{.Name}}
+{{range .Kinds}}
+### {{.Name}}
+
+{{range .Entries}}- {{.Title}} [{{.Repository}}#{{.Number}}]({{.URL}}) (@{{.Author}})
+{{end}}{{end}}{{end}}
+## Contributors
+
+{{range $i, $c := .Contributors}}{{if $i}}, {{end}}@{{$c}}{{end}}
+`))
+
+var notesHTML = template.Must(template.New("html").Parse(
+	`<h1>{{.Project}}</h1>
+{{range .Areas}}<h2>{{.Name}}</h2>
+{{range .Kinds}}<h3>{{.Name}}</h3>
+<ul>
+{{range .Entries}}<li>{{.Title}} <a href="{{.URL}}">{{.Repository}}#{{.Number}}</a> (<a href="https://github.com/{{.Author}}">@{{.Author}}</a>)</li>
+{{end}}</ul>
+{{end}}{{end}}<h2>Contributors</h2>
+<p>{{range $i, $c := .Contributors}}{{if $i}}, {{end}}<a href="https://github.com/{{$c}}">@{{$c}}</a>{{end}}</p>
+`))
+
+// render writes the notes as markdown, html or json.
+func (n *releaseNotes) render(w io.Writer, format string) error {
+	switch format {
+	case "", "markdown", "md":
+		return notesMarkdown.Execute(w, n)
+	case "html":
+		return notesHTML.Execute(w, n)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(n)
+	}
+	return fmt.Errorf("unknown format %q, use markdown, html or json", format)
+}
+
+var notesContentTypes = map[string]string{
+	"":         "text/markdown; charset=utf-8",
+	"markdown": "text/markdown; charset=utf-8",
+	"md":       "text/markdown; charset=utf-8",
+	"html":     "text/html; charset=utf-8",
+	"json":     "application/json",
+}
+
+// handleNotes serves the release notes of a project at
+// /notes/{owner}/{name}/{project}, or /notes/{org}/{project} for
+// organization projects. ?format= and ?column= work like the flags of the
+// notes command. It takes the admin token and only serves boards in the
+// config.
+func (mon *githubMonitor) handleNotes(w http.ResponseWriter, r *http.Request) {
+	if !mon.authorized(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	owner, name, project := vars["owner"], vars["name"], vars["project"]
+	if (name == "" && mon.config.organization(owner) == nil) || (name != "" && mon.config.repository(owner, name) == nil) {
+		http.Error(w, "Unknown repository or organization", http.StatusNotFound)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	contentType, ok := notesContentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	m, err := mon.forOwner(ctx, owner, name)
+	if err != nil {
+		log.Errorf("%s %v", r.URL, err)
+		http.Error(w, "Could not authenticate", http.StatusInternalServerError)
+		return
+	}
+	notes, err := m.releaseNotes(ctx, owner, name, project, r.URL.Query().Get("column"))
+	if err != nil {
+		if _, ok := err.(permanentError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Errorf("%s Could not collect release notes: %v", r.URL, err)
+		http.Error(w, "Could not collect release notes", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if err := notes.render(w, format); err != nil {
+		log.Errorf("%s Could not render release notes: %v", r.URL, err)
+	}
+}
+
+// notesCommand prints the release notes of a project:
+//
+//	release-bot notes [-format markdown|html|json] [-column name] <owner/name|org> <project>
+func notesCommand(mon *githubMonitor, args []string) error {
+	flags := flag.NewFlagSet("notes", flag.ExitOnError)
+	format := flags.String("format", "markdown", "Format of the notes: markdown, html or json")
+	column := flags.String("column", "", "Column to take the notes from, defaults to the workflow's cherry_picked column")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: release-bot notes [-format markdown|html|json] [-column name] <owner/name|org> <project>")
+	}
+	owner, name := splitBoard(flags.Arg(0))
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	m, err := mon.forOwner(ctx, owner, name)
+	if err != nil {
+		return err
+	}
+	notes, err := m.releaseNotes(ctx, owner, name, flags.Arg(1), *column)
+	if err != nil {
+		return err
+	}
+	return notes.render(os.Stdout, *format)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/gorilla/mux"
+)
+
+func TestNotesLabelGroup(t *testing.T) {
+	labels := func(names ...string) []github.Label {
+		var labels []github.Label
+		for i := range names {
+			labels = append(labels, github.Label{Name: &names[i]})
+		}
+		return labels
+	}
+	tests := []struct {
+		labels []github.Label
+		want   string
+	}{
+		{labels("area/networking"), "Networking"},
+		{labels("kind/bug", "area/swarm", "area/builder"), "Builder"},
+		{labels("area/secret-store"), "Secret store"},
+		{labels("kind/bug"), "Other"},
+		{nil, "Other"},
+		{labels("area/"), "Other"},
+		{labels("area/", "area/volumes"), "Volumes"},
+		{[]github.Label{{}}, "Other"},
+	}
+	for _, tt := range tests {
+		if got := notesLabelGroup(tt.labels, "area/", "Other"); got != tt.want {
+			t.Errorf("notesLabelGroup(%v) = %q, want %q", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestReleaseNotes(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"GET /repos/docker/release-tracking/projects": {body: `[{"id": 1, "name": "17.06.1-ee-1-rc1"}, {"id": 2, "name": "17.06.1-ee-1-rc2"}]`},
+		"GET /projects/2/columns":                     {body: `[{"id": 20, "name": "Triage"}, {"id": 21, "name": "Cherry Picked"}]`},
+		"GET /projects/columns/21/cards": {body: `[
+			{"id": 1, "content_url": "https://api.github.com/repos/docker/cli/issues/9"},
+			{"id": 2, "note": "Remember the changelog"},
+			{"id": 3, "content_url": "https://api.github.com/repos/docker/docker/issues/4"},
+			{"id": 4, "content_url": "https://api.github.com/repos/docker/cli/issues/3"}
+		]`},
+		"GET /repos/docker/cli/issues/9": {body: `{"number": 9, "title": "Fix the builder", "html_url": "https://github.com/docker/cli/pull/9",
+			"user": {"login": "carol"}, "labels": [{"name": "area/builder"}, {"name": "kind/bug"}], "pull_request": {}}`},
+		"GET /repos/docker/docker/issues/4": {body: `{"number": 4, "title": "Fix networking", "html_url": "https://github.com/docker/docker/issues/4",
+			"user": {"login": "alice"}, "labels": [{"name": "area/networking"}]}`},
+		"GET /repos/docker/cli/issues/3": {body: `{"number": 3, "title": "Fix the docs", "html_url": "https://github.com/docker/cli/issues/3",
+			"user": {"login": "alice"}, "labels": [{"name": "kind/docs"}]}`},
+	})
+	defer fake.Close()
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon := &githubMonitor{ctx: context.Background(), client: fake.client(), config: cfg}
+	notes, err := mon.releaseNotes(context.Background(), "docker", "release-tracking", "17.06.1-ee-1-rc2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := notes.render(&out, "markdown"); err != nil {
+		t.Fatal(err)
+	}
+	want := `# 17.06.1-ee-1-rc2
+
+## Builder
+
+### Bug
+
+- Fix the builder [docker/cli#9](https://github.com/docker/cli/pull/9) (@carol)
+
+## Networking
+
+### Other
+
+- Fix networking [docker/docker#4](https://github.com/docker/docker/issues/4) (@alice)
+
+## Other
+
+### Docs
+
+- Fix the docs [docker/cli#3](https://github.com/docker/cli/issues/3) (@alice)
+
+## Contributors
+
+@alice, @carol
+`
+	if out.String() != want {
+		t.Errorf("release notes are\n%s\nwant\n%s", out.String(), want)
+	}
+	if _, err := mon.releaseNotes(context.Background(), "docker", "release-tracking", "17.06.1-ee-1-rc3", ""); err == nil || isTransient(err) {
+		t.Errorf("releaseNotes() of a missing project = %v, want a permanent error", err)
+	}
+	if _, err := mon.releaseNotes(context.Background(), "docker", "release-tracking", "17.06.1-ee-1-rc2", "Done"); err == nil || isTransient(err) {
+		t.Errorf("releaseNotes() of a missing column = %v, want a permanent error", err)
+	}
+}
+
+func TestHandleNotesNeedsAdminTokenAndConfiguredBoard(t *testing.T) {
+	path, cleanup := writeConfig(t, `{"repositories": {"docker/cli": {}}, "organizations": {"docker": {}}}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon := &githubMonitor{adminToken: []byte("admin"), config: cfg}
+	router := mux.NewRouter()
+	router.Handle("/notes/{owner}/{project}", http.HandlerFunc(mon.handleNotes)).Methods("GET")
+	router.Handle("/notes/{owner}/{name}/{project}", http.HandlerFunc(mon.handleNotes)).Methods("GET")
+	tests := []struct {
+		path          string
+		authorization string
+		code          int
+	}{
+		{"/notes/docker/cli/17.06.1-ee-1", "", http.StatusUnauthorized},
+		{"/notes/docker/cli/17.06.1-ee-1", "Bearer wrong", http.StatusUnauthorized},
+		{"/notes/docker/compose/17.06.1-ee-1", "Bearer admin", http.StatusNotFound},
+		{"/notes/moby/17.06.1-ee-1", "Bearer admin", http.StatusNotFound},
+		{"/notes/docker/cli/17.06.1-ee-1?format=pdf", "Bearer admin", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Authorization", tt.authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s with %q: responded %d, want %d", tt.path, tt.authorization, w.Code, tt.code)
+		}
+	}
+}
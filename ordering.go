@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// deliveryOrder says which deliveries have to be handled one after the other
+// and which are out of date.
+type deliveryOrder struct {
+	// keys are the issues and cards a delivery touches. Deliveries sharing a
+	// key are handled in the order they arrived, others in parallel.
+	keys []string
+	// subject is the label of an issue or the card a delivery is about. A
+	// delivery updated before the last one handled about its subject is stale.
+	subject string
+	updated time.Time
+}
+
+// order works out the order of a delivery from its payload, once.
+func (d *delivery) order() *deliveryOrder {
+	if d.ordering == nil {
+		d.ordering = parseDeliveryOrder(d.Event, d.Payload)
+	}
+	return d.ordering
+}
+
+func parseDeliveryOrder(event string, payload []byte) *deliveryOrder {
+	var p struct {
+		Action string `json:"action"`
+		Label  *struct {
+			Name string `json:"name"`
+		} `json:"label"`
+		Issue *struct {
+			Number    int       `json:"number"`
+			UpdatedAt time.Time `json:"updated_at"`
+		} `json:"issue"`
+		PullRequest *struct {
+			Number    int       `json:"number"`
+			UpdatedAt time.Time `json:"updated_at"`
+		} `json:"pull_request"`
+		ProjectCard *struct {
+			ID         int       `json:"id"`
+			ContentURL string    `json:"content_url"`
+			UpdatedAt  time.Time `json:"updated_at"`
+		} `json:"project_card"`
+	}
+	o := &deliveryOrder{}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return o
+	}
+	owner, name := payloadRepository(payload)
+	switch {
+	case p.Issue != nil && name != "":
+		o.keys = []string{issueKey(owner, name, p.Issue.Number)}
+		o.updated = p.Issue.UpdatedAt
+	case p.PullRequest != nil && name != "":
+		o.keys = []string{issueKey(owner, name, p.PullRequest.Number)}
+		o.updated = p.PullRequest.UpdatedAt
+	case event == "project_card" && p.ProjectCard != nil:
+		o.keys = []string{cardKey(p.ProjectCard.ID)}
+		// Moving a card changes the labels of its issue
+		if p.ProjectCard.ContentURL != "" {
+			if owner, name, number, err := contentIssue(p.ProjectCard.ContentURL); err == nil {
+				o.keys = append(o.keys, issueKey(owner, name, number))
+			}
+		}
+		o.subject, o.updated = o.keys[0], p.ProjectCard.UpdatedAt
+	}
+	if (p.Action == "labeled" || p.Action == "unlabeled") && p.Label != nil && len(o.keys) > 0 {
+		o.subject = fmt.Sprintf("%s %s", o.keys[0], p.Label.Name)
+	}
+	return o
+}
+
+func issueKey(owner, name string, number int) string {
+	return fmt.Sprintf("issue %s/%s#%d", strings.ToLower(owner), strings.ToLower(name), number)
+}
+
+func cardKey(cardID int) string {
+	return fmt.Sprintf("card %d", cardID)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDeliveryOrder(t *testing.T) {
+	updated := time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		event   string
+		payload string
+		want    *deliveryOrder
+	}{
+		{
+			"issues",
+			`{"action":"labeled","issue":{"number":5,"updated_at":"2017-08-01T12:00:00Z"},"label":{"name":"17.06/triage"},"repository":{"name":"CLI","owner":{"login":"docker"}}}`,
+			&deliveryOrder{keys: []string{"issue docker/cli#5"}, subject: "issue docker/cli#5 17.06/triage", updated: updated},
+		},
+		{
+			"issues",
+			`{"action":"opened","issue":{"number":5,"updated_at":"2017-08-01T12:00:00Z"},"repository":{"name":"cli","owner":{"login":"docker"}}}`,
+			&deliveryOrder{keys: []string{"issue docker/cli#5"}, updated: updated},
+		},
+		{
+			"pull_request",
+			`{"action":"unlabeled","number":7,"pull_request":{"number":7,"updated_at":"2017-08-01T12:00:00Z"},"label":{"name":"17.06/triage"},"repository":{"name":"cli","owner":{"login":"docker"}}}`,
+			&deliveryOrder{keys: []string{"issue docker/cli#7"}, subject: "issue docker/cli#7 17.06/triage", updated: updated},
+		},
+		{
+			"project_card",
+			`{"action":"moved","project_card":{"id":3,"content_url":"https://api.github.com/repos/docker/cli/issues/5","updated_at":"2017-08-01T12:00:00Z"}}`,
+			&deliveryOrder{keys: []string{"card 3", "issue docker/cli#5"}, subject: "card 3", updated: updated},
+		},
+		{
+			"project_card",
+			`{"action":"created","project_card":{"id":3,"note":"A note","updated_at":"2017-08-01T12:00:00Z"}}`,
+			&deliveryOrder{keys: []string{"card 3"}, subject: "card 3", updated: updated},
+		},
+		{"project", `{"action":"closed","project":{"id":1}}`, &deliveryOrder{}},
+		{"issues", `not json`, &deliveryOrder{}},
+	}
+	for _, tt := range tests {
+		if got := parseDeliveryOrder(tt.event, []byte(tt.payload)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDeliveryOrder(%s, %s) = %+v, want %+v", tt.event, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestQueueOrdersDeliveriesPerIssue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "release-bot-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := newEventQueue(dir, 3, func(*delivery) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(id string, number int) *delivery {
+		return &delivery{
+			ID:       id,
+			Event:    "issues",
+			Payload:  []byte(fmt.Sprintf(`{"action":"labeled","issue":{"number":%d},"repository":{"name":"cli","owner":{"login":"docker"}}}`, number)),
+			Received: time.Now(),
+		}
+	}
+	for _, d := range []*delivery{issue("a", 1), issue("b", 1), issue("c", 2)} {
+		if err := q.Enqueue(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var handled *delivery
+	next := func() string {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		d, _ := q.due()
+		if d == nil {
+			return ""
+		}
+		handled = d
+		return d.ID
+	}
+	// b waits for a, which is about the same issue, c doesn't
+	if id := next(); id != "a" {
+		t.Fatalf("first due delivery is %q, want a", id)
+	}
+	a := handled
+	if id := next(); id != "c" {
+		t.Fatalf("second due delivery is %q, want c", id)
+	}
+	if id := next(); id != "" {
+		t.Fatalf("%q is due while a is handled, want none", id)
+	}
+	// A redelivery of a while it is handled isn't queued again
+	if err := q.Enqueue(issue("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if depth := q.Depth(); depth != 1 {
+		t.Fatalf("depth is %d after redelivering a, want 1", depth)
+	}
+	q.finish(a, nil)
+	if id := next(); id != "b" {
+		t.Fatalf("due delivery after a is %q, want b", id)
+	}
+}
+
+func TestQueueLockHoldsOffDeliveries(t *testing.T) {
+	q, cleanup := newTestQueue(t, func(*delivery) error { return nil })
+	defer cleanup()
+	keys := []string{issueKey("docker", "cli", 1), cardKey(31)}
+	q.lock(keys)
+	d := &delivery{
+		ID:       "a",
+		Event:    "issues",
+		Payload:  []byte(`{"action":"labeled","issue":{"number":1},"repository":{"name":"cli","owner":{"login":"docker"}}}`),
+		Received: time.Now(),
+	}
+	if err := q.Enqueue(d); err != nil {
+		t.Fatal(err)
+	}
+	due := func() *delivery {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		d, _ := q.due()
+		return d
+	}
+	if d := due(); d != nil {
+		t.Fatalf("%s is due while its issue is locked", d.ID)
+	}
+	q.unlock(keys)
+	handled := due()
+	if handled == nil || handled.ID != "a" {
+		t.Fatalf("due delivery after unlocking is %+v, want a", handled)
+	}
+	// Locking waits for the delivery being handled
+	locked := make(chan bool)
+	go func() {
+		q.lock(keys)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock() returned while a delivery about the issue is handled")
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.finish(handled, nil)
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock() still waits after the delivery was handled")
+	}
+	q.unlock(keys)
+	// A queue that isn't running has nothing to lock
+	var none *eventQueue
+	none.lock(keys)
+	none.unlock(keys)
+}
@@ -0,0 +1,35 @@
+// Package paginate walks the pages of GitHub list calls.
+//
+// The API returns 30 items a page unless asked for more, and what comes after
+// is only found by following the Link header. Pages calls a function for every
+// page in turn, which fetches it with the go-github call at hand and hands
+// back the number of the next page from the response, so one loop serves every
+// list call. The loop also stops when the context is done, since a project
+// can have thousands of cards.
+package paginate
+
+import "context"
+
+// PerPage is the most items GitHub returns in a page.
+const PerPage = 100
+
+// Pages calls fetch with the number of every page until it returns 0 as the
+// next page, or an error. Page 0 is the first page. It stops early once ctx is
+// done, returning its error.
+func Pages(ctx context.Context, fetch func(page int) (next int, err error)) error {
+	page := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		next, err := fetch(page)
+		if err != nil {
+			return err
+		}
+		// A next page that doesn't move forward would never end
+		if next <= page {
+			return nil
+		}
+		page = next
+	}
+}
@@ -0,0 +1,55 @@
+package paginate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPages(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name string
+		// next is the next page each page answers with, by page
+		next  map[int]int
+		err   map[int]error
+		pages []int
+		want  error
+	}{
+		{"single page", map[int]int{0: 0}, nil, []int{0}, nil},
+		{"several pages", map[int]int{0: 2, 2: 3, 3: 0}, nil, []int{0, 2, 3}, nil},
+		{"error", map[int]int{0: 2, 2: 3}, map[int]error{2: failed}, []int{0, 2}, failed},
+		{"next page going back", map[int]int{0: 2, 2: 1}, nil, []int{0, 2}, nil},
+		{"next page repeated", map[int]int{0: 2, 2: 2}, nil, []int{0, 2}, nil},
+	}
+	for _, tt := range tests {
+		var pages []int
+		err := Pages(context.Background(), func(page int) (int, error) {
+			pages = append(pages, page)
+			return tt.next[page], tt.err[page]
+		})
+		if err != tt.want {
+			t.Errorf("%s: Pages() = %v, want %v", tt.name, err, tt.want)
+		}
+		if !reflect.DeepEqual(pages, tt.pages) {
+			t.Errorf("%s: fetched pages %v, want %v", tt.name, pages, tt.pages)
+		}
+	}
+}
+
+func TestPagesStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var pages []int
+	err := Pages(ctx, func(page int) (int, error) {
+		pages = append(pages, page)
+		cancel()
+		return page + 1, nil
+	})
+	if err != context.Canceled {
+		t.Errorf("Pages() = %v, want %v", err, context.Canceled)
+	}
+	if !reflect.DeepEqual(pages, []int{0}) {
+		t.Errorf("fetched pages %v, want [0]", pages)
+	}
+}
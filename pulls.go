@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// pullRequestEvent is a pull_request webhook along with the fields the
+// vendored go-github doesn't decode.
+type pullRequestEvent struct {
+	*github.PullRequestEvent
+	Label *github.Label
+	Draft bool
+}
+
+func parsePullRequestEvent(payload []byte) (*pullRequestEvent, error) {
+	e := &pullRequestEvent{PullRequestEvent: &github.PullRequestEvent{}}
+	if err := json.Unmarshal(payload, e.PullRequestEvent); err != nil {
+		return nil, err
+	}
+	var extra struct {
+		Label       *github.Label `json:"label"`
+		PullRequest struct {
+			Draft bool `json:"draft"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(payload, &extra); err != nil {
+		return nil, err
+	}
+	e.Label = extra.Label
+	e.Draft = extra.PullRequest.Draft
+	if e.Action == nil || e.PullRequest == nil || e.Repo == nil {
+		return nil, fmt.Errorf("pull_request payload is missing its action, pull request or repository")
+	}
+	return e, nil
+}
+
+func pullRequestItem(repo *github.Repository, pr *github.PullRequest) *boardItem {
+	return &boardItem{
+		Owner:       *repo.Owner.Login,
+		Repo:        *repo.Name,
+		Number:      *pr.Number,
+		URL:         *pr.IssueURL,
+		ContentID:   *pr.ID,
+		ContentType: "PullRequest",
+	}
+}
+
+// handlePullRequestEvent gives pull requests the same board semantics as
+// issues. Labeling a pull request arrives as a pull_request event rather than
+// an issues event.
+func (mon *githubMonitor) handlePullRequestEvent(d *delivery) error {
+	e, err := parsePullRequestEvent(d.Payload)
+	if err != nil {
+		return permanent(err)
+	}
+	item := pullRequestItem(e.Repo, e.PullRequest)
+	switch *e.Action {
+	case "labeled":
+		if err := mon.handleLabelEvent(item, *e.Label.Name, d); err != nil {
+			return err
+		}
+		return mon.handleCherryPickLabel(item, *e.Label.Name, d)
+	case "unlabeled":
+		return mon.handleUnlabelEvent(item, *e.Label.Name, d)
+	case "opened":
+		// Drafts get triaged once they are marked ready for review
+		if e.Draft {
+			return nil
+		}
+		return mon.handleOpenedEvent(item, d)
+	case "ready_for_review":
+		return mon.handleOpenedEvent(item, d)
+	case "reopened":
+		return mon.handleReopenedEvent(item, d)
+	case "closed":
+		if e.PullRequest.Merged != nil && *e.PullRequest.Merged {
+			if err := mon.handleMergedEvent(item, d); err != nil {
+				return err
+			}
+			return mon.handleBackportMerged(e, d)
+		}
+	}
+	return nil
+}
+
+// releaseLabels returns the {release}/{action} labels of an issue or pull
+// request.
+func (mon *githubMonitor) releaseLabels(ctx context.Context, item *boardItem) ([]string, error) {
+	labels, err := mon.issueLabels(ctx, item.Owner, item.Repo, item.Number)
+	if err != nil {
+		return nil, err
+	}
+	grammar := mon.config.grammarFor(item.Owner, item.Repo)
+	var releaseLabels []string
+	for _, label := range labels {
+		if _, _, err := grammar.ParseLabel(*label.Name); err == nil {
+			releaseLabels = append(releaseLabels, *label.Name)
+		}
+	}
+	return releaseLabels, nil
+}
+
+// When an issue or pull request is reopened its cards are put back where its
+// release labels say they belong, in case they were removed while it was
+// closed.
+func (mon *githubMonitor) handleReopenedEvent(item *boardItem, d *delivery) error {
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	labels, err := mon.releaseLabels(ctx, item)
+	if err != nil {
+		return err
+	}
+	for _, label := range labels {
+		if err := mon.handleLabelEvent(item, label, d); err != nil {
+			if _, ok := err.(permanentError); ok {
+				log.Debugf("%s Not restoring card for %s: %v", d.URI, label, err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// When a pull request is merged the releases it was labeled for cherry-picking
+// get their cherry-pick pull requests, and its cards advance as configured by
+// the workflow's on_merge, for example from Cherry Pick to Cherry Picked, with
+// its labels following.
+func (mon *githubMonitor) handleMergedEvent(item *boardItem, d *delivery) error {
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	wf := mon.config.workflowFor(item.Owner, item.Repo)
+	labels, err := mon.releaseLabels(ctx, item)
+	if err != nil {
+		return err
+	}
+	grammar := mon.config.grammarFor(item.Owner, item.Repo)
+	for _, label := range labels {
+		projectPrefix, labelSuffix, _ := grammar.ParseLabel(label)
+		if labelSuffix == wf.CherryPick {
+			if err := mon.handleCherryPickLabel(item, label, d); err != nil {
+				return err
+			}
+		}
+		next, ok := wf.OnMerge[labelSuffix]
+		if !ok {
+			continue
+		}
+		log.Infof("%s Pull request #%d merged, advancing %s to %s", d.URI, item.Number, label, next)
+		if err := mon.handleLabelEvent(item, fmt.Sprintf("%s/%s", projectPrefix, next), d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
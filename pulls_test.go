@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePullRequestEvent(t *testing.T) {
+	tests := []struct {
+		payload string
+		label   string
+		draft   bool
+		ok      bool
+	}{
+		{`{"action":"labeled","label":{"name":"17.06/triage"},"pull_request":{"number":7},"repository":{"name":"cli"}}`, "17.06/triage", false, true},
+		{`{"action":"opened","pull_request":{"number":7,"draft":true},"repository":{"name":"cli"}}`, "", true, true},
+		{`{"action":"opened","repository":{"name":"cli"}}`, "", false, false},
+		{`{"pull_request":{"number":7},"repository":{"name":"cli"}}`, "", false, false},
+		{`not json`, "", false, false},
+	}
+	for _, tt := range tests {
+		e, err := parsePullRequestEvent([]byte(tt.payload))
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("parsePullRequestEvent(%s) = %v, want ok %v", tt.payload, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if label := e.Label.GetName(); label != tt.label {
+			t.Errorf("parsePullRequestEvent(%s) has label %q, want %q", tt.payload, label, tt.label)
+		}
+		if e.Draft != tt.draft {
+			t.Errorf("parsePullRequestEvent(%s) has draft %v, want %v", tt.payload, e.Draft, tt.draft)
+		}
+	}
+}
+
+func TestPullRequestItem(t *testing.T) {
+	e, err := parsePullRequestEvent([]byte(`{
+		"action": "closed",
+		"pull_request": {"id": 1234, "number": 7, "merged": true, "issue_url": "https://api.github.com/repos/docker/cli/issues/7"},
+		"repository": {"name": "cli", "owner": {"login": "docker"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &boardItem{
+		Owner:       "docker",
+		Repo:        "cli",
+		Number:      7,
+		URL:         "https://api.github.com/repos/docker/cli/issues/7",
+		ContentID:   1234,
+		ContentType: "PullRequest",
+	}
+	if got := pullRequestItem(e.Repo, e.PullRequest); !reflect.DeepEqual(got, want) {
+		t.Errorf("pullRequestItem() = %+v, want %+v", got, want)
+	}
+}
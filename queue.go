@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// delivery is a single accepted webhook delivery. It is written to disk before
+// we acknowledge the webhook so that a crash or a failing GitHub API call
+// never loses the label or card change it describes.
+type delivery struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	URI       string          `json:"uri"`
+	Payload   json.RawMessage `json:"payload"`
+	Received  time.Time       `json:"received"`
+	Attempts  int             `json:"attempts"`
+	NextRetry time.Time       `json:"next_retry"`
+	LastError string          `json:"last_error,omitempty"`
+
+	ordering *deliveryOrder
+}
+
+// permanentError marks a failure that retrying will not fix, for example a
+// validation error from GitHub. Deliveries failing this way go straight to the
+// dead letter store.
+type permanentError struct {
+	error
+}
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// isTransient reports whether a failed delivery is worth retrying. Rate limits,
+// server errors and network problems are, anything GitHub rejected as a bad
+// request is not.
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case permanentError:
+		return false
+	case *github.RateLimitError, *github.AbuseRateLimitError, *github.AcceptedError:
+		return true
+	case *github.ErrorResponse:
+		code := e.Response.StatusCode
+		return code >= 500 || code == 429
+	}
+	// Anything else is most likely a network problem talking to GitHub.
+	return true
+}
+
+// eventQueue is an on-disk work queue of webhook deliveries processed by a
+// bounded pool of workers. Deliveries about the same issue or card are handled
+// one at a time in the order they arrived, and dropped when they are older
+// than one already handled about the same label or card.
+//
+// Layout of dir:
+//
+//	pending/<delivery>.json  deliveries waiting to be processed or retried
+//	dead/<delivery>.json     deliveries that failed permanently or ran out of attempts
+type eventQueue struct {
+	dir         string
+	handler     func(*delivery) error
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*delivery
+	timer   *time.Timer
+	// running are the keys of the deliveries being handled
+	running map[string]bool
+	// handling are the IDs of the deliveries being handled
+	handling map[string]bool
+	// latest is when the subject of the last delivery handled about it was
+	// updated
+	latest map[string]time.Time
+}
+
+func newEventQueue(dir string, maxAttempts int, handler func(*delivery) error) (*eventQueue, error) {
+	for _, sub := range []string{"pending", "dead"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	q := &eventQueue{
+		dir:         dir,
+		handler:     handler,
+		maxAttempts: maxAttempts,
+		minBackoff:  5 * time.Second,
+		maxBackoff:  30 * time.Minute,
+		running:     make(map[string]bool),
+		handling:    make(map[string]bool),
+		latest:      make(map[string]time.Time),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load picks up every delivery left in pending/ by a previous run.
+func (q *eventQueue) load() error {
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, "pending"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(q.dir, "pending", f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var d delivery
+		if err := json.Unmarshal(data, &d); err != nil {
+			log.Errorf("Moving unreadable queue entry %s to dead letters: %v", f.Name(), err)
+			os.Rename(path, filepath.Join(q.dir, "dead", f.Name()))
+			continue
+		}
+		// Entries written before IDs were encoded in hex are renamed, so
+		// that finishing them removes them
+		if name := q.path("pending", &d); name != path {
+			if err := os.Rename(path, name); err != nil {
+				return err
+			}
+		}
+		q.pending = append(q.pending, &d)
+	}
+	sort.SliceStable(q.pending, func(i, j int) bool {
+		return q.pending[i].Received.Before(q.pending[j].Received)
+	})
+	if len(q.pending) > 0 {
+		log.Infof("Resuming %d queued deliveries", len(q.pending))
+	}
+	return nil
+}
+
+// Start launches the worker pool.
+func (q *eventQueue) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+// Enqueue durably stores a delivery and hands it to the workers. Deliveries
+// GitHub sends again with the same ID are only queued once, also while the
+// first one is being handled since finishing it removes its file.
+func (q *eventQueue) Enqueue(d *delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.handling[d.ID] {
+		log.Debugf("Delivery %s is already being handled", d.ID)
+		return nil
+	}
+	for _, p := range q.pending {
+		if p.ID == d.ID {
+			log.Debugf("Delivery %s is already queued", d.ID)
+			return nil
+		}
+	}
+	if err := q.write("pending", d); err != nil {
+		return err
+	}
+	q.pending = append(q.pending, d)
+	// Wake everyone, lock may be waiting too
+	q.cond.Broadcast()
+	return nil
+}
+
+// Depth returns the number of deliveries waiting to be processed or retried.
+func (q *eventQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *eventQueue) work() {
+	for {
+		q.handle(q.next())
+	}
+}
+
+// handle runs the handler for a delivery unless it is stale. A handler that
+// panics fails the delivery for good instead of taking the worker, and the
+// issues and cards the delivery holds, down with it.
+func (q *eventQueue) handle(d *delivery) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Handler panicked on delivery %s (%s): %v\n%s", d.ID, d.Event, r, debug.Stack())
+			q.finish(d, permanent(fmt.Errorf("panic: %v", r)))
+		}
+	}()
+	o := d.order()
+	q.mu.Lock()
+	latest := q.latest[o.subject]
+	q.mu.Unlock()
+	if o.subject != "" && o.updated.Before(latest) {
+		log.Infof("Dropping delivery %s (%s), %s changed again since", d.ID, d.Event, o.subject)
+		q.finish(d, nil)
+		return
+	}
+	q.finish(d, q.handler(d))
+}
+
+// next blocks until a delivery is due and removes it from the pending list.
+func (q *eventQueue) next() *delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		d, wake := q.due()
+		if d != nil {
+			return d
+		}
+		if !wake.IsZero() {
+			q.wakeAt(wake)
+		}
+		q.cond.Wait()
+	}
+}
+
+// due removes the first delivery that is due from the pending list, or
+// returns when the next one will be. A delivery isn't due while one about the
+// same issue or card is being handled or arrived before it and is waiting for
+// a retry.
+func (q *eventQueue) due() (*delivery, time.Time) {
+	now := time.Now()
+	var wake time.Time
+	waiting := make(map[string]bool)
+	for i, d := range q.pending {
+		keys := d.order().keys
+		if !d.NextRetry.After(now) && !q.blocked(keys, waiting) {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			for _, key := range keys {
+				q.running[key] = true
+			}
+			q.handling[d.ID] = true
+			return d, time.Time{}
+		}
+		for _, key := range keys {
+			waiting[key] = true
+		}
+		if d.NextRetry.After(now) && (wake.IsZero() || d.NextRetry.Before(wake)) {
+			wake = d.NextRetry
+		}
+	}
+	return nil, wake
+}
+
+func (q *eventQueue) blocked(keys []string, waiting map[string]bool) bool {
+	for _, key := range keys {
+		if q.running[key] || waiting[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// lock waits until no delivery about the issues and cards of keys is being
+// handled and keeps them from being handled until unlock, for changes made
+// outside of deliveries.
+func (q *eventQueue) lock(keys []string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.blocked(keys, nil) {
+		q.cond.Wait()
+	}
+	for _, key := range keys {
+		q.running[key] = true
+	}
+}
+
+func (q *eventQueue) unlock(keys []string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, key := range keys {
+		delete(q.running, key)
+	}
+	q.cond.Broadcast()
+}
+
+// Drain handles every delivery that is due in the calling goroutine instead
+// of the workers, for replaying deliveries one after the other.
+func (q *eventQueue) Drain() {
+	for {
+		q.mu.Lock()
+		d, _ := q.due()
+		q.mu.Unlock()
+		if d == nil {
+			return
+		}
+		q.handle(d)
+	}
+}
+
+// wakeAt makes sure idle workers are woken up when the next retry is due.
+func (q *eventQueue) wakeAt(t time.Time) {
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.timer = time.AfterFunc(time.Until(t), func() {
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	})
+}
+
+func (q *eventQueue) finish(d *delivery, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	o := d.order()
+	for _, key := range o.keys {
+		delete(q.running, key)
+	}
+	delete(q.handling, d.ID)
+	// Deliveries about the same issue or card may be due now
+	q.cond.Broadcast()
+	if err == nil {
+		if o.subject != "" && o.updated.After(q.latest[o.subject]) {
+			q.remember(o.subject, o.updated)
+		}
+		if rmErr := os.Remove(q.path("pending", d)); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Errorf("Could not remove finished delivery %s: %v", d.ID, rmErr)
+		}
+		return
+	}
+	d.Attempts++
+	d.LastError = err.Error()
+	if !isTransient(err) || d.Attempts >= q.maxAttempts {
+		log.Errorf("Delivery %s (%s) failed after %d attempt(s), moving to dead letters: %v", d.ID, d.Event, d.Attempts, err)
+		if wErr := q.write("dead", d); wErr != nil {
+			log.Errorf("Could not store dead letter %s: %v", d.ID, wErr)
+			return
+		}
+		os.Remove(q.path("pending", d))
+		return
+	}
+	delay := q.backoff(d.Attempts)
+	d.NextRetry = time.Now().Add(delay)
+	log.Warnf("Delivery %s (%s) failed, retrying in %v: %v", d.ID, d.Event, delay, err)
+	if wErr := q.write("pending", d); wErr != nil {
+		log.Errorf("Could not persist retry state for %s: %v", d.ID, wErr)
+	}
+	q.insert(d)
+}
+
+// remember notes when the subject of a handled delivery was updated. Subjects
+// not updated for a day are forgotten, GitHub doesn't retry for that long.
+func (q *eventQueue) remember(subject string, updated time.Time) {
+	q.latest[subject] = updated
+	if len(q.latest) < 10000 {
+		return
+	}
+	for s, t := range q.latest {
+		if time.Since(t) > 24*time.Hour {
+			delete(q.latest, s)
+		}
+	}
+}
+
+// insert puts a delivery back into the pending list, keeping arrival order.
+func (q *eventQueue) insert(d *delivery) {
+	i := sort.Search(len(q.pending), func(i int) bool {
+		return q.pending[i].Received.After(d.Received)
+	})
+	q.pending = append(q.pending, nil)
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = d
+}
+
+// backoff doubles the delay on every attempt, capped at maxBackoff.
+func (q *eventQueue) backoff(attempts int) time.Duration {
+	delay := q.minBackoff
+	for i := 1; i < attempts && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	return delay
+}
+
+func (q *eventQueue) path(sub string, d *delivery) string {
+	return filepath.Join(q.dir, sub, fmt.Sprintf("%s.json", safeFileName(d.ID)))
+}
+
+// write atomically replaces the on-disk copy of a delivery.
+func (q *eventQueue) write(sub string, d *delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	path := q.path(sub, d)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// safeFileName encodes s in hex, which no other string encodes to the same
+// name, even on a file system that ignores case.
+func safeFileName(s string) string {
+	return hex.EncodeToString([]byte(s))
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func newTestQueue(t *testing.T, handler func(*delivery) error) (*eventQueue, func()) {
+	dir, err := ioutil.TempDir("", "release-bot-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := newEventQueue(dir, 3, handler)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return q, func() { os.RemoveAll(dir) }
+}
+
+func testDelivery(id string) *delivery {
+	return &delivery{ID: id, Event: "issues", Payload: []byte(`{}`), Received: time.Now()}
+}
+
+// errorResponse is the error go-github returns for a response with code.
+func errorResponse(code int) *github.ErrorResponse {
+	req, _ := http.NewRequest("GET", "https://api.github.com/repos/docker/cli", nil)
+	return &github.ErrorResponse{Response: &http.Response{StatusCode: code, Request: req}}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection reset by peer"), true},
+		{permanent(errors.New("bad payload")), false},
+		{&github.RateLimitError{}, true},
+		{&github.AbuseRateLimitError{}, true},
+		{errorResponse(http.StatusBadGateway), true},
+		{errorResponse(http.StatusTooManyRequests), true},
+		{errorResponse(http.StatusNotFound), false},
+		{errorResponse(http.StatusUnprocessableEntity), false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := &eventQueue{minBackoff: 5 * time.Second, maxBackoff: 30 * time.Minute}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{9, 1280 * time.Second},
+		{10, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := q.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestQueueRetriesUntilHandled(t *testing.T) {
+	handled := make(chan int)
+	attempts := 0
+	q, cleanup := newTestQueue(t, func(d *delivery) error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("attempt %d failed", attempts)
+		}
+		handled <- d.Attempts
+		return nil
+	})
+	defer cleanup()
+	q.minBackoff = time.Millisecond
+	q.Start(1)
+	if err := q.Enqueue(testDelivery("a")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case previous := <-handled:
+		if previous != 2 {
+			t.Errorf("delivery was handled after %d failed attempts, want 2", previous)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was not retried")
+	}
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		dead     bool
+	}{
+		{"transient", errors.New("connection reset by peer"), 1, false},
+		{"out of attempts", errors.New("connection reset by peer"), 3, true},
+		{"permanent", permanent(errors.New("bad payload")), 1, true},
+		{"validation", errorResponse(http.StatusUnprocessableEntity), 1, true},
+	}
+	for _, tt := range tests {
+		q, cleanup := newTestQueue(t, nil)
+		if err := q.Enqueue(testDelivery("a")); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < tt.attempts; i++ {
+			d := q.pending[0]
+			d.NextRetry = time.Time{}
+			q.finish(q.next(), tt.err)
+		}
+		dead := exists(q.path("dead", testDelivery("a")))
+		pending := exists(q.path("pending", testDelivery("a")))
+		if dead != tt.dead || pending == tt.dead {
+			t.Errorf("%s: dead letter %v and pending %v, want dead letter %v", tt.name, dead, pending, tt.dead)
+		}
+		if depth := q.Depth(); (depth == 0) != tt.dead {
+			t.Errorf("%s: %d deliveries pending", tt.name, depth)
+		}
+		cleanup()
+	}
+}
+
+func TestQueueSurvivesPanickingHandler(t *testing.T) {
+	handled := make(chan string)
+	q, cleanup := newTestQueue(t, func(d *delivery) error {
+		if d.ID == "a" {
+			panic("nil map")
+		}
+		handled <- d.ID
+		return nil
+	})
+	defer cleanup()
+	q.Start(1)
+	// Both are about the same issue, so b waits for a
+	for _, id := range []string{"a", "b"} {
+		d := testDelivery(id)
+		d.Payload = []byte(`{"action":"labeled","issue":{"number":1},"repository":{"name":"cli","owner":{"login":"docker"}}}`)
+		if err := q.Enqueue(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case id := <-handled:
+		if id != "b" {
+			t.Errorf("handled %s, want b", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery after the panic was not handled")
+	}
+	// The delivery that panicked isn't retried
+	if !exists(q.path("dead", testDelivery("a"))) {
+		t.Errorf("delivery that panicked is not a dead letter")
+	}
+}
+
+func TestQueueRetryIsDelayed(t *testing.T) {
+	q, cleanup := newTestQueue(t, nil)
+	defer cleanup()
+	if err := q.Enqueue(testDelivery("a")); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	d := q.next()
+	q.finish(d, errors.New("connection reset by peer"))
+	if d.Attempts != 1 || d.LastError != "connection reset by peer" {
+		t.Errorf("delivery has %d attempts and error %q after failing once", d.Attempts, d.LastError)
+	}
+	if d.NextRetry.Before(before.Add(q.minBackoff)) {
+		t.Errorf("delivery is retried at %v, less than %v after failing", d.NextRetry, q.minBackoff)
+	}
+	// The retry state survives a restart
+	resumed, err := newEventQueue(q.dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed.pending) != 1 || resumed.pending[0].Attempts != 1 || !resumed.pending[0].NextRetry.Equal(d.NextRetry) {
+		t.Errorf("resumed queue has %+v pending, want a after 1 attempt", resumed.pending)
+	}
+}
+
+func TestQueueEnqueuesDeliveriesOnce(t *testing.T) {
+	q, cleanup := newTestQueue(t, nil)
+	defer cleanup()
+	for _, id := range []string{"a", "b", "a"} {
+		if err := q.Enqueue(testDelivery(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth := q.Depth(); depth != 2 {
+		t.Errorf("depth is %d after enqueueing a twice, want 2", depth)
+	}
+}
+
+func TestQueueResumesPendingDeliveries(t *testing.T) {
+	q, cleanup := newTestQueue(t, nil)
+	defer cleanup()
+	first := testDelivery("first")
+	second := testDelivery("second")
+	second.Received = first.Received.Add(time.Second)
+	for _, d := range []*delivery{second, first} {
+		if err := q.Enqueue(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unreadable := filepath.Join(q.dir, "pending", "unreadable.json")
+	if err := ioutil.WriteFile(unreadable, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := newEventQueue(q.dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed.pending) != 2 || resumed.pending[0].ID != "first" || resumed.pending[1].ID != "second" {
+		t.Errorf("resumed queue has %+v pending, want first and second", resumed.pending)
+	}
+	if exists(unreadable) || !exists(filepath.Join(q.dir, "dead", "unreadable.json")) {
+		t.Errorf("unreadable delivery was not moved to the dead letters")
+	}
+}
+
+func TestQueueKeepsSimilarIDsApart(t *testing.T) {
+	q, cleanup := newTestQueue(t, nil)
+	defer cleanup()
+	// Both would be a_b with only the characters unsafe in file names replaced
+	for _, id := range []string{"a.b", "a_b", "A_B"} {
+		if err := q.Enqueue(testDelivery(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resumed, err := newEventQueue(q.dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := resumed.Depth(); depth != 3 {
+		t.Errorf("resumed queue has %d deliveries, want all 3", depth)
+	}
+	for _, id := range []string{"a.b", "../a", "a/b"} {
+		if name := safeFileName(id); strings.ContainsAny(name, "./") {
+			t.Errorf("safeFileName(%q) = %q", id, name)
+		}
+	}
+}
+
+func TestQueueRenamesEntriesOfEarlierVersions(t *testing.T) {
+	q, cleanup := newTestQueue(t, nil)
+	defer cleanup()
+	d := testDelivery("a.b")
+	old := filepath.Join(q.dir, "pending", "a_b.json")
+	data, _ := json.Marshal(d)
+	if err := ioutil.WriteFile(old, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := newEventQueue(q.dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Depth() != 1 || exists(old) || !exists(resumed.path("pending", d)) {
+		t.Errorf("entry of an earlier version was not picked up under its new name")
+	}
+}
@@ -0,0 +1,223 @@
+// Package ratelimit keeps GitHub API clients within their rate limits.
+//
+// Transport sits between the authenticating transport and the network. It
+// tracks the remaining quota of every set of credentials from the
+// X-RateLimit headers of their responses and holds requests back once it is
+// used up, waits out secondary (abuse) rate limits as GitHub asks with
+// Retry-After, and retries server errors with a backoff. Share one Transport
+// between the clients of a process, so that clients using the same
+// credentials draw on the one quota they really have.
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transport is a rate limit aware http.RoundTripper.
+type Transport struct {
+	// Base makes the requests, http.DefaultTransport if nil.
+	Base http.RoundTripper
+	// Reserve is the part of the quota that is never used up, left for
+	// people sharing the credentials.
+	Reserve int
+	// MaxRetries is how often a request is retried after a secondary rate
+	// limit or a server error.
+	MaxRetries int
+	// MaxWait is the budget of time a request may spend waiting for quota
+	// and between retries, after which its last response or an
+	// *ExhaustedError is returned.
+	MaxWait time.Duration
+
+	mu     sync.Mutex
+	quotas map[string]*quota
+}
+
+type quota struct {
+	remaining int
+	reset     time.Time
+}
+
+// ExhaustedError is returned when the quota of the credentials is used up
+// and it doesn't reset within the request's wait budget.
+type ExhaustedError struct {
+	Reset time.Time
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("GitHub rate limit exhausted until %s", e.Reset.Format(time.RFC3339))
+}
+
+// New returns a Transport with defaults suitable for a long running server:
+// a reserve of 50 requests, 3 retries and a minute of waiting per request.
+func New(base http.RoundTripper) *Transport {
+	return &Transport{
+		Base:       base,
+		Reserve:    50,
+		MaxRetries: 3,
+		MaxWait:    time.Minute,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	key := credentials(req)
+	deadline := time.Now().Add(t.MaxWait)
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if err := t.take(req, key, deadline); err != nil {
+			return nil, err
+		}
+		resp, err := base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		t.update(key, resp)
+		wait, retry := t.retryAfter(req, resp, backoff)
+		if !retry || attempt >= t.MaxRetries || time.Now().Add(wait).After(deadline) || !rewind(req) {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if err := sleep(req, wait); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+		// Retries after the first one need a fresh body
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r := new(http.Request)
+			*r = *req
+			r.Body = body
+			req = r
+		}
+	}
+}
+
+// retryAfter decides whether a response is worth retrying and after how long.
+func (t *Transport) retryAfter(req *http.Request, resp *http.Response, backoff time.Duration) (time.Duration, bool) {
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests:
+		// Secondary rate limits say how long to back off for
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		// The primary rate limit resets at a known time
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			if reset, ok := resetTime(resp); ok {
+				return time.Until(reset), true
+			}
+		}
+	case resp.StatusCode >= 500:
+		// Other requests may have been carried out before the server failed
+		if req.Method == "GET" || req.Method == "HEAD" || req.Method == "PUT" || req.Method == "DELETE" {
+			return backoff, true
+		}
+	}
+	return 0, false
+}
+
+// take uses up a request of the quota of the credentials, waiting for the
+// quota to reset if it has run out.
+func (t *Transport) take(req *http.Request, key string, deadline time.Time) error {
+	t.mu.Lock()
+	q := t.quotas[key]
+	if q == nil || q.remaining > t.Reserve || time.Now().After(q.reset) {
+		if q != nil {
+			q.remaining--
+		}
+		t.mu.Unlock()
+		return nil
+	}
+	reset := q.reset
+	t.mu.Unlock()
+	if reset.After(deadline) {
+		return &ExhaustedError{Reset: reset}
+	}
+	if err := sleep(req, time.Until(reset)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// update records the quota a response reports. Quotas that have reset since
+// are forgotten: every app JWT is a set of credentials of its own, which
+// would otherwise pile up.
+func (t *Transport) update(key string, resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, ok := resetTime(resp)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.quotas == nil {
+		t.quotas = make(map[string]*quota)
+	}
+	now := time.Now()
+	for k, q := range t.quotas {
+		if now.After(q.reset) {
+			delete(t.quotas, k)
+		}
+	}
+	t.quotas[key] = &quota{remaining: remaining, reset: reset}
+}
+
+// Remaining reports the last known quota of the credentials of a request,
+// -1 if none is known yet.
+func (t *Transport) Remaining(req *http.Request) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if q := t.quotas[credentials(req)]; q != nil {
+		return q.remaining
+	}
+	return -1
+}
+
+func resetTime(resp *http.Response) (time.Time, bool) {
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(reset, 0), true
+}
+
+// credentials identifies who a request is made as without keeping the token
+// around.
+func credentials(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// rewind reports whether a request can be sent again.
+func rewind(req *http.Request) bool {
+	return req.Body == nil || req.GetBody != nil
+}
+
+// sleep waits for d unless the request is cancelled first.
+func sleep(req *http.Request, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
@@ -0,0 +1,193 @@
+package ratelimit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer answers requests with respond and counts them.
+type countingServer struct {
+	*httptest.Server
+	requests int32
+}
+
+func newCountingServer(respond func(w http.ResponseWriter, r *http.Request, n int32)) *countingServer {
+	s := &countingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, atomic.AddInt32(&s.requests, 1))
+	}))
+	return s
+}
+
+func (s *countingServer) count() int32 {
+	return atomic.LoadInt32(&s.requests)
+}
+
+func send(t *testing.T, transport *Transport, method, url string) (*http.Response, error) {
+	var body io.Reader
+	if method != "GET" {
+		body = strings.NewReader(`{"name":"triage"}`)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "token secret")
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestSecondaryRateLimitIsRetriedAfterRetryAfter(t *testing.T) {
+	for _, code := range []int{http.StatusForbidden, http.StatusTooManyRequests} {
+		server := newCountingServer(func(w http.ResponseWriter, r *http.Request, n int32) {
+			if n == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(code)
+			}
+		})
+		resp, err := send(t, New(nil), "POST", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || server.count() != 2 {
+			t.Errorf("%d with Retry-After: got %d after %d requests, want 200 after 2", code, resp.StatusCode, server.count())
+		}
+		server.Close()
+	}
+}
+
+func TestForbiddenWithoutRateLimitIsNotRetried(t *testing.T) {
+	server := newCountingServer(func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer server.Close()
+	resp, err := send(t, New(nil), "GET", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden || server.count() != 1 {
+		t.Errorf("got %d after %d requests, want 403 after 1", resp.StatusCode, server.count())
+	}
+}
+
+func TestExhaustedQuotaWaitsForReset(t *testing.T) {
+	reset := time.Now().Add(time.Second).Truncate(time.Second).Add(time.Second)
+	server := newCountingServer(func(w http.ResponseWriter, r *http.Request, n int32) {
+		remaining := 0
+		if time.Now().After(reset) {
+			remaining = 4999
+		}
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	})
+	defer server.Close()
+	transport := New(nil)
+	transport.Reserve = 0
+	if _, err := send(t, transport, "GET", server.URL); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Authorization", "token secret")
+	if remaining := transport.Remaining(req); remaining != 0 {
+		t.Errorf("Remaining() = %d, want 0", remaining)
+	}
+	if _, err := send(t, transport, "GET", server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Before(reset) {
+		t.Errorf("request was sent before the quota reset at %v", reset)
+	}
+	// Other credentials have their own quota
+	req.Header.Set("Authorization", "token other")
+	if remaining := transport.Remaining(req); remaining != -1 {
+		t.Errorf("Remaining() of other credentials = %d, want -1", remaining)
+	}
+}
+
+func TestQuotasAreForgottenOnceReset(t *testing.T) {
+	reset := time.Now().Add(time.Second).Truncate(time.Second).Add(time.Second)
+	server := newCountingServer(func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	})
+	defer server.Close()
+	transport := New(nil)
+	request := func(token string) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// Every app JWT is different
+	request("jwt-1")
+	request("jwt-2")
+	time.Sleep(time.Until(reset.Add(time.Second)))
+	request("jwt-3")
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if len(transport.quotas) != 1 {
+		t.Errorf("%d quotas are tracked, want only the one reported last", len(transport.quotas))
+	}
+}
+
+func TestExhaustedQuotaBeyondMaxWait(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	server := newCountingServer(func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.Header().Set("X-RateLimit-Remaining", "10")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	})
+	defer server.Close()
+	transport := New(nil)
+	if _, err := send(t, transport, "GET", server.URL); err != nil {
+		t.Fatal(err)
+	}
+	// 10 requests left is within the reserve of 50
+	_, err := send(t, transport, "GET", server.URL)
+	if e, ok := err.(*ExhaustedError); !ok || e.Reset.Unix() != reset.Unix() {
+		t.Errorf("got %v, want an ExhaustedError until %v", err, reset)
+	}
+	if server.count() != 1 {
+		t.Errorf("%d requests were sent, want 1", server.count())
+	}
+}
+
+func TestServerErrorsAreRetried(t *testing.T) {
+	tests := []struct {
+		method   string
+		requests int32
+	}{
+		{"GET", 2},
+		{"PUT", 2},
+		{"DELETE", 2},
+		// They may have been carried out before the server failed
+		{"POST", 1},
+		{"PATCH", 1},
+	}
+	for _, tt := range tests {
+		server := newCountingServer(func(w http.ResponseWriter, r *http.Request, n int32) {
+			w.WriteHeader(http.StatusBadGateway)
+		})
+		transport := New(nil)
+		transport.MaxRetries = 1
+		resp, err := send(t, transport, tt.method, server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadGateway || server.count() != tt.requests {
+			t.Errorf("%s: got %d after %d requests, want 502 after %d", tt.method, resp.StatusCode, server.count(), tt.requests)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/seemethere/release-bot/paginate"
+	log "github.com/sirupsen/logrus"
+)
+
+// reconcileEvent is the event of the audit records of reconciliations, whose
+// delivery ID is the ID of the run.
+const reconcileEvent = "reconcile"
+
+// errNoBoards is returned when every board is to be reconciled but none are
+// configured, as when release-bot is set up with environment variables
+// alone: without a config it doesn't know which repositories it serves.
+var errNoBoards = errors.New("no repositories or organizations are configured to reconcile, add them to the -config file or name the board")
+
+// Sources of truth when a card's column and the release labels of its issue
+// disagree, set with reconcile in the repository settings.
+const (
+	// reconcileBoard makes the labels follow the column
+	reconcileBoard = "board"
+	// reconcileLabels moves, creates or removes the card to follow the labels
+	reconcileLabels = "labels"
+	// reconcileLatest goes with whichever of the two was changed last
+	reconcileLatest = "latest"
+)
+
+// reconcileChange is drift found between a project and the labels of an
+// issue, and how it was fixed.
+type reconcileChange struct {
+	Project string `json:"project"`
+	Issue   string `json:"issue"`
+	// Column is where the card is, empty if there is none
+	Column string   `json:"column,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+	Fix    string   `json:"fix"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// boardEntry is an issue or pull request on a release board along with its
+// card, if it has one, and the release labels it carries.
+type boardEntry struct {
+	ref    issueRef
+	card   *github.ProjectCard
+	column string
+	labels []string
+}
+
+// reconcileAll reconciles every configured board. Repositories tracked on
+// organization projects are reconciled along with their organization. A
+// board that fails doesn't keep the others from being reconciled.
+func (mon *githubMonitor) reconcileAll(ctx context.Context, d *delivery) ([]*reconcileChange, error) {
+	boards := mon.config.boards()
+	if len(boards) == 0 {
+		return nil, errNoBoards
+	}
+	var changes []*reconcileChange
+	var failed []string
+	for _, board := range boards {
+		owner, name := splitBoard(board)
+		boardChanges, err := mon.reconcile(ctx, owner, name, d)
+		changes = append(changes, boardChanges...)
+		if err != nil {
+			log.Errorf("%s Could not reconcile %s: %v", d.URI, board, err)
+			failed = append(failed, board)
+		}
+	}
+	if len(failed) > 0 {
+		return changes, fmt.Errorf("could not reconcile %s", strings.Join(failed, ", "))
+	}
+	return changes, nil
+}
+
+// reconcile makes the open release projects of owner/name, or of the
+// organization owner if name is empty, and the release labels of the issues
+// on them agree again.
+func (mon *githubMonitor) reconcile(ctx context.Context, owner, name string, d *delivery) ([]*reconcileChange, error) {
+	m, err := mon.forOwner(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	m.delivery = d
+	projects, err := m.openProjects(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*reconcileChange
+	grammar := m.config.grammarFor(owner, name)
+	reconciled := make(map[string]bool)
+	for _, project := range projects {
+		release, err := grammar.Parse(*project.Name)
+		if err != nil || reconciled[release.Prefix] {
+			continue
+		}
+		reconciled[release.Prefix] = true
+		// Labels go with the project getProject picks for their release
+		chosen, err := releaseProject(projects, grammar, release.Prefix)
+		if err != nil {
+			log.Warnf("%s Not reconciling %s: %v", m.delivery.URI, release.Prefix, err)
+			continue
+		}
+		if release, err = grammar.Parse(*chosen.Name); err != nil {
+			return changes, err
+		}
+		projectChanges, err := m.reconcileProject(ctx, owner, name, chosen, release)
+		changes = append(changes, projectChanges...)
+		if err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+func (mon *githubMonitor) reconcileProject(ctx context.Context, owner, name string, project *github.Project, release *Release) ([]*reconcileChange, error) {
+	wf := mon.config.workflowFor(owner, name)
+	entries, err := mon.boardEntries(ctx, owner, name, project, wf, release)
+	if err != nil {
+		return nil, err
+	}
+	// The handlers fixing the drift use the card index
+	mon.cards.forget(*project.ID)
+	var changes []*reconcileChange
+	for _, e := range entries {
+		suffix, tracked := wf.labelSuffix(e.column)
+		if e.card != nil && !tracked {
+			// Columns outside of the workflow have no label to agree with
+			continue
+		}
+		expected := fmt.Sprintf("%s/%s", release.Prefix, suffix)
+		if e.card != nil && len(e.labels) == 1 && e.labels[0] == expected {
+			continue
+		}
+		change := &reconcileChange{
+			Project: *project.Name,
+			Issue:   fmt.Sprintf("%s/%s#%d", e.ref.Owner, e.ref.Repo, e.ref.Number),
+			Column:  e.column,
+			Labels:  e.labels,
+		}
+		if err := mon.fixEntry(ctx, owner, name, e, release, wf, expected, change); err != nil {
+			change.Error = err.Error()
+			log.Errorf("%s Could not reconcile %s in %s: %v", mon.delivery.URI, change.Issue, change.Project, err)
+		} else {
+			log.Infof("%s %s in %s: %s", mon.delivery.URI, change.Issue, change.Project, change.Fix)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// fixEntry fixes the drift of an entry while no delivery about its issue or
+// card is handled, as if the fix were a delivery of its own.
+func (mon *githubMonitor) fixEntry(ctx context.Context, owner, name string, e *boardEntry, release *Release, wf *workflow, expected string, change *reconcileChange) error {
+	keys := []string{issueKey(e.ref.Owner, e.ref.Repo, e.ref.Number)}
+	if e.card != nil {
+		keys = append(keys, cardKey(*e.card.ID))
+	}
+	mon.queue.lock(keys)
+	defer mon.queue.unlock(keys)
+	return mon.fixDrift(ctx, owner, name, e, release, wf, expected, change)
+}
+
+// fixDrift brings the card and the labels of an entry back in line, going
+// with the board or the labels as configured.
+func (mon *githubMonitor) fixDrift(ctx context.Context, owner, name string, e *boardEntry, release *Release, wf *workflow, expected string, change *reconcileChange) error {
+	boardWins, err := mon.boardWins(ctx, owner, name, e, release)
+	if err != nil {
+		return err
+	}
+	if boardWins {
+		change.Fix = fmt.Sprintf("labeled %s", expected)
+		return mon.syncLabels(ctx, e.ref.Owner, e.ref.Repo, e.ref.Number, release.Prefix, wf, e.column)
+	}
+	item, _, err := mon.getItem(ctx, e.ref)
+	if err != nil {
+		return err
+	}
+	if len(e.labels) == 0 {
+		change.Fix = fmt.Sprintf("removed card from %s", e.column)
+		return mon.handleUnlabelEvent(item, expected, mon.delivery)
+	}
+	// Of several labels the one furthest along the workflow wins
+	label := e.labels[len(e.labels)-1]
+	_, suffix, _ := mon.config.grammarFor(owner, name).ParseLabel(label)
+	column := wf.columnName(suffix)
+	if e.card == nil {
+		change.Fix = fmt.Sprintf("added card to %s", column)
+	} else {
+		change.Fix = fmt.Sprintf("moved card to %s", column)
+	}
+	if err := mon.handleLabelEvent(item, label, mon.delivery); err != nil {
+		return err
+	}
+	if len(e.labels) > 1 {
+		change.Fix += fmt.Sprintf(", labeled %s", label)
+		return mon.syncLabels(ctx, e.ref.Owner, e.ref.Repo, e.ref.Number, release.Prefix, wf, column)
+	}
+	return nil
+}
+
+// boardWins decides whether the column of an entry's card or its labels are
+// right.
+func (mon *githubMonitor) boardWins(ctx context.Context, owner, name string, e *boardEntry, release *Release) (bool, error) {
+	if e.card == nil {
+		return false, nil
+	}
+	switch mon.config.reconcileFor(owner, name) {
+	case reconcileBoard:
+		return true, nil
+	case reconcileLabels:
+		return false, nil
+	}
+	// A card that was never labeled keeps its column
+	labeled, err := mon.lastLabeled(ctx, e.ref, release.Prefix)
+	if err != nil {
+		return false, err
+	}
+	return e.card.UpdatedAt != nil && e.card.UpdatedAt.After(labeled), nil
+}
+
+// lastLabeled returns when a label of the release was last added to or
+// removed from an issue.
+func (mon *githubMonitor) lastLabeled(ctx context.Context, ref issueRef, prefix string) (time.Time, error) {
+	var last time.Time
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		events, resp, err := mon.client.Issues.ListIssueEvents(ctx, ref.Owner, ref.Repo, ref.Number, listPage(page))
+		if err != nil {
+			return 0, err
+		}
+		for _, event := range events {
+			if event.Label == nil || event.Label.Name == nil || !strings.HasPrefix(*event.Label.Name, prefix+"/") {
+				continue
+			}
+			if (*event.Event == "labeled" || *event.Event == "unlabeled") && event.CreatedAt.After(last) {
+				last = *event.CreatedAt
+			}
+		}
+		return resp.NextPage, nil
+	})
+	return last, err
+}
+
+// boardEntries collects the cards of a release project and the issues and
+// pull requests carrying a label of the release, in the repositories tracked
+// on the project.
+func (mon *githubMonitor) boardEntries(ctx context.Context, owner, name string, project *github.Project, wf *workflow, release *Release) ([]*boardEntry, error) {
+	entries := make(map[string]*boardEntry)
+	var order []string
+	entry := func(contentURL string) (*boardEntry, error) {
+		if e := entries[contentURL]; e != nil {
+			return e, nil
+		}
+		issueOwner, issueRepo, number, err := contentIssue(contentURL)
+		if err != nil {
+			return nil, err
+		}
+		e := &boardEntry{ref: issueRef{issueOwner, issueRepo, number}}
+		entries[contentURL] = e
+		order = append(order, contentURL)
+		return e, nil
+	}
+	columns, err := mon.projectColumns(ctx, *project.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range columns {
+		cards, err := mon.columnCards(ctx, *column.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, card := range cards {
+			if card.ContentURL == nil {
+				continue
+			}
+			e, err := entry(*card.ContentURL)
+			if err != nil {
+				return nil, err
+			}
+			e.card, e.column = card, *column.Name
+		}
+	}
+	var repos []string
+	if name != "" {
+		repos = []string{fmt.Sprintf("%s/%s", owner, name)}
+	} else if oc := mon.config.organization(owner); oc != nil {
+		repos = oc.Repositories
+	}
+	// Labels are listed in workflow order so the last one of an issue is the
+	// one furthest along
+	for _, label := range wf.labels(release.Prefix) {
+		for _, repo := range repos {
+			repoOwner, repoName := splitBoard(repo)
+			err := paginate.Pages(ctx, func(page int) (int, error) {
+				opt := &github.IssueListByRepoOptions{State: "all", Labels: []string{label}, ListOptions: *listPage(page)}
+				issues, resp, err := mon.client.Issues.ListByRepo(ctx, repoOwner, repoName, opt)
+				if err != nil {
+					return 0, err
+				}
+				for _, issue := range issues {
+					e, err := entry(*issue.URL)
+					if err != nil {
+						return 0, err
+					}
+					e.labels = append(e.labels, label)
+				}
+				return resp.NextPage, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	result := make([]*boardEntry, 0, len(order))
+	for _, contentURL := range order {
+		result = append(result, entries[contentURL])
+	}
+	return result, nil
+}
+
+// newReconcileDelivery makes up the delivery changes of a reconciliation run
+// are recorded under.
+func newReconcileDelivery() *delivery {
+	d := &delivery{Event: reconcileEvent, Received: time.Now()}
+	d.ID = fmt.Sprintf("reconcile-%d", d.Received.UnixNano())
+	d.URI = d.ID
+	return d
+}
+
+// reconcileEvery reconciles every configured board on a schedule.
+func (mon *githubMonitor) reconcileEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(mon.ctx, interval)
+		changes, err := mon.reconcileAll(ctx, newReconcileDelivery())
+		cancel()
+		if err != nil {
+			log.Errorf("Reconciling failed: %v", err)
+		}
+		log.Infof("Reconciled boards, %d change(s)", len(changes))
+	}
+}
+
+// handleReconcile reconciles the board given as board=owner/name or
+// board=org, or every configured one, writing the changes as JSON lines. When
+// a board can't be reconciled the status is 502 and the changes made so far
+// are followed by a last line {"error": "..."}.
+func (mon *githubMonitor) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if !mon.authorized(w, r) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(mon.ctx, 30*time.Minute)
+	defer cancel()
+	d := newReconcileDelivery()
+	var changes []*reconcileChange
+	var err error
+	if board := r.URL.Query().Get("board"); board != "" {
+		owner, name := splitBoard(board)
+		changes, err = mon.reconcile(ctx, owner, name, d)
+	} else {
+		changes, err = mon.reconcileAll(ctx, d)
+	}
+	if err == errNoBoards {
+		http.Error(w, "No boards are configured, name one with board=owner/name or board=org", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Reconcile-ID", d.ID)
+	if err != nil {
+		log.Errorf("%s Could not reconcile: %v", r.URL, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	enc := json.NewEncoder(w)
+	for _, change := range changes {
+		enc.Encode(change)
+	}
+	if err != nil {
+		enc.Encode(map[string]string{"error": err.Error()})
+	}
+}
+
+// reconcileCommand reconciles the given boards, or every configured one, and
+// prints what it changed. Combine with -dry-run to only see the drift:
+//
+//	release-bot [-dry-run] reconcile [<owner/name|org>...]
+func reconcileCommand(mon *githubMonitor, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	flags.Parse(args)
+	boards := flags.Args()
+	if len(boards) == 0 {
+		boards = mon.config.boards()
+	}
+	if len(boards) == 0 {
+		return fmt.Errorf("%v: release-bot reconcile <owner/name|org>...", errNoBoards)
+	}
+	ctx, cancel := context.WithTimeout(mon.ctx, 30*time.Minute)
+	defer cancel()
+	d := newReconcileDelivery()
+	for _, board := range boards {
+		owner, name := splitBoard(board)
+		changes, err := mon.reconcile(ctx, owner, name, d)
+		for _, c := range changes {
+			status := c.Fix
+			if c.Error != "" {
+				status = fmt.Sprintf("%s failed: %s", c.Fix, c.Error)
+			}
+			fmt.Fprintf(os.Stdout, "%s\t%s\t%s\t[%s]\t%s\n", c.Project, c.Issue, c.Column, strings.Join(c.Labels, " "), status)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", board, err)
+		}
+	}
+	return nil
+}
+
+// boards returns the configured boards: organizations and the repositories
+// that have projects of their own.
+func (cfg *config) boards() []string {
+	var boards []string
+	for repo := range cfg.Repositories {
+		owner, name := splitBoard(repo)
+		if cfg.projectOrg(owner, name) == "" {
+			boards = append(boards, repo)
+		}
+	}
+	for org := range cfg.Organizations {
+		boards = append(boards, org)
+	}
+	sort.Strings(boards)
+	return boards
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestConfigBoards(t *testing.T) {
+	path, cleanup := writeConfig(t, `{
+		"repositories": {"docker/cli": {}, "docker/docker": {}, "moby/moby": {}},
+		"organizations": {"docker": {"repositories": ["docker/docker"]}}
+	}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// docker/docker is on the projects of its organization
+	want := []string{"docker", "docker/cli", "moby/moby"}
+	if got := cfg.boards(); !reflect.DeepEqual(got, want) {
+		t.Errorf("boards() = %v, want %v", got, want)
+	}
+}
+
+func TestConfigReconcileFor(t *testing.T) {
+	path, cleanup := writeConfig(t, `{
+		"repositories": {"docker/cli": {"reconcile": "board"}},
+		"organizations": {"docker": {"reconcile": "labels", "repositories": ["docker/cli", "docker/docker"]}}
+	}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		owner, name string
+		want        string
+	}{
+		{"docker", "cli", reconcileBoard},
+		{"docker", "docker", reconcileLabels},
+		{"moby", "moby", reconcileLatest},
+	}
+	for _, tt := range tests {
+		if got := cfg.reconcileFor(tt.owner, tt.name); got != tt.want {
+			t.Errorf("reconcileFor(%s, %s) = %s, want %s", tt.owner, tt.name, got, tt.want)
+		}
+	}
+	path, cleanup = writeConfig(t, `{"repositories": {"docker/cli": {"reconcile": "newest"}}}`)
+	defer cleanup()
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "reconcile must be") {
+		t.Errorf("loadConfig() with reconcile newest = %v, want an error", err)
+	}
+}
+
+// reconcileResponses is a board where the card of #1 is in Triage without a
+// label, #2 is labeled cherry-pick without a card, #3 agrees and #4 is in a
+// column outside of the workflow.
+func reconcileResponses() map[string]fakeResponse {
+	issue := func(number string) string {
+		return `{"id":10` + number + `,"number":` + number + `,"url":"https://api.github.com/repos/docker/cli/issues/` + number + `"}`
+	}
+	card := func(id, number string) string {
+		return `{"id":` + id + `,"content_url":"https://api.github.com/repos/docker/cli/issues/` + number + `"}`
+	}
+	return map[string]fakeResponse{
+		"GET /repos/docker/cli/projects": {body: `[{"id":2,"name":"17.06.1-ee-1-rc1"},{"id":3,"name":"roadmap"}]`},
+		"GET /projects/2/columns":        {body: `[{"id":21,"name":"Triage"},{"id":22,"name":"Cherry Pick"},{"id":23,"name":"Backlog"}]`},
+		"GET /projects/columns/21/cards": {body: `[` + card("31", "1") + `]`},
+		"GET /projects/columns/22/cards": {body: `[` + card("33", "3") + `]`},
+		"GET /projects/columns/23/cards": {body: `[` + card("34", "4") + `]`},
+		"GET /repos/docker/cli/issues":   {body: `[]`},
+		"GET /repos/docker/cli/issues?labels=17.06.1-ee-1%2Fcherry-pick&per_page=100&state=all": {body: `[` + issue("3") + `,` + issue("2") + `]`},
+		"GET /repos/docker/cli/issues/1":         {body: issue("1")},
+		"GET /repos/docker/cli/issues/2":         {body: issue("2")},
+		"GET /repos/docker/cli/issues/1/labels":  {body: `[]`},
+		"GET /repos/docker/cli/issues/2/labels":  {body: `[{"name":"17.06.1-ee-1/cherry-pick"}]`},
+		"POST /repos/docker/cli/issues/1/labels": {body: `[{"name":"17.06.1-ee-1/triage"}]`},
+		"POST /projects/columns/22/cards":        {code: http.StatusCreated, body: card("35", "2")},
+		"DELETE /projects/columns/cards/31":      {code: http.StatusNoContent},
+	}
+}
+
+// newReconcileMonitor returns a monitor talking to fake, configured to
+// reconcile docker/cli with the board or the labels winning.
+func newReconcileMonitor(t *testing.T, fake *fakeGitHub, mode string) (*githubMonitor, func()) {
+	path, cleanup := writeConfig(t, `{"repositories": {"docker/cli": {"reconcile": "`+mode+`"}}}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, cleanupAudit := newTestAuditLog(t)
+	stats := newMetrics()
+	clients, err := newClientSource(context.Background(), fake.URL+"/", "token", nil, 0, stats)
+	if err != nil {
+		cleanupAudit()
+		t.Fatal(err)
+	}
+	return &githubMonitor{
+		ctx:        context.Background(),
+		adminToken: []byte("admin"),
+		clients:    clients,
+		config:     cfg,
+		metrics:    stats,
+		audit:      audit,
+		cards:      newCardIndex(time.Hour),
+	}, cleanupAudit
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		mode    string
+		fixes   []string
+		changes []string
+	}{
+		{
+			reconcileBoard,
+			[]string{"docker/cli#1: labeled 17.06.1-ee-1/triage", "docker/cli#2: added card to Cherry Pick"},
+			[]string{"POST /repos/docker/cli/issues/1/labels", "POST /projects/columns/22/cards"},
+		},
+		{
+			reconcileLabels,
+			[]string{"docker/cli#1: removed card from Triage", "docker/cli#2: added card to Cherry Pick"},
+			[]string{"DELETE /projects/columns/cards/31", "POST /projects/columns/22/cards"},
+		},
+	}
+	for _, tt := range tests {
+		fake := newFakeGitHub(reconcileResponses())
+		mon, cleanup := newReconcileMonitor(t, fake, tt.mode)
+		d := newReconcileDelivery()
+		changes, err := mon.reconcileAll(context.Background(), d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fixes []string
+		for _, c := range changes {
+			if c.Project != "17.06.1-ee-1-rc1" || c.Error != "" {
+				t.Errorf("%s: change %+v", tt.mode, c)
+			}
+			fixes = append(fixes, c.Issue+": "+c.Fix)
+		}
+		if !reflect.DeepEqual(fixes, tt.fixes) {
+			t.Errorf("%s: reconcileAll() fixed %q, want %q", tt.mode, fixes, tt.fixes)
+		}
+		var sent []string
+		for _, request := range fake.sent() {
+			if !strings.HasPrefix(request, "GET ") {
+				sent = append(sent, request)
+			}
+		}
+		if !reflect.DeepEqual(sent, tt.changes) {
+			t.Errorf("%s: reconcileAll() changed %v, want %v", tt.mode, sent, tt.changes)
+		}
+		// The changes are audited under the run's ID
+		records, err := mon.audit.query(&auditFilter{Delivery: d.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 2 || records[0].Event != reconcileEvent {
+			t.Errorf("%s: audit log has %+v for the run", tt.mode, records)
+		}
+		cleanup()
+		fake.Close()
+	}
+}
+
+func TestBoardWins(t *testing.T) {
+	labeled := time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"GET /repos/docker/cli/issues/1/events": {body: `[
+			{"event":"labeled","label":{"name":"17.06.1-ee-1/triage"},"created_at":"2017-08-01T12:00:00Z"},
+			{"event":"labeled","label":{"name":"17.06.2-ee-1/triage"},"created_at":"2017-08-02T12:00:00Z"},
+			{"event":"closed","created_at":"2017-08-03T12:00:00Z"}
+		]`},
+	})
+	defer fake.Close()
+	release := &Release{Prefix: "17.06.1-ee-1"}
+	entry := func(updated time.Time) *boardEntry {
+		return &boardEntry{ref: issueRef{"docker", "cli", 1}, card: &github.ProjectCard{UpdatedAt: &github.Timestamp{Time: updated}}}
+	}
+	tests := []struct {
+		name  string
+		mode  string
+		entry *boardEntry
+		want  bool
+	}{
+		{"no card", reconcileBoard, &boardEntry{ref: issueRef{"docker", "cli", 1}}, false},
+		{"board", reconcileBoard, entry(labeled.Add(-time.Hour)), true},
+		{"labels", reconcileLabels, entry(labeled.Add(time.Hour)), false},
+		{"card moved last", reconcileLatest, entry(labeled.Add(time.Hour)), true},
+		{"labeled last", reconcileLatest, entry(labeled.Add(-time.Hour)), false},
+	}
+	for _, tt := range tests {
+		mon, cleanup := newReconcileMonitor(t, fake, tt.mode)
+		mon.client = mon.clients.forToken("token", false)
+		got, err := mon.boardWins(context.Background(), "docker", "cli", tt.entry, release)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: boardWins() = %v, want %v", tt.name, got, tt.want)
+		}
+		cleanup()
+	}
+}
+
+func TestHandleReconcile(t *testing.T) {
+	fake := newFakeGitHub(reconcileResponses())
+	defer fake.Close()
+	mon, cleanup := newReconcileMonitor(t, fake, reconcileBoard)
+	defer cleanup()
+	r := httptest.NewRequest("POST", "/reconcile?board=docker/cli", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	mon.handleReconcile(w, r)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("X-Reconcile-ID"), "reconcile-") {
+		t.Errorf("responded %d with ID %q", w.Code, w.Header().Get("X-Reconcile-ID"))
+	}
+	if changes := strings.Count(w.Body.String(), "\n"); changes != 2 {
+		t.Errorf("got %d changes, want 2:\n%s", changes, w.Body.String())
+	}
+}
+
+func TestHandleReconcileFailure(t *testing.T) {
+	responses := reconcileResponses()
+	delete(responses, "GET /projects/2/columns")
+	fake := newFakeGitHub(responses)
+	defer fake.Close()
+	mon, cleanup := newReconcileMonitor(t, fake, reconcileBoard)
+	defer cleanup()
+	r := httptest.NewRequest("POST", "/reconcile?board=docker/cli", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	mon.handleReconcile(w, r)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusBadGateway || !strings.HasPrefix(lines[len(lines)-1], `{"error":`) {
+		t.Errorf("responded %d with %s, want 502 ending in an error", w.Code, w.Body.String())
+	}
+}
+
+func TestReconcileWithoutBoards(t *testing.T) {
+	fake := newFakeGitHub(reconcileResponses())
+	defer fake.Close()
+	mon, cleanup := newReconcileMonitor(t, fake, reconcileBoard)
+	defer cleanup()
+	// Set up with environment variables alone
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.config = cfg
+	if _, err := mon.reconcileAll(context.Background(), newReconcileDelivery()); err != errNoBoards {
+		t.Errorf("reconcileAll() = %v, want %v", err, errNoBoards)
+	}
+	if err := reconcileCommand(mon, nil); err == nil || !strings.Contains(err.Error(), "no repositories or organizations") {
+		t.Errorf("reconcileCommand() = %v, want an error naming what is missing", err)
+	}
+	r := httptest.NewRequest("POST", "/reconcile", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	mon.handleReconcile(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "board=owner/name") {
+		t.Errorf("responded %d with %s, want 400 asking for a board", w.Code, w.Body.String())
+	}
+	// A named board can still be reconciled
+	r = httptest.NewRequest("POST", "/reconcile?board=docker/cli", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	mon.handleReconcile(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("reconciling docker/cli responded %d: %s", w.Code, w.Body.String())
+	}
+	if len(fake.sent()) == 0 {
+		t.Errorf("docker/cli was not reconciled")
+	}
+}
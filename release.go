@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// releasePresets are the release name grammars that can be referred to by
+// name from the config instead of spelling out a pattern.
+var releasePresets = map[string]string{
+	// 17.06.1-ee-1-rc3, 17.07.0-ce-rc1, 17.06.2-ee-5
+	"docker": `^(?P<version>\d+\.\d+(?:\.\d+)?)(?:-(?P<edition>ce|ee))?(?:-(?P<build>\d+))?(?:-(?P<stage>(?:rc|tp|beta)\d*))?$`,
+	// v1.4.0-rc.2, 1.4.0, 1.4.0-beta.1+build.5
+	"semver": `^(?P<version>v?\d+\.\d+\.\d+)(?:-(?P<stage>(?:alpha|beta|rc)(?:\.?\d+)?))?(?:\+(?P<build>[0-9A-Za-z.-]+))?$`,
+	// 2017.10, 2017.10.1-rc1, 2017.10.1-beta.2
+	"calver": `^(?P<version>\d{4}\.\d{1,2}(?:\.\d+)?)(?:-(?P<stage>(?:alpha|beta|rc)\.?\d*))?$`,
+}
+
+// Release is a project name split into its parts. The label prefix of a
+// release is its name without the pre-release stage, so every release
+// candidate of 17.06.1-ee-1 shares the 17.06.1-ee-1/{action} labels.
+type Release struct {
+	Name    string
+	Version string
+	Edition string
+	Build   string
+	Stage   string
+	Prefix  string
+}
+
+// releaseGrammar parses project names into releases. Patterns must have a
+// "version" group and may have "edition", "build" and "stage" groups.
+type releaseGrammar struct {
+	pattern *regexp.Regexp
+}
+
+// newReleaseGrammar takes either the name of a preset or a pattern.
+func newReleaseGrammar(pattern string) (*releaseGrammar, error) {
+	if pattern == "" {
+		pattern = "docker"
+	}
+	if preset, ok := releasePresets[pattern]; ok {
+		pattern = preset
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	hasVersion := false
+	for _, group := range re.SubexpNames() {
+		switch group {
+		case "version":
+			hasVersion = true
+		case "", "edition", "build", "stage":
+		default:
+			return nil, fmt.Errorf("unknown group %q in release pattern", group)
+		}
+	}
+	if !hasVersion {
+		return nil, fmt.Errorf("release pattern %q has no version group", pattern)
+	}
+	return &releaseGrammar{pattern: re}, nil
+}
+
+// Parse splits a project name into a release.
+func (g *releaseGrammar) Parse(name string) (*Release, error) {
+	match := g.pattern.FindStringSubmatchIndex(name)
+	if match == nil {
+		return nil, fmt.Errorf("%q is not a release name", name)
+	}
+	release := &Release{Name: name, Prefix: name}
+	for i, group := range g.pattern.SubexpNames() {
+		start, end := match[2*i], match[2*i+1]
+		if group == "" || start < 0 {
+			continue
+		}
+		value := name[start:end]
+		switch group {
+		case "version":
+			release.Version = value
+		case "edition":
+			release.Edition = value
+		case "build":
+			release.Build = value
+		case "stage":
+			release.Stage = value
+			// Cut the stage and the separator in front of it out of the name
+			release.Prefix = strings.TrimRight(name[:start], "-._") + name[end:]
+		}
+	}
+	return release, nil
+}
+
+// stageRanks orders the kinds of pre-releases, a release without a stage
+// coming after all of them.
+var stageRanks = map[string]int{"alpha": 1, "tp": 2, "beta": 3, "rc": 4, "": 5}
+
+var stagePattern = regexp.MustCompile(`^([a-z]*)[.-]?(\d*)$`)
+
+// compareStages orders two pre-release stages of a release, like rc2 before
+// rc10 and beta3 before rc1. It returns false if they can't be told apart or
+// compared.
+func compareStages(a, b string) (int, bool) {
+	aRank, aNumber, ok := stageOrder(a)
+	if !ok {
+		return 0, false
+	}
+	bRank, bNumber, ok := stageOrder(b)
+	switch {
+	case !ok:
+		return 0, false
+	case aRank != bRank:
+		return aRank - bRank, true
+	case aNumber != bNumber:
+		return aNumber - bNumber, true
+	}
+	return 0, false
+}
+
+func stageOrder(stage string) (int, int, bool) {
+	match := stagePattern.FindStringSubmatch(strings.ToLower(stage))
+	if match == nil {
+		return 0, 0, false
+	}
+	rank, ok := stageRanks[match[1]]
+	if !ok {
+		return 0, 0, false
+	}
+	number := 0
+	if match[2] != "" {
+		number, _ = strconv.Atoi(match[2])
+	}
+	return rank, number, true
+}
+
+// Format fills the {name}, {prefix}, {version}, {edition} and {build}
+// placeholders of a template, like the release_branch setting.
+func (r *Release) Format(template string) string {
+	return strings.NewReplacer(
+		"{name}", r.Name,
+		"{prefix}", r.Prefix,
+		"{version}", r.Version,
+		"{edition}", r.Edition,
+		"{build}", r.Build,
+	).Replace(template)
+}
+
+// ParseLabel splits a {release}/{action} label and checks that the release
+// part is a release label prefix.
+func (g *releaseGrammar) ParseLabel(label string) (string, string, error) {
+	prefix, action, err := splitLabel(label)
+	if err != nil {
+		return "", "", err
+	}
+	release, err := g.Parse(prefix)
+	if err != nil {
+		return "", "", err
+	}
+	if release.Prefix != prefix {
+		return "", "", fmt.Errorf("label %q names a pre-release instead of a release", label)
+	}
+	return prefix, action, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestReleaseGrammarParse(t *testing.T) {
+	tests := []struct {
+		grammar string
+		name    string
+		want    *Release
+	}{
+		{"docker", "17.06.1-ee-1-rc3", &Release{Name: "17.06.1-ee-1-rc3", Version: "17.06.1", Edition: "ee", Build: "1", Stage: "rc3", Prefix: "17.06.1-ee-1"}},
+		{"docker", "17.07.0-ce-rc1", &Release{Name: "17.07.0-ce-rc1", Version: "17.07.0", Edition: "ce", Stage: "rc1", Prefix: "17.07.0-ce"}},
+		{"docker", "17.06.2-ee-5", &Release{Name: "17.06.2-ee-5", Version: "17.06.2", Edition: "ee", Build: "5", Prefix: "17.06.2-ee-5"}},
+		{"docker", "17.06", &Release{Name: "17.06", Version: "17.06", Prefix: "17.06"}},
+		{"docker", "Backlog", nil},
+		{"docker", "17.06.1-ee-1-rc3 (old)", nil},
+		{"semver", "v1.4.0-rc.2", &Release{Name: "v1.4.0-rc.2", Version: "v1.4.0", Stage: "rc.2", Prefix: "v1.4.0"}},
+		{"semver", "1.4.0-beta.1+build.5", &Release{Name: "1.4.0-beta.1+build.5", Version: "1.4.0", Build: "build.5", Stage: "beta.1", Prefix: "1.4.0+build.5"}},
+		{"semver", "1.4", nil},
+		{"calver", "2017.10.1-beta.2", &Release{Name: "2017.10.1-beta.2", Version: "2017.10.1", Stage: "beta.2", Prefix: "2017.10.1"}},
+		{"calver", "2017.10", &Release{Name: "2017.10", Version: "2017.10", Prefix: "2017.10"}},
+		{`^release-(?P<version>\d+)(?:-(?P<stage>rc\d+))?$`, "release-42-rc1", &Release{Name: "release-42-rc1", Version: "42", Stage: "rc1", Prefix: "release-42"}},
+	}
+	for _, tt := range tests {
+		grammar, err := newReleaseGrammar(tt.grammar)
+		if err != nil {
+			t.Fatalf("newReleaseGrammar(%q): %v", tt.grammar, err)
+		}
+		got, err := grammar.Parse(tt.name)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: Parse(%q) = %+v, want an error", tt.grammar, tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Parse(%q): %v", tt.grammar, tt.name, err)
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("%s: Parse(%q) = %+v, want %+v", tt.grammar, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewReleaseGrammarRejectsBadPatterns(t *testing.T) {
+	for _, pattern := range []string{
+		`^(\d+)$`,
+		`^(?P<version>\d+)-(?P<flavor>\w+)$`,
+		`^(?P<version>\d+`,
+	} {
+		if _, err := newReleaseGrammar(pattern); err == nil {
+			t.Errorf("newReleaseGrammar(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestReleaseGrammarParseLabel(t *testing.T) {
+	tests := []struct {
+		label  string
+		prefix string
+		action string
+		ok     bool
+	}{
+		{"17.06.1-ee-1/triage", "17.06.1-ee-1", "triage", true},
+		{"17.07.0-ce/cherry-pick", "17.07.0-ce", "cherry-pick", true},
+		// Labels name the release, not one of its release candidates
+		{"17.06.1-ee-1-rc3/triage", "", "", false},
+		{"triage", "", "", false},
+		{"17.06.1-ee-1/triage/extra", "", "", false},
+		{"area/networking", "", "", false},
+	}
+	grammar, err := newReleaseGrammar("docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		prefix, action, err := grammar.ParseLabel(tt.label)
+		if ok := err == nil; ok != tt.ok || prefix != tt.prefix || action != tt.action {
+			t.Errorf("ParseLabel(%q) = %q, %q, %v, want %q, %q, ok %v", tt.label, prefix, action, err, tt.prefix, tt.action, tt.ok)
+		}
+	}
+}
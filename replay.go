@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordedDelivery is a webhook delivery as it was received, its signature
+// checked.
+type recordedDelivery struct {
+	Received time.Time   `json:"received"`
+	Method   string      `json:"method"`
+	URI      string      `json:"uri"`
+	Header   http.Header `json:"header"`
+	Body     string      `json:"body"`
+}
+
+// deliveryRecorder writes webhook deliveries to a directory, one file per
+// delivery named so they sort in the order they were received.
+type deliveryRecorder struct {
+	dir string
+}
+
+func newDeliveryRecorder(dir string) (*deliveryRecorder, error) {
+	// Deliveries carry their signature and whatever the payload holds
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &deliveryRecorder{dir: dir}, nil
+}
+
+// record writes a delivery whose signature was checked, body being what was
+// signed.
+func (rec *deliveryRecorder) record(r *http.Request, body []byte) {
+	if rec == nil {
+		return
+	}
+	d := &recordedDelivery{
+		Received: time.Now(),
+		Method:   r.Method,
+		URI:      r.RequestURI,
+		Header:   r.Header,
+		Body:     string(body),
+	}
+	name := fmt.Sprintf("%020d-%s.json", d.Received.UnixNano(), safeFileName(github.DeliveryID(r)))
+	if data, err := json.Marshal(d); err != nil {
+		log.Errorf("%s Could not encode recording: %v", r.RequestURI, err)
+	} else if err := ioutil.WriteFile(filepath.Join(rec.dir, name), data, 0600); err != nil {
+		log.Errorf("%s Could not record delivery: %v", r.RequestURI, err)
+	}
+}
+
+// loadRecordings reads the recorded deliveries in the files and directories
+// of paths, in the order they were received.
+func loadRecordings(paths []string) ([]*recordedDelivery, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	var recordings []*recordedDelivery
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		rec := &recordedDelivery{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", file, err)
+		}
+		recordings = append(recordings, rec)
+	}
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].Received.Before(recordings[j].Received)
+	})
+	return recordings, nil
+}
+
+// webhookSecrets are the secrets deliveries to uri may be signed with, the
+// first one being the one to sign with.
+func (mon *githubMonitor) webhookSecrets(uri string) [][]byte {
+	bits := strings.Split(strings.Trim(strings.SplitN(uri, "?", 2)[0], "/"), "/")
+	var settings *repoConfig
+	if len(bits) == 1 {
+		if oc := mon.config.organization(bits[0]); oc != nil {
+			settings = &oc.repoConfig
+		}
+	} else {
+		settings = mon.config.repository(strings.Join(bits[:len(bits)-1], "/"), bits[len(bits)-1])
+	}
+	return mon.secretsFor(settings)
+}
+
+// request rebuilds the recorded delivery as it was signed.
+func (rec *recordedDelivery) request() *http.Request {
+	r := httptest.NewRequest(rec.Method, rec.URI, strings.NewReader(rec.Body))
+	for name, values := range rec.Header {
+		r.Header[name] = values
+	}
+	return r
+}
+
+// resign rebuilds the recorded delivery signed with secret, once its original
+// signature is checked against any of verify. A delivery that couldn't be
+// delivered live can't be replayed either.
+func (rec *recordedDelivery) resign(verify [][]byte, secret []byte) (*http.Request, error) {
+	if _, _, err := validatePayload(rec.request(), verify); err != nil {
+		return nil, err
+	}
+	r := rec.request()
+	sign := func(header string, prefix string, h func() hash.Hash) {
+		mac := hmac.New(h, secret)
+		mac.Write([]byte(rec.Body))
+		r.Header.Set(header, prefix+hex.EncodeToString(mac.Sum(nil)))
+	}
+	sign("X-Hub-Signature", "sha1=", sha1.New)
+	if r.Header.Get("X-Hub-Signature-256") != "" {
+		sign("X-Hub-Signature-256", "sha256=", sha256.New)
+	}
+	return r, nil
+}
+
+// replayCommand feeds recorded deliveries through the webhook handlers one
+// after the other, re-signed with the secret now configured for them:
+//
+//	release-bot [-github-url url] [-dry-run] replay [-speed n] [-secret s] [-audit-log file] <recording|dir>...
+//
+// Only deliveries whose recorded signature checks out against the configured
+// secrets, or -secret if they were recorded before it was rotated, are
+// replayed.
+//
+// Point -github-url at a fake GitHub, or use -dry-run, to replay without
+// touching the real boards. The changes a replay makes are audited to its own
+// -audit-log, if any, so they don't end up mixed with the server's.
+func replayCommand(mon *githubMonitor, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 0, "Replay at this multiple of the recorded pace, 0 for as fast as possible")
+	secret := flags.String("secret", "", "Check recorded signatures against this secret instead of the configured ones")
+	auditLogFile := flags.String("audit-log", "", "File to append a JSON line to for every change made by the replay, empty to turn off")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: release-bot replay [-speed n] [-secret s] [-audit-log file] <recording|dir>...")
+	}
+	recordings, err := loadRecordings(flags.Args())
+	if err != nil {
+		return err
+	}
+	audit, err := openAuditLog(*auditLogFile)
+	if err != nil {
+		return err
+	}
+	if audit != nil {
+		defer audit.file.Close()
+	}
+	mon.audit = audit
+	if err := mon.resolveLogins(); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "release-bot-replay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// Failures aren't retried so they show up right after their delivery
+	queue, err := newEventQueue(dir, 1, mon.handleDelivery)
+	if err != nil {
+		return err
+	}
+	mon.queue = queue
+	router := mux.NewRouter()
+	mon.webhookRoutes(router)
+	for i, rec := range recordings {
+		if i > 0 && *speed > 0 {
+			time.Sleep(time.Duration(float64(rec.Received.Sub(recordings[i-1].Received)) / *speed))
+		}
+		secrets := mon.webhookSecrets(rec.URI)
+		verify := secrets
+		if *secret != "" {
+			verify = [][]byte{[]byte(*secret)}
+		}
+		r, err := rec.resign(verify, secrets[0])
+		if err != nil {
+			log.Errorf("Not replaying delivery to %s received at %s: %v", rec.URI, rec.Received, err)
+			continue
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		log.Infof("Replayed %s delivery %s to %s: %d", github.WebHookType(r), github.DeliveryID(r), rec.URI, w.Code)
+		queue.Drain()
+	}
+	return nil
+}
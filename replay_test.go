@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordTestDeliveries sends webhooks signed with old-secret to a monitor
+// recording them into a temporary directory, returning it.
+func recordTestDeliveries(t *testing.T, requests ...*http.Request) (string, func()) {
+	dir, err := ioutil.TempDir("", "release-bot-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	recorder, err := newDeliveryRecorder(dir)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	q, cleanupQueue := newTestQueue(t, nil)
+	defer cleanupQueue()
+	cfg, err := loadConfig("")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	mon := &githubMonitor{secret: []byte("old-secret"), config: cfg, queue: q, metrics: newMetrics(), recorder: recorder}
+	router := webhookRouter(mon)
+	for _, r := range requests {
+		router.ServeHTTP(httptest.NewRecorder(), r)
+		// Recordings are named by when they were received
+		time.Sleep(time.Millisecond)
+	}
+	return dir, cleanup
+}
+
+func closedIssue(number string) string {
+	return `{"action":"closed","issue":{"id":1` + number + `,"number":` + number + `,"url":"https://api.github.com/repos/docker/cli/issues/` + number + `"},"repository":{"name":"cli","owner":{"login":"docker"}}}`
+}
+
+func TestRecordAndLoadDeliveries(t *testing.T) {
+	dir, cleanup := recordTestDeliveries(t,
+		signedRequest("/docker/cli", "issues", "../first", closedIssue("1"), "old-secret"),
+		signedRequest("/docker/cli", "issues", "second", closedIssue("2"), "old-secret"),
+		// Only signed deliveries are recorded
+		signedRequest("/docker/cli", "issues", "forged", closedIssue("3"), "wrong-secret"),
+	)
+	defer cleanup()
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("recorded %v, want 2 deliveries", files)
+	}
+	for _, file := range files {
+		if filepath.Dir(file) != dir || strings.Contains(filepath.Base(file), "..") {
+			t.Errorf("delivery was recorded as %s", file)
+		}
+	}
+	recordings, err := loadRecordings([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 2 || recordings[0].Body != closedIssue("1") || recordings[1].Body != closedIssue("2") {
+		t.Errorf("loadRecordings() = %+v, want both deliveries in order", recordings)
+	}
+	if rec := recordings[0]; rec.Method != "POST" || rec.URI != "/docker/cli" || rec.Header.Get("X-GitHub-Event") != "issues" {
+		t.Errorf("recording is %+v", rec)
+	}
+	if _, err := loadRecordings([]string{filepath.Join(dir, "missing.json")}); err == nil {
+		t.Errorf("loadRecordings() of a missing file succeeded")
+	}
+}
+
+func TestRecordingsAreSignedAgain(t *testing.T) {
+	dir, cleanup := recordTestDeliveries(t, signedRequest("/docker/cli", "issues", "1", closedIssue("1"), "old-secret"))
+	defer cleanup()
+	recordings, err := loadRecordings([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := recordings[0].resign([][]byte{[]byte("old-secret")}, []byte("new-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := validatePayload(r, [][]byte{[]byte("new-secret")}); err != nil {
+		t.Errorf("replayed delivery does not validate with the new secret: %v", err)
+	}
+	if _, err := recordings[0].resign([][]byte{[]byte("new-secret")}, []byte("new-secret")); err == nil {
+		t.Errorf("resign() of a recording not signed with the secrets to check succeeded")
+	}
+}
+
+func TestWebhookSecrets(t *testing.T) {
+	path, cleanup := writeConfig(t, `{
+		"repositories": {"docker/cli": {"secrets": ["cli-secret", "old-cli-secret"]}},
+		"organizations": {"moby": {"secrets": ["org-secret"]}}
+	}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon := &githubMonitor{secret: []byte("shared-secret"), config: cfg}
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/docker/cli", "cli-secret"},
+		{"/docker/cli?debug=1", "cli-secret"},
+		{"/moby", "org-secret"},
+		{"/docker/docker", "shared-secret"},
+	}
+	for _, tt := range tests {
+		if got := mon.webhookSecrets(tt.uri); string(got[0]) != tt.want {
+			t.Errorf("webhookSecrets(%s) = %s, want %s first", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestReplayCommand(t *testing.T) {
+	dir, cleanup := recordTestDeliveries(t,
+		signedRequest("/docker/cli", "issues", "1", closedIssue("1"), "old-secret"),
+		signedRequest("/docker/cli", "issues", "2", closedIssue("2"), "old-secret"),
+	)
+	defer cleanup()
+	fake := newFakeGitHub(nil)
+	defer fake.Close()
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := newMetrics()
+	clients, err := newClientSource(context.Background(), fake.URL+"/", "token", nil, 0, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAudit, cleanupAudit := newTestAuditLog(t)
+	defer cleanupAudit()
+	mon := &githubMonitor{
+		ctx:     context.Background(),
+		secret:  []byte("shared-secret"),
+		clients: clients,
+		config:  cfg,
+		metrics: stats,
+		audit:   serverAudit,
+		cards:   newCardIndex(time.Hour),
+	}
+	// The recordings were signed with a secret that has since been rotated
+	if err := replayCommand(mon, []string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	want := `release_bot_webhook_deliveries_total{event="issues",action="closed",result="success"}`
+	if got := scrape(stats); strings.Contains(got, want) {
+		t.Errorf("recordings with a signature that doesn't check out were replayed:\n%s", got)
+	}
+	// Replayed changes stay out of the server's audit log
+	if mon.audit != nil {
+		t.Errorf("replay audits to %s, want no audit log", mon.audit.path)
+	}
+	replayAudit := filepath.Join(filepath.Dir(serverAudit.path), "replay.jsonl")
+	if err := replayCommand(mon, []string{"-secret", "old-secret", "-audit-log", replayAudit, dir}); err != nil {
+		t.Fatal(err)
+	}
+	if mon.audit == nil || mon.audit.path != replayAudit {
+		t.Errorf("replay audits to %+v, want %s", mon.audit, replayAudit)
+	}
+	// Both were handled by the time the command returns
+	if got := scrape(stats); !strings.Contains(got, want+" 2") {
+		t.Errorf("metrics do not contain %q:\n%s", want+" 2", got)
+	}
+	if depth := mon.queue.Depth(); depth != 0 {
+		t.Errorf("%d deliveries left in the queue", depth)
+	}
+	if err := replayCommand(mon, nil); err == nil {
+		t.Errorf("replay without recordings succeeded")
+	}
+}
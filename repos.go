@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/go-github/github"
+)
+
+// secretsFor returns the webhook secrets a delivery for a repository may be
+// signed with.
+func (mon *githubMonitor) secretsFor(rc *repoConfig) [][]byte {
+	if rc == nil || len(rc.Secrets) == 0 {
+		return [][]byte{mon.secret}
+	}
+	var secrets [][]byte
+	for _, secret := range rc.Secrets {
+		secrets = append(secrets, []byte(secret))
+	}
+	return secrets
+}
+
+// validatePayload reads the body of a delivery and checks its signature
+// against each of the secrets in turn. It returns the payload along with the
+// body as it was signed.
+func validatePayload(r *http.Request, secrets [][]byte) ([]byte, []byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = errors.New("no webhook secret configured")
+	for _, secret := range secrets {
+		// Anyone can sign with an empty key
+		if len(secret) == 0 {
+			continue
+		}
+		var payload []byte
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		payload, err = github.ValidatePayload(r, secret)
+		if err == nil {
+			return payload, body, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// payloadRepository returns the owner and name of the repository a delivery
+// is about, empty if it isn't about a repository.
+func payloadRepository(payload []byte) (string, string) {
+	var p struct {
+		Repository *struct {
+			Name  string `json:"name"`
+			Owner struct {
+				Login string `json:"login"`
+			} `json:"owner"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil || p.Repository == nil {
+		return "", ""
+	}
+	return p.Repository.Owner.Login, p.Repository.Name
+}
+
+// payloadOrganization returns the organization a delivery was sent for, empty
+// if it wasn't sent by an organization webhook.
+func payloadOrganization(payload []byte) string {
+	var p struct {
+		Organization *struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil || p.Organization == nil {
+		return ""
+	}
+	return p.Organization.Login
+}
+
+// payloadOwner returns the repository a delivery is about, or the
+// organization and an empty name for organization level events.
+func payloadOwner(payload []byte) (string, string) {
+	if owner, name := payloadRepository(payload); name != "" {
+		return owner, name
+	}
+	return payloadOrganization(payload), ""
+}
+
+// payloadAction returns the action of a delivery, like labeled, empty for
+// events without one.
+func payloadAction(payload []byte) string {
+	var p struct {
+		Action string `json:"action"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ""
+	}
+	return p.Action
+}
+
+// payloadSender returns the login of who caused a delivery.
+func payloadSender(payload []byte) string {
+	var p struct {
+		Sender *struct {
+			Login string `json:"login"`
+		} `json:"sender"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil || p.Sender == nil {
+		return ""
+	}
+	return p.Sender.Login
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// signedRequest builds a webhook delivery signed with secret.
+func signedRequest(path, event, id, payload, secret string) *http.Request {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(payload))
+	r := httptest.NewRequest("POST", path, bytes.NewBufferString(payload))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-GitHub-Event", event)
+	r.Header.Set("X-GitHub-Delivery", id)
+	r.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+// webhookRouter routes webhooks to mon like the server does.
+func webhookRouter(mon *githubMonitor) *mux.Router {
+	router := mux.NewRouter()
+	router.Handle("/{org:[^/]+}", http.HandlerFunc(mon.handleOrgWebhook)).Methods("POST")
+	router.Handle("/{user:.*}/{name:.*}", http.HandlerFunc(mon.handleGithubWebhook)).Methods("POST")
+	return router
+}
+
+func TestValidatePayload(t *testing.T) {
+	payload := `{"action":"opened"}`
+	tests := []struct {
+		secrets    []string
+		signedWith string
+		ok         bool
+	}{
+		{[]string{"secret"}, "secret", true},
+		{[]string{"old", "secret"}, "secret", true},
+		{[]string{"old"}, "secret", false},
+		{nil, "secret", false},
+		// An empty key is no secret at all
+		{[]string{""}, "", false},
+	}
+	for _, tt := range tests {
+		var secrets [][]byte
+		for _, secret := range tt.secrets {
+			secrets = append(secrets, []byte(secret))
+		}
+		got, _, err := validatePayload(signedRequest("/docker/cli", "issues", "1", payload, tt.signedWith), secrets)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("validatePayload() with secrets %q = %v, want ok %v", tt.secrets, err, tt.ok)
+		}
+		if tt.ok && string(got) != payload {
+			t.Errorf("validatePayload() with secrets %q = %s, want %s", tt.secrets, got, payload)
+		}
+	}
+}
+
+func TestPayloadRepository(t *testing.T) {
+	tests := []struct {
+		payload     string
+		owner, name string
+	}{
+		{`{"repository":{"name":"cli","owner":{"login":"docker"}}}`, "docker", "cli"},
+		{`{"project":{"id":1}}`, "", ""},
+		{`not json`, "", ""},
+	}
+	for _, tt := range tests {
+		if owner, name := payloadRepository([]byte(tt.payload)); owner != tt.owner || name != tt.name {
+			t.Errorf("payloadRepository(%s) = %s/%s, want %s/%s", tt.payload, owner, name, tt.owner, tt.name)
+		}
+	}
+}
+
+func TestPayloadOwner(t *testing.T) {
+	tests := []struct {
+		payload     string
+		owner, name string
+	}{
+		{`{"repository":{"name":"cli","owner":{"login":"docker"}},"organization":{"login":"docker"}}`, "docker", "cli"},
+		{`{"project":{"id":1},"organization":{"login":"docker"}}`, "docker", ""},
+		{`{"project":{"id":1}}`, "", ""},
+	}
+	for _, tt := range tests {
+		if owner, name := payloadOwner([]byte(tt.payload)); owner != tt.owner || name != tt.name {
+			t.Errorf("payloadOwner(%s) = %s/%s, want %s/%s", tt.payload, owner, name, tt.owner, tt.name)
+		}
+	}
+}
+
+func TestHandleGithubWebhookRoutesRepositories(t *testing.T) {
+	os.Setenv("RELEASE_BOT_TEST_SECRET", "cli-secret")
+	defer os.Unsetenv("RELEASE_BOT_TEST_SECRET")
+	// Secrets whose variable isn't set are left out rather than taken as empty
+	path, cleanup := writeConfig(t, `{"repositories": {
+		"docker/cli": {"secrets": ["${RELEASE_BOT_TEST_SECRET}", "${RELEASE_BOT_TEST_UNSET_SECRET}"]},
+		"docker/docker": {},
+		"docker/old": {"disabled": true}
+	}}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, cleanupQueue := newTestQueue(t, nil)
+	defer cleanupQueue()
+	mon := &githubMonitor{secret: []byte("shared-secret"), config: cfg, queue: q, metrics: newMetrics()}
+	router := webhookRouter(mon)
+	payload := func(owner, name string) string {
+		return `{"action":"opened","issue":{"number":1},"repository":{"name":"` + name + `","owner":{"login":"` + owner + `"}}}`
+	}
+	tests := []struct {
+		name    string
+		path    string
+		payload string
+		secret  string
+		code    int
+		queued  bool
+	}{
+		{"own secret", "/docker/cli", payload("docker", "cli"), "cli-secret", http.StatusAccepted, true},
+		{"names ignore case", "/Docker/CLI", payload("docker", "cli"), "cli-secret", http.StatusAccepted, true},
+		{"shared secret", "/docker/docker", payload("docker", "docker"), "shared-secret", http.StatusAccepted, true},
+		{"other repository's secret", "/docker/cli", payload("docker", "cli"), "shared-secret", http.StatusUnauthorized, false},
+		{"unset secret", "/docker/cli", payload("docker", "cli"), "", http.StatusUnauthorized, false},
+		{"unknown repository", "/docker/compose", payload("docker", "compose"), "shared-secret", http.StatusNotFound, false},
+		{"payload for another repository", "/docker/cli", payload("docker", "docker"), "cli-secret", http.StatusBadRequest, false},
+		{"disabled", "/docker/old", payload("docker", "old"), "shared-secret", http.StatusOK, false},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		depth := q.Depth()
+		router.ServeHTTP(w, signedRequest(tt.path, "issues", string(rune('a'+i)), tt.payload, tt.secret))
+		if w.Code != tt.code {
+			t.Errorf("%s: responded %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if queued := q.Depth() > depth; queued != tt.queued {
+			t.Errorf("%s: queued %v, want %v", tt.name, queued, tt.queued)
+		}
+	}
+}
+
+func TestHandleOrgWebhookRoutesOrganizations(t *testing.T) {
+	path, cleanup := writeConfig(t, `{"organizations": {
+		"docker": {"secrets": ["org-secret"], "repositories": ["docker/cli"]}
+	}}`)
+	defer cleanup()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, cleanupQueue := newTestQueue(t, nil)
+	defer cleanupQueue()
+	mon := &githubMonitor{secret: []byte("shared-secret"), config: cfg, queue: q, metrics: newMetrics()}
+	router := webhookRouter(mon)
+	issue := func(org, name string) string {
+		return `{"action":"opened","issue":{"number":1},"repository":{"name":"` + name + `","owner":{"login":"` + org + `"}},"organization":{"login":"` + org + `"}}`
+	}
+	project := `{"action":"created","project":{"id":1,"name":"17.06.1-ee-1-rc1"},"organization":{"login":"docker"}}`
+	tests := []struct {
+		name    string
+		path    string
+		event   string
+		payload string
+		secret  string
+		code    int
+		queued  bool
+	}{
+		{"organization project", "/docker", "project", project, "org-secret", http.StatusAccepted, true},
+		{"tracked repository", "/docker", "issues", issue("docker", "cli"), "org-secret", http.StatusAccepted, true},
+		{"untracked repository", "/docker", "issues", issue("docker", "docker"), "org-secret", http.StatusOK, false},
+		{"shared secret", "/docker", "project", project, "shared-secret", http.StatusUnauthorized, false},
+		{"unknown organization", "/moby", "project", project, "shared-secret", http.StatusNotFound, false},
+		{"payload for another organization", "/docker", "issues", issue("moby", "cli"), "org-secret", http.StatusBadRequest, false},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		depth := q.Depth()
+		router.ServeHTTP(w, signedRequest(tt.path, tt.event, string(rune('a'+i)), tt.payload, tt.secret))
+		if w.Code != tt.code {
+			t.Errorf("%s: responded %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if queued := q.Depth() > depth; queued != tt.queued {
+			t.Errorf("%s: queued %v, want %v", tt.name, queued, tt.queued)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// revertStep undoes one audit record.
+type revertStep struct {
+	Record *auditRecord `json:"record"`
+	// Undo describes what reverting the record does, empty if it can't be
+	// reverted
+	Undo    string `json:"undo,omitempty"`
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// revertEvent is the event of the audit records of reverts, whose delivery
+// ID is the ID of the revert.
+const revertEvent = "revert"
+
+// planRevert returns the steps undoing records, newest first. Dry-run
+// changes, which have nothing to undo, and earlier reverts are left out
+// unless the delivery to revert is one.
+func planRevert(records []*auditRecord, f *auditFilter) []*revertStep {
+	steps := make([]*revertStep, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].DryRun || (records[i].Event == revertEvent && f.Delivery == "") {
+			continue
+		}
+		steps = append(steps, &revertStep{Record: records[i], Undo: undoDescription(records[i])})
+	}
+	return steps
+}
+
+// undoDescription says how a record is reverted. Created labels and columns
+// are left alone since other issues may have come to use them, and created
+// projects are closed rather than deleted along with whatever was added to
+// them since.
+func undoDescription(r *auditRecord) string {
+	issue := fmt.Sprintf("%s/%s#%d", r.Owner, r.Repo, r.Issue)
+	switch {
+	case r.Action == "AddLabelsToIssue" && r.After != nil:
+		return fmt.Sprintf("remove label %s from %s", r.After.Label, issue)
+	case r.Action == "RemoveLabelForIssue" && r.Before != nil:
+		return fmt.Sprintf("add label %s to %s", r.Before.Label, issue)
+	case r.Action == "CreateProjectCard" && r.After != nil:
+		return fmt.Sprintf("delete card of %s from %s/%s", issue, r.Project, r.After.Column)
+	case r.Action == "MoveProjectCard" && r.Before != nil && r.After != nil:
+		return fmt.Sprintf("move card of %s in %s from %s back to %s", issue, r.Project, r.After.Column, r.Before.Column)
+	case r.Action == "DeleteProjectCard" && r.Before != nil:
+		return fmt.Sprintf("create card of %s in %s/%s", issue, r.Project, r.Before.Column)
+	case r.Action == "CreateProject":
+		return fmt.Sprintf("close project %s", r.Project)
+	case r.Action == "UpdateProject" && r.Before != nil && r.Before.State != "":
+		return fmt.Sprintf("set project %s back to %s", r.Project, r.Before.State)
+	}
+	return ""
+}
+
+// cardIDs follows cards that a revert deleted and created again, which gives
+// them a new ID, from their old IDs to their new ones.
+type cardIDs map[int]int
+
+func (ids cardIDs) current(id int) int {
+	for {
+		next, ok := ids[id]
+		if !ok {
+			return id
+		}
+		id = next
+	}
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*github.ErrorResponse)
+	return ok && e.Response.StatusCode == http.StatusNotFound
+}
+
+// undo reverts a record. Cards it creates again are added to ids, so records
+// older than the deletion can still find them.
+func (mon *githubMonitor) undo(ctx context.Context, r *auditRecord, ids cardIDs) error {
+	item := &boardItem{Owner: r.Owner, Repo: r.Repo, Number: r.Issue}
+	project := &github.Project{ID: &r.ProjectID, Name: &r.Project}
+	column := func(s *auditState) *github.ProjectColumn {
+		return &github.ProjectColumn{ID: &s.ColumnID, Name: &s.Column}
+	}
+	switch r.Action {
+	case "AddLabelsToIssue":
+		resp, err := mon.removeLabel(ctx, r.Owner, r.Repo, r.Issue, r.After.Label)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	case "RemoveLabelForIssue":
+		return mon.addLabels(ctx, r.Owner, r.Repo, r.Issue, []string{r.Before.Label})
+	case "CreateProjectCard":
+		item.ContentID, item.ContentType = r.After.ContentID, r.After.ContentType
+		err := mon.deleteCard(ctx, project, item, ids.current(r.After.CardID), column(r.After))
+		if isNotFound(err) {
+			return nil
+		}
+		mon.cards.forget(r.ProjectID)
+		return err
+	case "MoveProjectCard":
+		item.ContentID, item.ContentType = r.Before.ContentID, r.Before.ContentType
+		err := mon.moveCard(ctx, project, item, ids.current(r.Before.CardID), column(r.After), column(r.Before))
+		// The card was deleted since
+		if isNotFound(err) {
+			return nil
+		}
+		mon.cards.forget(r.ProjectID)
+		return err
+	case "DeleteProjectCard":
+		item.ContentID, item.ContentType = r.Before.ContentID, r.Before.ContentType
+		card, resp, err := mon.createCard(ctx, project, column(r.Before), item)
+		// The card may have been added back since
+		if resp != nil && resp.StatusCode == http.StatusUnprocessableEntity {
+			return nil
+		}
+		if err == nil && card.GetID() != 0 {
+			ids[r.Before.CardID] = card.GetID()
+		}
+		mon.cards.forget(r.ProjectID)
+		return err
+	case "CreateProject":
+		return mon.setProjectState(ctx, r.Owner, r.Repo, project, "closed")
+	case "UpdateProject":
+		return mon.setProjectState(ctx, r.Owner, r.Repo, project, r.Before.State)
+	}
+	return fmt.Errorf("%s can't be reverted", r.Action)
+}
+
+// undoKeys are the queue keys of the issue and card of a record, held while
+// it is undone so that no delivery about them is handled in the middle.
+func undoKeys(r *auditRecord, ids cardIDs) []string {
+	var keys []string
+	if r.Issue != 0 {
+		keys = append(keys, issueKey(r.Owner, r.Repo, r.Issue))
+	}
+	for _, s := range []*auditState{r.Before, r.After} {
+		if s != nil && s.CardID != 0 {
+			keys = append(keys, cardKey(ids.current(s.CardID)))
+			break
+		}
+	}
+	return keys
+}
+
+// reverting returns the monitor acting on owner/name for the revert d.
+func (mon *githubMonitor) reverting(ctx context.Context, owner, name string, d *delivery) (*githubMonitor, error) {
+	m, err := mon.forOwner(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	reverting := *m
+	reverting.delivery = d
+	return &reverting, nil
+}
+
+// cardRevert is where a revert left the card of an issue on a project, an
+// empty column if it has none anymore.
+type cardRevert struct {
+	record *auditRecord
+	column string
+}
+
+// relabel makes the release labels of an issue match the column a revert
+// left its card in. The card changes of the revert are echoes, so the bot
+// won't do it when their webhooks come in.
+func (mon *githubMonitor) relabel(ctx context.Context, c *cardRevert, d *delivery) error {
+	r := c.record
+	release, err := mon.config.grammarFor(r.Owner, r.Repo).Parse(r.Project)
+	if err != nil {
+		return nil
+	}
+	keys := []string{issueKey(r.Owner, r.Repo, r.Issue)}
+	mon.queue.lock(keys)
+	defer mon.queue.unlock(keys)
+	m, err := mon.reverting(ctx, r.Owner, r.Repo, d)
+	if err != nil {
+		return err
+	}
+	return m.syncLabels(ctx, r.Owner, r.Repo, r.Issue, release.Prefix, mon.config.workflowFor(r.Owner, r.Repo), c.column)
+}
+
+// revert plans the steps undoing the audit records matching the filter and,
+// unless it is a dry run, applies them as a revert of its own ID. It stops at
+// the first step that fails since the ones before it may depend on it. The
+// labels of issues whose cards were put back are then synced with them,
+// unless the revert put back their labels too.
+func (mon *githubMonitor) revert(ctx context.Context, f *auditFilter, dryRun bool) (string, []*revertStep, error) {
+	if f.Delivery == "" && f.Issue == 0 && f.Project == "" {
+		return "", nil, permanent(fmt.Errorf("a delivery, issue or project to revert is required"))
+	}
+	if f.Issue != 0 && f.Repo == "" {
+		return "", nil, permanent(fmt.Errorf("the repository of issue %d is required", f.Issue))
+	}
+	records, err := mon.audit.query(f)
+	if err != nil {
+		return "", nil, err
+	}
+	steps := planRevert(records, f)
+	if dryRun {
+		return "", steps, nil
+	}
+	d := &delivery{Event: revertEvent, Received: time.Now()}
+	d.ID = fmt.Sprintf("revert-%d", d.Received.UnixNano())
+	ids := make(cardIDs)
+	cards := make(map[string]*cardRevert)
+	var moved []string
+	labeled := make(map[string]bool)
+	for _, step := range steps {
+		if step.Undo == "" {
+			continue
+		}
+		r := step.Record
+		keys := undoKeys(r, ids)
+		mon.queue.lock(keys)
+		m, err := mon.reverting(ctx, r.Owner, r.Repo, d)
+		if err == nil {
+			err = m.undo(ctx, r, ids)
+		}
+		mon.queue.unlock(keys)
+		if err != nil {
+			step.Error = err.Error()
+			return d.ID, steps, fmt.Errorf("could not %s: %v", step.Undo, err)
+		}
+		step.Applied = true
+		log.Infof("%s Reverted %s: %s", d.ID, r.Action, step.Undo)
+		// Steps go from newest to oldest, so the last one for a card is
+		// where the revert leaves it
+		issue := issueKey(r.Owner, r.Repo, r.Issue)
+		card := fmt.Sprintf("%s %d", issue, r.ProjectID)
+		column := ""
+		switch r.Action {
+		case "AddLabelsToIssue", "RemoveLabelForIssue":
+			labeled[issue] = true
+			continue
+		case "MoveProjectCard", "DeleteProjectCard":
+			column = r.Before.Column
+		case "CreateProjectCard":
+		default:
+			continue
+		}
+		if cards[card] == nil {
+			moved = append(moved, card)
+		}
+		cards[card] = &cardRevert{record: r, column: column}
+	}
+	for _, card := range moved {
+		c := cards[card]
+		if labeled[issueKey(c.record.Owner, c.record.Repo, c.record.Issue)] {
+			continue
+		}
+		if err := mon.relabel(ctx, c, d); err != nil {
+			return d.ID, steps, fmt.Errorf("could not relabel %s/%s#%d: %v", c.record.Owner, c.record.Repo, c.record.Issue, err)
+		}
+	}
+	return d.ID, steps, nil
+}
+
+// handleRevert reverts what the audit records matching the query parameters
+// did, writing the steps as JSON lines and the ID of the revert in the
+// X-Revert-ID header. Only a preview is given unless apply=true.
+func (mon *githubMonitor) handleRevert(w http.ResponseWriter, r *http.Request) {
+	if !mon.authorized(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	f, err := parseAuditFilter(query.Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	id, steps, err := mon.revert(ctx, f, query.Get("apply") != "true")
+	if err != nil {
+		if _, ok := err.(permanentError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Errorf("%s Could not revert: %v", r.URL, err)
+		if steps == nil {
+			http.Error(w, "Could not revert", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if id != "" {
+		w.Header().Set("X-Revert-ID", id)
+	}
+	if err != nil {
+		// The steps say how far the revert got
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	enc := json.NewEncoder(w)
+	for _, step := range steps {
+		enc.Encode(step)
+	}
+}
+
+// revertCommand undoes what the bot did for a delivery, or to an issue or
+// project, showing what it would do unless -apply is given:
+//
+//	release-bot revert [-apply] [-delivery id] [-repo owner/name|org] [-issue n] [-project name|id] [-user login] [-since 24h] [-until time]
+func revertCommand(mon *githubMonitor, args []string) error {
+	flags := flag.NewFlagSet("revert", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "Make the changes instead of only showing them")
+	params := auditFlags(flags)
+	flags.Parse(args)
+	f, err := parseAuditFilter(func(name string) string { return *params[name] })
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(mon.ctx, 30*time.Minute)
+	defer cancel()
+	id, steps, revertErr := mon.revert(ctx, f, !*apply)
+	for _, step := range steps {
+		switch {
+		case step.Undo == "":
+			fmt.Fprintf(os.Stdout, "skip    %s %s\n", step.Record.Time.Format(time.RFC3339), step.Record.Action)
+		case step.Applied:
+			fmt.Fprintf(os.Stdout, "undone  %s %s\n", step.Record.Time.Format(time.RFC3339), step.Undo)
+		case step.Error != "":
+			fmt.Fprintf(os.Stdout, "failed  %s %s: %s\n", step.Record.Time.Format(time.RFC3339), step.Undo, step.Error)
+		default:
+			fmt.Fprintf(os.Stdout, "would   %s %s\n", step.Record.Time.Format(time.RFC3339), step.Undo)
+		}
+	}
+	if id != "" {
+		fmt.Fprintf(os.Stdout, "Revert %s, undo it with -delivery %s\n", id, id)
+	}
+	if revertErr != nil {
+		return revertErr
+	}
+	if !*apply && len(steps) > 0 {
+		fmt.Fprintln(os.Stdout, "Run again with -apply to make these changes")
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditedChanges are the records of a delivery labeling an issue into
+// Triage and moving its card on to Cherry Pick, along with a delivery for
+// another issue.
+func auditedChanges() []*auditRecord {
+	now := time.Now().UTC()
+	card := func(column int, name string) *auditState {
+		return &auditState{CardID: 31, ColumnID: column, Column: name, ContentID: 101, ContentType: "Issue"}
+	}
+	return []*auditRecord{
+		{Time: now, Delivery: "d1", Action: "CreateLabel", Owner: "docker", Repo: "cli", After: &auditState{Label: "17.06.1-ee-1/triage", Color: "eeeeee"}},
+		{Time: now, Delivery: "d1", Action: "AddLabelsToIssue", Owner: "docker", Repo: "cli", Issue: 1, After: &auditState{Label: "17.06.1-ee-1/triage"}},
+		{Time: now, Delivery: "d1", Action: "CreateProjectCard", Owner: "docker", Repo: "cli", Issue: 1, ProjectID: 5, Project: "17.06.1-ee-1", After: card(21, "Triage")},
+		{Time: now, Delivery: "d1", Action: "MoveProjectCard", Owner: "docker", Repo: "cli", Issue: 1, ProjectID: 5, Project: "17.06.1-ee-1", Before: card(21, "Triage"), After: card(22, "Cherry Pick")},
+		{Time: now, Delivery: "d2", Action: "RemoveLabelForIssue", Owner: "docker", Repo: "cli", Issue: 2, Before: &auditState{Label: "17.06.1-ee-1/triage"}},
+	}
+}
+
+func TestUndoDescription(t *testing.T) {
+	var got []string
+	for _, r := range auditedChanges() {
+		got = append(got, undoDescription(r))
+	}
+	want := []string{
+		"",
+		"remove label 17.06.1-ee-1/triage from docker/cli#1",
+		"delete card of docker/cli#1 from 17.06.1-ee-1/Triage",
+		"move card of docker/cli#1 in 17.06.1-ee-1 from Cherry Pick back to Triage",
+		"add label 17.06.1-ee-1/triage to docker/cli#2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("undoDescription() = %q, want %q", got, want)
+	}
+}
+
+func TestPlanRevert(t *testing.T) {
+	records := auditedChanges()
+	records = append(records, &auditRecord{Delivery: "revert-1", Event: revertEvent, Action: "AddLabelsToIssue", Owner: "docker", Repo: "cli", Issue: 1, After: &auditState{Label: "17.06.1-ee-1/triage"}})
+	var actions []string
+	for _, step := range planRevert(records, &auditFilter{Issue: 1}) {
+		actions = append(actions, step.Record.Action)
+	}
+	// Newest first, leaving out the earlier revert
+	want := []string{"RemoveLabelForIssue", "MoveProjectCard", "CreateProjectCard", "AddLabelsToIssue", "CreateLabel"}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("planRevert() = %v, want %v", actions, want)
+	}
+	// Unless it is the revert being reverted
+	if steps := planRevert(records, &auditFilter{Delivery: "revert-1"}); steps[0].Record.Event != revertEvent {
+		t.Errorf("planRevert() of a revert left it out")
+	}
+}
+
+// newRevertMonitor returns a monitor talking to fake with the audited
+// changes in its audit log.
+func newRevertMonitor(t *testing.T, fake *fakeGitHub) (*githubMonitor, func()) {
+	audit, cleanup := newTestAuditLog(t)
+	for _, r := range auditedChanges() {
+		audit.write(r)
+	}
+	cfg, err := loadConfig("")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	stats := newMetrics()
+	clients, err := newClientSource(context.Background(), fake.URL+"/", "token", nil, 0, stats)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return &githubMonitor{
+		ctx:        context.Background(),
+		adminToken: []byte("admin"),
+		client:     clients.forToken("token", false),
+		clients:    clients,
+		config:     cfg,
+		metrics:    stats,
+		audit:      audit,
+		cards:      newCardIndex(time.Hour),
+	}, cleanup
+}
+
+func TestRevert(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"POST /projects/columns/cards/31/moves":                        {code: http.StatusCreated, body: `{}`},
+		"DELETE /projects/columns/cards/31":                            {code: http.StatusNoContent},
+		"DELETE /repos/docker/cli/issues/1/labels/17.06.1-ee-1/triage": {code: http.StatusNoContent},
+	})
+	defer fake.Close()
+	mon, cleanup := newRevertMonitor(t, fake)
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, _, err := mon.revert(ctx, &auditFilter{User: "alice"}, true); err == nil {
+		t.Errorf("revert() without a delivery, issue or project succeeded")
+	}
+	if _, steps, err := mon.revert(ctx, &auditFilter{Delivery: "d1"}, true); err != nil || len(steps) != 4 || len(fake.sent()) != 0 {
+		t.Errorf("dry run planned %d steps with error %v and sent %v", len(steps), err, fake.sent())
+	}
+
+	id, steps, err := mon.revert(ctx, &auditFilter{Delivery: "d1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST /projects/columns/cards/31/moves",
+		"DELETE /projects/columns/cards/31",
+		"DELETE /repos/docker/cli/issues/1/labels/17.06.1-ee-1/triage",
+	}
+	if got := fake.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("revert() sent %v, want %v", got, want)
+	}
+	if body := fake.body("POST /projects/columns/cards/31/moves"); !strings.Contains(body, `"column_id":21`) {
+		t.Errorf("card was moved with %s, want back to column 21", body)
+	}
+	for _, step := range steps {
+		if applied := step.Undo != ""; step.Applied != applied {
+			t.Errorf("step %s applied %v, want %v", step.Record.Action, step.Applied, applied)
+		}
+	}
+
+	// The revert is audited under its own ID so it can be reverted in turn
+	reverted, err := mon.audit.query(&auditFilter{Delivery: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, r := range reverted {
+		if r.Event != revertEvent {
+			t.Errorf("%s of the revert was recorded for event %q", r.Action, r.Event)
+		}
+		actions = append(actions, r.Action)
+	}
+	if want := []string{"MoveProjectCard", "DeleteProjectCard", "RemoveLabelForIssue"}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("revert recorded %v, want %v", actions, want)
+	}
+	// and doesn't come up when reverting the issue
+	_, steps, err = mon.revert(ctx, &auditFilter{Owner: "docker", Repo: "cli", Issue: 1}, true)
+	if err != nil || len(steps) != 3 {
+		t.Errorf("reverting docker/cli#1 planned %d steps with error %v, want the 3 d1 made to it", len(steps), err)
+	}
+}
+
+func TestRevertStopsAtFirstFailure(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"POST /projects/columns/cards/31/moves": {code: http.StatusBadGateway, body: `{"message":"Server Error"}`},
+	})
+	defer fake.Close()
+	mon, cleanup := newRevertMonitor(t, fake)
+	defer cleanup()
+	_, steps, err := mon.revert(context.Background(), &auditFilter{Delivery: "d1"}, false)
+	if err == nil {
+		t.Fatal("revert() succeeded")
+	}
+	if len(fake.sent()) != 1 {
+		t.Errorf("revert() went on after a failure, sending %v", fake.sent())
+	}
+	if steps[0].Applied || steps[0].Error == "" || steps[1].Applied {
+		t.Errorf("steps are %+v %+v, want the first one failed and the rest not applied", steps[0], steps[1])
+	}
+}
+
+func TestRevertFollowsRecreatedCards(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"POST /projects/columns/22/cards":       {code: http.StatusCreated, body: `{"id":41}`},
+		"POST /projects/columns/cards/41/moves": {code: http.StatusCreated, body: `{}`},
+		"DELETE /projects/columns/cards/41":     {code: http.StatusNoContent},
+		"GET /repos/docker/cli/issues/1/labels": {body: `[]`},
+	})
+	defer fake.Close()
+	mon, cleanup := newRevertMonitor(t, fake)
+	defer cleanup()
+	// d3 added a card to Triage, moved it to Cherry Pick and deleted it
+	card := func(column int, name string) *auditState {
+		return &auditState{CardID: 31, ColumnID: column, Column: name, ContentID: 101, ContentType: "Issue"}
+	}
+	for _, r := range []*auditRecord{
+		{Delivery: "d3", Action: "CreateProjectCard", Owner: "docker", Repo: "cli", Issue: 1, ProjectID: 5, Project: "17.06.1-ee-1", After: card(21, "Triage")},
+		{Delivery: "d3", Action: "MoveProjectCard", Owner: "docker", Repo: "cli", Issue: 1, ProjectID: 5, Project: "17.06.1-ee-1", Before: card(21, "Triage"), After: card(22, "Cherry Pick")},
+		{Delivery: "d3", Action: "DeleteProjectCard", Owner: "docker", Repo: "cli", Issue: 1, ProjectID: 5, Project: "17.06.1-ee-1", Before: card(22, "Cherry Pick")},
+	} {
+		r.Time = time.Now().UTC()
+		mon.audit.write(r)
+	}
+	if _, _, err := mon.revert(context.Background(), &auditFilter{Delivery: "d3"}, false); err != nil {
+		t.Fatal(err)
+	}
+	// The card added back has a new ID the older records are applied to
+	want := []string{
+		"POST /projects/columns/22/cards",
+		"POST /projects/columns/cards/41/moves",
+		"DELETE /projects/columns/cards/41",
+		"GET /repos/docker/cli/issues/1/labels",
+	}
+	if got := fake.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("revert() sent %v, want %v", got, want)
+	}
+}
+
+func TestRevertSkipsMovesOfDeletedCards(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"DELETE /projects/columns/cards/31":                            {code: http.StatusNotFound, body: `{"message":"Not Found"}`},
+		"DELETE /repos/docker/cli/issues/1/labels/17.06.1-ee-1/triage": {code: http.StatusNoContent},
+	})
+	defer fake.Close()
+	mon, cleanup := newRevertMonitor(t, fake)
+	defer cleanup()
+	// The fake has no card 31 to move back
+	_, steps, err := mon.revert(context.Background(), &auditFilter{Delivery: "d1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps {
+		if step.Error != "" {
+			t.Errorf("step %s failed: %s", step.Record.Action, step.Error)
+		}
+	}
+}
+
+func TestRevertRelabelsIssuesOfProject(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"POST /projects/columns/cards/31/moves":                        {code: http.StatusCreated, body: `{}`},
+		"DELETE /projects/columns/cards/31":                            {code: http.StatusNoContent},
+		"GET /repos/docker/cli/issues/1/labels":                        {body: `[{"name":"17.06.1-ee-1/triage"}]`},
+		"DELETE /repos/docker/cli/issues/1/labels/17.06.1-ee-1/triage": {code: http.StatusNoContent},
+	})
+	defer fake.Close()
+	mon, cleanup := newRevertMonitor(t, fake)
+	defer cleanup()
+	q, cleanupQueue := newTestQueue(t, nil)
+	defer cleanupQueue()
+	mon.queue = q
+	// A delivery about the issue is being handled
+	keys := []string{issueKey("docker", "cli", 1)}
+	q.lock(keys)
+	done := make(chan error)
+	go func() {
+		// Label records have no project, so only the card ones are reverted
+		_, _, err := mon.revert(context.Background(), &auditFilter{Project: "17.06.1-ee-1"}, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("revert() = %v while a delivery about the issue was handled", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if sent := fake.sent(); len(sent) != 0 {
+		t.Errorf("revert() sent %v while a delivery about the issue was handled", sent)
+	}
+	q.unlock(keys)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// The card is gone again, and so is the label of its column
+	want := []string{
+		"POST /projects/columns/cards/31/moves",
+		"DELETE /projects/columns/cards/31",
+		"GET /repos/docker/cli/issues/1/labels",
+		"DELETE /repos/docker/cli/issues/1/labels/17.06.1-ee-1/triage",
+	}
+	if got := fake.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("revert() sent %v, want %v", got, want)
+	}
+}
+
+func TestRevertProjects(t *testing.T) {
+	fake := newFakeGitHub(map[string]fakeResponse{
+		"PATCH /projects/5": {body: `{"id":5}`},
+		"PATCH /projects/6": {body: `{"id":6}`},
+	})
+	defer fake.Close()
+	mon, cleanup := newRevertMonitor(t, fake)
+	defer cleanup()
+	// d4 rotated 17.06.1-ee-1 into a new 17.06.1-ee-2 and closed it
+	for _, r := range []*auditRecord{
+		{Delivery: "d4", Action: "CreateProject", Owner: "docker", Repo: "cli", ProjectID: 6, Project: "17.06.1-ee-2", After: &auditState{State: "open"}},
+		{Delivery: "d4", Action: "UpdateProject", Owner: "docker", Repo: "cli", ProjectID: 5, Project: "17.06.1-ee-1", Before: &auditState{State: "open"}, After: &auditState{State: "closed"}},
+	} {
+		r.Time = time.Now().UTC()
+		mon.audit.write(r)
+	}
+	_, steps, err := mon.revert(context.Background(), &auditFilter{Delivery: "d4"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var undo []string
+	for _, step := range steps {
+		undo = append(undo, step.Undo)
+	}
+	if want := []string{"set project 17.06.1-ee-1 back to open", "close project 17.06.1-ee-2"}; !reflect.DeepEqual(undo, want) {
+		t.Errorf("revert() planned %q, want %q", undo, want)
+	}
+	if body := fake.body("PATCH /projects/5"); !strings.Contains(body, `"state":"open"`) {
+		t.Errorf("project 5 was patched with %s, want it opened", body)
+	}
+	if body := fake.body("PATCH /projects/6"); !strings.Contains(body, `"state":"closed"`) {
+		t.Errorf("project 6 was patched with %s, want it closed", body)
+	}
+}
+
+func TestHandleRevert(t *testing.T) {
+	fake := newFakeGitHub(nil)
+	defer fake.Close()
+	mon, cleanup := newRevertMonitor(t, fake)
+	defer cleanup()
+	tests := []struct {
+		query string
+		code  int
+		steps int
+	}{
+		{"delivery=d1", http.StatusOK, 4},
+		{"issue=2&repo=docker/cli", http.StatusOK, 1},
+		{"issue=2", http.StatusBadRequest, 0},
+		{"since=yesterday", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/revert?"+tt.query, nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		mon.handleRevert(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: responded %d, want %d", tt.query, w.Code, tt.code)
+		}
+		if tt.code == http.StatusOK {
+			if steps := strings.Count(w.Body.String(), "\n"); steps != tt.steps {
+				t.Errorf("%s: previewed %d steps, want %d", tt.query, steps, tt.steps)
+			}
+		}
+	}
+	// Only a preview is given without apply=true
+	if sent := fake.sent(); len(sent) != 0 {
+		t.Errorf("previews sent %v", sent)
+	}
+}
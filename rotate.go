@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+var stageNumberPattern = regexp.MustCompile(`\d+$`)
+
+// nextReleaseName returns the name of the release candidate after release,
+// 17.07.0-ce-rc4 for 17.07.0-ce-rc3. Releases that aren't numbered release
+// candidates have no next one.
+func nextReleaseName(release *Release) (string, bool) {
+	loc := stageNumberPattern.FindStringIndex(release.Stage)
+	if loc == nil {
+		return "", false
+	}
+	number, err := strconv.Atoi(release.Stage[loc[0]:])
+	if err != nil {
+		return "", false
+	}
+	stage := release.Stage[:loc[0]] + strconv.Itoa(number+1)
+	i := strings.LastIndex(release.Name, release.Stage)
+	return release.Name[:i] + stage + release.Name[i+len(release.Stage):], true
+}
+
+// When a release candidate project is closed the cards that aren't done yet,
+// those in the workflow's rotate columns, are carried over to the project of
+// the next release candidate, which is created if it doesn't exist yet.
+func (mon *githubMonitor) handleProjectClosedEvent(e *github.ProjectEvent, d *delivery) error {
+	ctx, cancel := context.WithTimeout(mon.ctx, 5*time.Minute)
+	defer cancel()
+	owner, name := boardOwner(e.Repo, e.Org)
+	if len(mon.config.workflowFor(owner, name).Rotate) == 0 {
+		return nil
+	}
+	release, err := mon.config.grammarFor(owner, name).Parse(*e.Project.Name)
+	if err != nil {
+		log.Debugf("%s Not rotating project %s: %v", d.URI, *e.Project.Name, err)
+		return nil
+	}
+	next, ok := nextReleaseName(release)
+	if !ok {
+		log.Infof("%s Not rotating project %s, it is not a release candidate", d.URI, *e.Project.Name)
+		return nil
+	}
+	return mon.rotateProject(ctx, owner, name, e.Project, next, d.URI)
+}
+
+// rotateCard is a card to carry over along with what it is about.
+type rotateCard struct {
+	card     *github.ProjectCard
+	column   *github.ProjectColumn
+	item     *boardItem
+	priority int
+}
+
+// cardPriority ranks the labels of an issue made of prefix and a number, like
+// priority/p0, priority/p1, ..., cards without one coming last.
+func cardPriority(labels []github.Label, prefix string) int {
+	priority := 1000
+	for _, label := range labels {
+		if label.Name == nil || !strings.HasPrefix(*label.Name, prefix) {
+			continue
+		}
+		if p, err := strconv.Atoi(strings.TrimPrefix(*label.Name, prefix)); err == nil && p < priority {
+			priority = p
+		}
+	}
+	return priority
+}
+
+// rotateProject moves the cards of the rotate columns of project from to the
+// same columns of the project named to on the board of owner/name, or the
+// organization owner if name is empty, creating it if needed. Cards keep
+// their order within a priority, with higher priorities on top. Issues moving
+// to another release get the labels of that release. Nothing happens when
+// there is nothing to carry over.
+func (mon *githubMonitor) rotateProject(ctx context.Context, owner, name string, from *github.Project, to, logPrefix string) error {
+	wf := mon.config.workflowFor(owner, name)
+	grammar := mon.config.grammarFor(owner, name)
+	fromRelease, err := grammar.Parse(*from.Name)
+	if err != nil {
+		return permanent(err)
+	}
+	toRelease, err := grammar.Parse(to)
+	if err != nil {
+		return permanent(err)
+	}
+	sourceColumns, err := mon.projectColumns(ctx, *from.ID)
+	if err != nil {
+		return err
+	}
+	carry := make(map[string][]*rotateCard)
+	total := 0
+	for _, label := range wf.Rotate {
+		columnName := wf.columnName(label)
+		for _, column := range sourceColumns {
+			if *column.Name != columnName {
+				continue
+			}
+			cards, err := mon.rotateCards(ctx, column, wf.priorityLabel())
+			if err != nil {
+				return err
+			}
+			carry[columnName] = cards
+			total += len(cards)
+		}
+	}
+	if total == 0 {
+		log.Infof("%s Nothing to carry over from %s to %s", logPrefix, *from.Name, to)
+		return nil
+	}
+	projects, err := mon.listProjects(ctx, owner, name, "all")
+	if err != nil {
+		return err
+	}
+	var dest *github.Project
+	for _, project := range projects {
+		if *project.Name == to {
+			dest = project
+		}
+	}
+	if dest == nil {
+		opt := &github.ProjectOptions{
+			Name: to,
+			Body: fmt.Sprintf("Carried over from %s", *from.Name),
+		}
+		if dest, err = mon.createProject(ctx, owner, name, opt); err != nil {
+			return err
+		}
+		log.Infof("%s Created project %s", logPrefix, to)
+		if mon.dryRun {
+			// There are no columns to look at in a project that wasn't made
+			log.Infof("%s Would have carried over %d card(s) to %s", logPrefix, total, to)
+			return nil
+		}
+	}
+	// Don't wait for the created webhook to set up the columns
+	if err := mon.setupProject(ctx, owner, name, *dest.ID, *dest.Name); err != nil {
+		return err
+	}
+	destColumns, err := mon.projectColumns(ctx, *dest.ID)
+	if err != nil {
+		return err
+	}
+	for _, label := range wf.Rotate {
+		columnName := wf.columnName(label)
+		cards := carry[columnName]
+		var destColumn *github.ProjectColumn
+		for _, column := range destColumns {
+			if *column.Name == columnName {
+				destColumn = column
+			}
+		}
+		if len(cards) == 0 || destColumn == nil {
+			continue
+		}
+		// New cards go on top of the column, so the last one is created first
+		for i := len(cards) - 1; i >= 0; i-- {
+			c := cards[i]
+			_, resp, err := mon.createCard(ctx, dest, destColumn, c.item)
+			// A retried rotation may have carried it over already
+			if err != nil && (resp == nil || resp.StatusCode != 422) {
+				return err
+			}
+			if err := mon.deleteCard(ctx, from, c.item, *c.card.ID, c.column); err != nil {
+				return err
+			}
+			if toRelease.Prefix != fromRelease.Prefix {
+				if err := mon.syncLabels(ctx, c.item.Owner, c.item.Repo, c.item.Number, toRelease.Prefix, wf, columnName); err != nil {
+					return err
+				}
+			}
+			log.Infof("%s %s/%s -> %s/%s: %s/%s#%d", logPrefix, *from.Name, columnName, to, columnName, c.item.Owner, c.item.Repo, c.item.Number)
+		}
+	}
+	return nil
+}
+
+// carriedOver reports whether the issue or pull request at contentURL has a
+// card on another open project of release than project, as rotating leaves
+// behind when it deletes the card of the release candidate it carried over.
+func (mon *githubMonitor) carriedOver(ctx context.Context, owner, name string, project *github.Project, release *Release, contentURL string) (bool, error) {
+	projects, err := mon.openProjects(ctx, owner, name)
+	if err != nil {
+		return false, err
+	}
+	grammar := mon.config.grammarFor(owner, name)
+	for _, other := range projects {
+		if *other.ID == *project.ID {
+			continue
+		}
+		if r, err := grammar.Parse(*other.Name); err != nil || r.Prefix != release.Prefix {
+			continue
+		}
+		if err := mon.indexProject(ctx, *other.ID); err != nil {
+			return false, err
+		}
+		if _, found := mon.cards.find(*other.ID, contentURL); found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rotateCards lists the cards of a column in the order of their priority
+// labels, which start with priorityLabel.
+func (mon *githubMonitor) rotateCards(ctx context.Context, column *github.ProjectColumn, priorityLabel string) ([]*rotateCard, error) {
+	columnCards, err := mon.columnCards(ctx, *column.ID)
+	if err != nil {
+		return nil, err
+	}
+	var cards []*rotateCard
+	for _, card := range columnCards {
+		if card.ContentURL == nil {
+			continue
+		}
+		issueOwner, issueRepo, number, err := contentIssue(*card.ContentURL)
+		if err != nil {
+			return nil, err
+		}
+		item, issue, err := mon.getItem(ctx, issueRef{issueOwner, issueRepo, number})
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, &rotateCard{card: card, column: column, item: item, priority: cardPriority(issue.Labels, priorityLabel)})
+	}
+	sort.SliceStable(cards, func(i, j int) bool { return cards[i].priority < cards[j].priority })
+	return cards, nil
+}
+
+// rotateCommand carries the unfinished cards of a project over to the next
+// release candidate, or to the named project, and closes it:
+//
+//	release-bot rotate <owner/name|org> <project> [<next project>]
+func rotateCommand(mon *githubMonitor, args []string) error {
+	flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 && flags.NArg() != 3 {
+		return fmt.Errorf("usage: release-bot rotate <owner/name|org> <project> [<next project>]")
+	}
+	owner, name := splitBoard(flags.Arg(0))
+	ctx, cancel := context.WithTimeout(mon.ctx, 30*time.Minute)
+	defer cancel()
+	m, err := mon.forOwner(ctx, owner, name)
+	if err != nil {
+		return err
+	}
+	projects, err := m.listProjects(ctx, owner, name, "all")
+	if err != nil {
+		return err
+	}
+	var from *github.Project
+	for _, project := range projects {
+		if *project.Name == flags.Arg(1) {
+			from = project
+		}
+	}
+	if from == nil {
+		return fmt.Errorf("no project named %s", flags.Arg(1))
+	}
+	to := flags.Arg(2)
+	if to == "" {
+		release, err := m.config.grammarFor(owner, name).Parse(*from.Name)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if to, ok = nextReleaseName(release); !ok {
+			return fmt.Errorf("%s is not a release candidate, name the next project", *from.Name)
+		}
+	}
+	if err := m.rotateProject(ctx, owner, name, from, to, "rotate"); err != nil {
+		return err
+	}
+	// Closing the project last leaves nothing for the closed webhook to
+	// carry over to a release candidate of its own choosing
+	return m.setProjectState(ctx, owner, name, from, "closed")
+}
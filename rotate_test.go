@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestNextReleaseName(t *testing.T) {
+	tests := []struct {
+		grammar string
+		name    string
+		next    string
+		ok      bool
+	}{
+		{"docker", "17.07.0-ce-rc3", "17.07.0-ce-rc4", true},
+		{"docker", "17.06.1-ee-1-rc9", "17.06.1-ee-1-rc10", true},
+		{"docker", "17.06.1-ee-1-beta2", "17.06.1-ee-1-beta3", true},
+		{"docker", "17.06.2-ee-5", "", false},
+		{"docker", "17.06.1-ee-1-rc", "", false},
+		{"semver", "v1.4.0-rc.2", "v1.4.0-rc.3", true},
+		{"semver", "1.4.0-beta.1+build.5", "1.4.0-beta.2+build.5", true},
+		{"calver", "2017.10.1-rc1", "2017.10.1-rc2", true},
+	}
+	for _, tt := range tests {
+		grammar, err := newReleaseGrammar(tt.grammar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release, err := grammar.Parse(tt.name)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.name, err)
+		}
+		next, ok := nextReleaseName(release)
+		if next != tt.next || ok != tt.ok {
+			t.Errorf("nextReleaseName(%q) = %q, %v, want %q, %v", tt.name, next, ok, tt.next, tt.ok)
+		}
+	}
+}
+
+func TestCardPriority(t *testing.T) {
+	labels := func(names ...string) []github.Label {
+		var labels []github.Label
+		for i := range names {
+			labels = append(labels, github.Label{Name: &names[i]})
+		}
+		return labels
+	}
+	tests := []struct {
+		labels []github.Label
+		prefix string
+		want   int
+	}{
+		{labels("priority/p1"), "priority/p", 1},
+		{labels("priority/p2", "kind/bug", "priority/p0"), "priority/p", 0},
+		{labels("priority/high"), "priority/p", 1000},
+		{labels("kind/bug"), "priority/p", 1000},
+		{[]github.Label{{}}, "priority/p", 1000},
+		{nil, "priority/p", 1000},
+		{labels("P2", "priority/p0"), "P", 2},
+		{labels("priority/p0"), "P", 1000},
+	}
+	for _, tt := range tests {
+		if got := cardPriority(tt.labels, tt.prefix); got != tt.want {
+			t.Errorf("cardPriority(%v, %q) = %d, want %d", tt.labels, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestCarriedOverCardKeepsLabels(t *testing.T) {
+	labeled := `[{"name":"17.06.1-ee-1/triage"}]`
+	deleted := func(number string) *github.ProjectCardEvent {
+		return &github.ProjectCardEvent{
+			Action: github.String("deleted"),
+			ProjectCard: &github.ProjectCard{
+				ID:         github.Int(31),
+				ColumnURL:  github.String("https://api.github.com/projects/columns/21"),
+				ContentURL: github.String("https://api.github.com/repos/docker/cli/issues/" + number),
+			},
+			Repo: &github.Repository{Name: github.String("cli"), Owner: &github.User{Login: github.String("docker")}},
+		}
+	}
+	tests := []struct {
+		number string
+		want   []string
+	}{
+		// Rotated onto rc2 along with its labels
+		{"1", nil},
+		// Removed from the release
+		{"2", []string{"DELETE /repos/docker/cli/issues/2/labels/17.06.1-ee-1/triage"}},
+	}
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		fake := newFakeGitHub(map[string]fakeResponse{
+			"GET /projects/columns/21":                                     {body: `{"id":21,"name":"Triage","project_url":"https://api.github.com/projects/2"}`},
+			"GET /projects/2":                                              {body: `{"id":2,"name":"17.06.1-ee-1-rc1"}`},
+			"GET /repos/docker/cli/projects":                               {body: `[{"id":2,"name":"17.06.1-ee-1-rc1"},{"id":3,"name":"17.06.2-ee-1-rc1"},{"id":4,"name":"17.06.1-ee-1-rc2"}]`},
+			"GET /projects/4/columns":                                      {body: `[{"id":41,"name":"Triage"}]`},
+			"GET /projects/columns/41/cards":                               {body: `[{"id":51,"content_url":"https://api.github.com/repos/docker/cli/issues/1"}]`},
+			"GET /repos/docker/cli/issues/1/labels":                        {body: labeled},
+			"GET /repos/docker/cli/issues/2/labels":                        {body: labeled},
+			"DELETE /repos/docker/cli/issues/2/labels/17.06.1-ee-1/triage": {code: http.StatusNoContent},
+		})
+		// Without recognizing echoes
+		mon := &githubMonitor{ctx: context.Background(), client: fake.client(), config: cfg, metrics: newMetrics(), cards: newCardIndex(time.Hour)}
+		if err := mon.handleProjectCardDeletedEvent(deleted(tt.number), &delivery{URI: "/docker/cli"}); err != nil {
+			t.Fatal(err)
+		}
+		var changes []string
+		for _, request := range fake.sent() {
+			if !strings.HasPrefix(request, "GET ") {
+				changes = append(changes, request)
+			}
+		}
+		if !reflect.DeepEqual(changes, tt.want) {
+			t.Errorf("deleting the card of #%s changed %v, want %v", tt.number, changes, tt.want)
+		}
+		fake.Close()
+	}
+}
@@ -8,16 +8,28 @@ import (
 	"github.com/google/go-github/github"
 )
 
-func CreateProject(client *github.Client, ctx context.Context, projectName, repoOwner, repoName string) (*github.Project, error) {
+func projectOptions(projectName string) *github.ProjectOptions {
 	opt := &github.ProjectOptions{Name: projectName, Body: ""}
 	info := strings.Split(projectName, "-") //ex. 18.02.0-ce-rc2 -> [18.02.0, ce, rc2]
 	if len(info) == 3 {
 		opt.Body = fmt.Sprintf(`Docker %s %s %s release`, info[0], strings.ToUpper(info[1]), strings.ToUpper(info[2]))
 	}
-	project, _, err := client.Repositories.CreateProject(ctx, repoOwner, repoName, opt)
+	return opt
+}
+
+func CreateProject(client *github.Client, ctx context.Context, projectName, repoOwner, repoName string) (*github.Project, error) {
+	project, _, err := client.Repositories.CreateProject(ctx, repoOwner, repoName, projectOptions(projectName))
 	if err != nil {
 		return nil, fmt.Errorf("Project '%s' failed to create project", projectName)
 	} else {
 		return project, nil
 	}
 }
+
+func CreateOrgProject(client *github.Client, ctx context.Context, projectName, org string) (*github.Project, error) {
+	project, _, err := client.Organizations.CreateProject(ctx, org, projectOptions(projectName))
+	if err != nil {
+		return nil, fmt.Errorf("Project '%s' failed to create project", projectName)
+	}
+	return project, nil
+}
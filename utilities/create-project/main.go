@@ -6,8 +6,8 @@ import (
 
 	"github.com/google/go-github/github"
 	"github.com/seemethere/release-bot/utilities/create-project/cmd"
+	"github.com/seemethere/release-bot/utilities/githubclient"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -16,7 +16,10 @@ var (
 	projectName            = kingpin.Arg("source-project", "Name of the project to create").Required().String()
 	repoName               = kingpin.Flag("repo-name", "Name of the repository to point to").Short('r').Default("staging-release-tracking").String()
 	repoOwner              = kingpin.Flag("repo-owner", "Name of the owner of the repository to point to").Short('o').Default("docker").String()
+	orgName                = kingpin.Flag("org", "Create an organization project instead of a repository project").String()
 	verbose                = kingpin.Flag("verbose", "See debug statements").Short('v').Bool()
+	appID                  = kingpin.Flag("app-id", "ID of a GitHub App to authenticate as instead of using GITHUB_TOKEN").Envar("GITHUB_APP_ID").Int64()
+	appKey                 = kingpin.Flag("app-key", "Path to the private key of the GitHub App").Envar("GITHUB_APP_KEY").String()
 )
 
 func main() {
@@ -26,11 +29,26 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: os.Getenv(githubTokenEnvVariable)},
-	)
-	client := github.NewClient(oauth2.NewClient(ctx, ts))
-	_, err := cmd.CreateProject(client, ctx, *projectName, *repoOwner, *repoName)
+	// The installation of --app-id on the repository or organization, or
+	// GITHUB_TOKEN without one
+	httpClient, err := githubclient.New(ctx, githubclient.Options{
+		Token:  os.Getenv(githubTokenEnvVariable),
+		AppID:  *appID,
+		AppKey: *appKey,
+		Org:    *orgName,
+		Owner:  *repoOwner,
+		Repo:   *repoName,
+	})
+	if err != nil {
+		log.Errorf("Could not authenticate with GitHub: %v", err)
+		os.Exit(1)
+	}
+	client := github.NewClient(httpClient)
+	if *orgName != "" {
+		_, err = cmd.CreateOrgProject(client, ctx, *projectName, *orgName)
+	} else {
+		_, err = cmd.CreateProject(client, ctx, *projectName, *repoOwner, *repoName)
+	}
 
 	if err != nil {
 		log.Errorf("Source %v", err)
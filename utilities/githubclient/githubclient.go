@@ -0,0 +1,57 @@
+// Package githubclient authenticates the release-bot utilities against
+// GitHub.
+//
+// The utilities take either a personal access token or a GitHub App, which
+// acts as its installation on the repository or organization they work on.
+// Either way requests go through ratelimit, so long transfers wait out the
+// rate limit instead of stopping halfway.
+package githubclient
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/seemethere/release-bot/githubapp"
+	"github.com/seemethere/release-bot/ratelimit"
+	"golang.org/x/oauth2"
+)
+
+// Options says how to authenticate and, for an app, where it is installed.
+type Options struct {
+	// Token is used unless AppID is set.
+	Token string
+	// AppID and AppKey, the path of the app's private key, identify a GitHub
+	// App to authenticate as instead.
+	AppID  int64
+	AppKey string
+	// Org is the organization the app is installed on, or if it is empty,
+	// Owner/Repo the repository.
+	Org   string
+	Owner string
+	Repo  string
+}
+
+// New returns an http.Client to create a go-github client with.
+func New(ctx context.Context, opts Options) (*http.Client, error) {
+	limiter := ratelimit.New(nil)
+	if opts.AppID == 0 {
+		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: opts.Token})
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: limiter})
+		return oauth2.NewClient(ctx, ts), nil
+	}
+	app, err := githubapp.NewFromFile(opts.AppID, opts.AppKey)
+	if err != nil {
+		return nil, err
+	}
+	app.Client = &http.Client{Transport: limiter}
+	var installationID int64
+	if opts.Org != "" {
+		installationID, err = app.OrgInstallation(ctx, opts.Org)
+	} else {
+		installationID, err = app.Installation(ctx, opts.Owner, opts.Repo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: app.Transport(installationID, limiter)}, nil
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/go-github/github"
+	"github.com/seemethere/release-bot/paginate"
+	"github.com/seemethere/release-bot/utilities/githubclient"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -21,39 +23,61 @@ var (
 	columnsToMove          = kingpin.Flag("columns", "Columns to pull from, comma separated").Short('c').Default("Triage,Cherry Pick").String()
 	repoName               = kingpin.Flag("repo-name", "Name of the repository to point to").Short('r').Default("staging-release-tracking").String()
 	repoOwner              = kingpin.Flag("repo-owner", "Name of the owner of the repository to point to").Short('o').Default("docker").String()
+	orgName                = kingpin.Flag("org", "Transfer cards between projects of this organization instead of the repository").String()
 	verbose                = kingpin.Flag("verbose", "See debug statements").Short('v').Bool()
+	appID                  = kingpin.Flag("app-id", "ID of a GitHub App to authenticate as instead of using GITHUB_TOKEN").Envar("GITHUB_APP_ID").Int64()
+	appKey                 = kingpin.Flag("app-key", "Path to the private key of the GitHub App").Envar("GITHUB_APP_KEY").String()
 )
 
+// projectOwner describes where projects are looked up and created, for log
+// and error messages.
+func projectOwner() string {
+	if *orgName != "" {
+		return fmt.Sprintf("organization %s", *orgName)
+	}
+	return fmt.Sprintf("repo %s/%s", *repoOwner, *repoName)
+}
+
+func listProjects(client *github.Client, ctx context.Context, opt *github.ProjectListOptions) ([]*github.Project, *github.Response, error) {
+	if *orgName != "" {
+		return client.Organizations.ListProjects(ctx, *orgName, opt)
+	}
+	return client.Repositories.ListProjects(ctx, *repoOwner, *repoName, opt)
+}
+
 func getProject(client *github.Client, ctx context.Context, projectName string, source bool) (*github.Project, error) {
-	log.Debugf("Attempting to find project %s for repo %s/%s", projectName, *repoOwner, *repoName)
+	log.Debugf("Attempting to find project %s for %s", projectName, projectOwner())
 
 	var project *github.Project
 
-	opt := &github.ProjectListOptions{State: "all"}
-	for {
-		projects, resp, getProjectErr := client.Repositories.ListProjects(ctx, *repoOwner, *repoName, opt)
-		if getProjectErr != nil {
-			log.Errorf("Could not grab existing projects for %s/%s: %v", *repoOwner, *repoName, getProjectErr)
-			break
+	getProjectErr := paginate.Pages(ctx, func(page int) (int, error) {
+		opt := &github.ProjectListOptions{State: "all", ListOptions: *listPage(page)}
+		projects, resp, err := listProjects(client, ctx, opt)
+		if err != nil {
+			return 0, err
 		}
-		for _, project := range projects {
-			if *project.Name == projectName {
-				return project, nil
+		for _, p := range projects {
+			if *p.Name == projectName {
+				project = p
+				return 0, nil
 			}
 		}
-		if resp.NextPage == 0 {
-			break
-		}
-		opt.Page = resp.NextPage
+		return resp.NextPage, nil
+	})
+	if getProjectErr != nil {
+		log.Errorf("Could not grab existing projects for %s: %v", projectOwner(), getProjectErr)
+	}
+	if project != nil {
+		return project, nil
 	}
 
 	// don't want to create a project if the project is a source project
 	if source {
-		return nil, fmt.Errorf("project '%s' not found in repo %s/%s", projectName, *repoOwner, *repoName)
+		return nil, fmt.Errorf("project '%s' not found in %s", projectName, projectOwner())
 	}
 	// if this is a dry run do not create the project
 	if *dryrun {
-		return nil, fmt.Errorf("project '%s' not found in repo %s/%s if you would like the utility to create the project rerun without the dryrun option", projectName, *repoOwner, *repoName)
+		return nil, fmt.Errorf("project '%s' not found in %s if you would like the utility to create the project rerun without the dryrun option", projectName, projectOwner())
 	}
 
 	// the project was not found so try creating the project
@@ -77,7 +101,7 @@ func releaseBotDone(client *github.Client, ctx context.Context, projectID int) (
 	for retries < 4 && columnsLength != 3 {
 		log.Infof("Release bot progress: retries: %d, project columns:  %d", retries, columnsLength)
 
-		columns, _, err := client.Projects.ListProjectColumns(context.Background(), projectID, &github.ListOptions{})
+		columns, err := projectColumns(client, ctx, projectID)
 		if err != nil {
 			return false, err
 		}
@@ -100,7 +124,13 @@ func createProject(client *github.Client, ctx context.Context, projectName strin
 	if len(info) == 3 {
 		opt.Body = fmt.Sprintf(`Docker %s %s %s release`, info[0], strings.ToUpper(info[1]), strings.ToUpper(info[2]))
 	}
-	project, _, err := client.Repositories.CreateProject(ctx, *repoOwner, *repoName, opt)
+	var project *github.Project
+	var err error
+	if *orgName != "" {
+		project, _, err = client.Organizations.CreateProject(ctx, *orgName, opt)
+	} else {
+		project, _, err = client.Repositories.CreateProject(ctx, *repoOwner, *repoName, opt)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Project '%s' failed to create project", projectName)
 	}
@@ -136,55 +166,95 @@ func getRelatedIssue(card *github.ProjectCard, issues []*github.Issue) (*github.
 }
 
 func allIssues(client *github.Client, ctx context.Context) ([]*github.Issue, error) {
-	opt := &github.IssueListByRepoOptions{}
 	var issues []*github.Issue
-	for {
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		opt := &github.IssueListByRepoOptions{ListOptions: *listPage(page)}
 		issuesByPage, resp, err := client.Issues.ListByRepo(ctx, *repoOwner, *repoName, opt)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 		issues = append(issues, issuesByPage...)
-		if resp.NextPage == 0 {
-			break
+		return resp.NextPage, nil
+	})
+	return issues, err
+}
+
+// cardIssues adds the issues of cards that aren't in issues yet. Organization
+// projects hold issues from several repositories so they are fetched one by one.
+func cardIssues(client *github.Client, ctx context.Context, cards []*github.ProjectCard, issues []*github.Issue) ([]*github.Issue, error) {
+	for _, card := range cards {
+		if card.ContentURL == nil {
+			continue
+		}
+		if _, err := getRelatedIssue(card, issues); err == nil {
+			continue
+		}
+		issueBits := strings.Split(*card.ContentURL, "/")
+		if len(issueBits) < 4 {
+			return nil, fmt.Errorf("card %s has unexpected content url %s", *card.URL, *card.ContentURL)
 		}
-		opt.Page = resp.NextPage
+		number, err := strconv.Atoi(issueBits[len(issueBits)-1])
+		if err != nil {
+			return nil, err
+		}
+		issue, _, err := client.Issues.Get(ctx, issueBits[len(issueBits)-4], issueBits[len(issueBits)-3], number)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, issue)
 	}
 	return issues, nil
 }
 
 func getCards(client *github.Client, ctx context.Context, sourceColumnID int) ([]*github.ProjectCard, error) {
-	opt := &github.ListOptions{}
 	var cards []*github.ProjectCard
-	for {
-		sourceCardsByPage, resp, err := client.Projects.ListProjectCards(ctx, sourceColumnID, opt)
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		sourceCardsByPage, resp, err := client.Projects.ListProjectCards(ctx, sourceColumnID, listPage(page))
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-
 		cards = append(cards, sourceCardsByPage...)
-		if resp.NextPage == 0 {
-			break
+		return resp.NextPage, nil
+	})
+	return cards, err
+}
+
+func projectColumns(client *github.Client, ctx context.Context, projectID int) ([]*github.ProjectColumn, error) {
+	var columns []*github.ProjectColumn
+	err := paginate.Pages(ctx, func(page int) (int, error) {
+		columnsByPage, resp, err := client.Projects.ListProjectColumns(ctx, projectID, listPage(page))
+		if err != nil {
+			return 0, err
 		}
-		opt.Page = resp.NextPage
-	}
-	return cards, nil
+		columns = append(columns, columnsByPage...)
+		return resp.NextPage, nil
+	})
+	return columns, err
+}
+
+// listPage asks for a page of as many items as GitHub hands out at once.
+func listPage(page int) *github.ListOptions {
+	return &github.ListOptions{Page: page, PerPage: paginate.PerPage}
 }
 
 func moveIssues(client *github.Client, ctx context.Context, sourceProject, destProject *github.Project, columns []string) {
-	sourceColumns, _, err := client.Projects.ListProjectColumns(ctx, *sourceProject.ID, nil)
+	sourceColumns, err := projectColumns(client, ctx, *sourceProject.ID)
 	if err != nil {
 		log.Errorf("Error grabbing columns for project %s: %v", *sourceProject.Name, err)
 		os.Exit(1)
 	}
-	destColumns, _, err := client.Projects.ListProjectColumns(ctx, *destProject.ID, nil)
+	destColumns, err := projectColumns(client, ctx, *destProject.ID)
 	if err != nil {
 		log.Errorf("Error grabbing columns for project %s: %v", *destProject.Name, err)
 		os.Exit(1)
 	}
-	issues, err := allIssues(client, ctx)
-	if err != nil {
-		log.Errorf("Error grabbing issues for repo: %v", err)
-		os.Exit(1)
+	var issues []*github.Issue
+	if *orgName == "" {
+		issues, err = allIssues(client, ctx)
+		if err != nil {
+			log.Errorf("Error grabbing issues for repo: %v", err)
+			os.Exit(1)
+		}
 	}
 	for _, column := range columns {
 		var p0Cards, p1Cards, p2Cards, noPCards []*github.ProjectCard
@@ -203,6 +273,13 @@ func moveIssues(client *github.Client, ctx context.Context, sourceProject, destP
 			log.Errorf("Error retrieving source project cards")
 			os.Exit(1)
 		}
+		if *orgName != "" {
+			issues, err = cardIssues(client, ctx, sourceCards, issues)
+			if err != nil {
+				log.Errorf("Error grabbing issues for cards: %v", err)
+				os.Exit(1)
+			}
+		}
 		for _, card := range sourceCards {
 			relatedIssue, err := getRelatedIssue(card, issues)
 			var priority string
@@ -288,10 +365,21 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: os.Getenv(githubTokenEnvVariable)},
-	)
-	client := github.NewClient(oauth2.NewClient(ctx, ts))
+	// The installation of --app-id on the repository or organization, or
+	// GITHUB_TOKEN without one
+	httpClient, err := githubclient.New(ctx, githubclient.Options{
+		Token:  os.Getenv(githubTokenEnvVariable),
+		AppID:  *appID,
+		AppKey: *appKey,
+		Org:    *orgName,
+		Owner:  *repoOwner,
+		Repo:   *repoName,
+	})
+	if err != nil {
+		log.Errorf("Could not authenticate with GitHub: %v", err)
+		os.Exit(1)
+	}
+	client := github.NewClient(httpClient)
 	sourceProject, err := getProject(client, ctx, *sourceProjectName, true)
 	if err != nil {
 		log.Errorf("Source %v", err)